@@ -0,0 +1,279 @@
+package analyze
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --------------------------------------------------------
+// Report Definition
+// --------------------------------------------------------
+
+const (
+	IssueDigestMismatch string = "digest-mismatch"
+	IssueOutOfRange     string = "out-of-range"
+	IssueTimerExpired   string = "timer-expired"
+	IssueNotCommitted   string = "not-committed"
+)
+
+// Step is what one log tells about a sequence number, a nil time was not
+// logged
+type Step struct {
+	Source             string     `json:"source"`
+	Request            *time.Time `json:"request,omitempty"`
+	PreprepareSent     *time.Time `json:"preprepare_sent,omitempty"`
+	PreprepareReceived *time.Time `json:"preprepare_received,omitempty"`
+	Prepares           int        `json:"prepares"`
+	Prepared           *time.Time `json:"prepared,omitempty"`
+	Commits            int        `json:"commits"`
+	Committed          *time.Time `json:"committed,omitempty"`
+	ReplySent          *time.Time `json:"reply_sent,omitempty"`
+	Replies            int        `json:"replies,omitempty"`
+	FirstReply         *time.Time `json:"first_reply,omitempty"`
+	Accepted           *time.Time `json:"accepted,omitempty"`
+}
+
+// Timeline collects the steps of every log for one sequence number
+type Timeline struct {
+	Seq   int64     `json:"seq"`
+	Start time.Time `json:"start"`
+	Steps []*Step   `json:"steps"`
+}
+
+type Issue struct {
+	Kind   string    `json:"kind"`
+	Source string    `json:"source"`
+	File   string    `json:"file,omitempty"`
+	Line   int       `json:"line,omitempty"`
+	Time   time.Time `json:"time"`
+	Seq    int64     `json:"seq"`
+	Detail string    `json:"detail"`
+}
+
+type Report struct {
+	Sources   []string   `json:"sources"`
+	Lines     int        `json:"lines"`
+	Timelines []Timeline `json:"timelines"`
+	Issues    []Issue    `json:"issues"`
+	// error and warn lines that are not an issue, per source
+	OtherErrors map[string]int `json:"other_errors"`
+}
+
+// Filter keeps the sequence numbers in [FromSeq, ToSeq], a negative bound is
+// open. Issues without a sequence number are always kept.
+type Filter struct {
+	FromSeq int64
+	ToSeq   int64
+}
+
+func (f Filter) keeps(seq int64) bool {
+	return seq < 0 || ((f.FromSeq < 0 || seq >= f.FromSeq) && (f.ToSeq < 0 || seq <= f.ToSeq))
+}
+
+// --------------------------------------------------------
+// Events
+// --------------------------------------------------------
+
+// where a line without a sequence number belongs
+const (
+	// the last sequence number the log named, e.g. the sends after a quorum
+	attachLast = iota
+	// the next sequence number the log names, e.g. the request the primary
+	// assigns one to
+	attachNext
+)
+
+type event struct {
+	pattern *regexp.Regexp
+	attach  int
+	apply   func(step *Step, line Line)
+}
+
+func at(t time.Time) *time.Time {
+	return &t
+}
+
+func setOnce(field **time.Time, t time.Time) {
+	if *field == nil {
+		*field = at(t)
+	}
+}
+
+// events match the messages of the current and of the older format, which
+// named peers by address and logged the commit quorum as a prepare quorum
+var events = []event{
+	{regexp.MustCompile(`^Received request message from`), attachNext, func(s *Step, l Line) { setOnce(&s.Request, l.Time) }},
+	{regexp.MustCompile(`^Msg Sent: MsgRequestMessage`), attachNext, func(s *Step, l Line) { setOnce(&s.Request, l.Time) }},
+	{regexp.MustCompile(`^Send preprepare message to`), attachNext, func(s *Step, l Line) { setOnce(&s.PreprepareSent, l.Time) }},
+	{regexp.MustCompile(`Received preprepare message from`), attachLast, func(s *Step, l Line) { setOnce(&s.PreprepareReceived, l.Time) }},
+	{regexp.MustCompile(`Received prepare message from`), attachLast, func(s *Step, l Line) { s.Prepares++ }},
+	{regexp.MustCompile(`prepare messages, enough to commit the block`), attachLast, func(s *Step, l Line) {
+		if s.Prepared == nil {
+			s.Prepared = at(l.Time)
+		} else {
+			setOnce(&s.Committed, l.Time)
+		}
+	}},
+	{regexp.MustCompile(`Received commit message from`), attachLast, func(s *Step, l Line) { s.Commits++ }},
+	{regexp.MustCompile(`commit messages, enough to reply to client`), attachLast, func(s *Step, l Line) { setOnce(&s.Committed, l.Time) }},
+	{regexp.MustCompile(`^Send reply message to`), attachLast, func(s *Step, l Line) { setOnce(&s.ReplySent, l.Time) }},
+	{regexp.MustCompile(`^Received reply message from`), attachLast, func(s *Step, l Line) {
+		s.Replies++
+		setOnce(&s.FirstReply, l.Time)
+	}},
+	{regexp.MustCompile(`^Accepted result of sequence number`), attachLast, func(s *Step, l Line) { setOnce(&s.Accepted, l.Time) }},
+}
+
+var timerExpired = regexp.MustCompile(`Timer '([^']+)' expired`)
+
+// issueOf flags a line, the second result is false for a line that is fine
+func issueOf(line Line) (Issue, bool) {
+	issue := Issue{Source: line.Source, File: line.File, Line: line.Number, Time: line.Time, Seq: line.Seq, Detail: line.Msg}
+	switch {
+	case strings.Contains(line.Msg, "digest mismatch"):
+		issue.Kind = IssueDigestMismatch
+	case strings.Contains(line.Msg, "out of range"):
+		issue.Kind = IssueOutOfRange
+	case timerExpired.MatchString(line.Msg):
+		issue.Kind = IssueTimerExpired
+		issue.Detail = "timer " + timerExpired.FindStringSubmatch(line.Msg)[1] + " expired"
+	default:
+		return issue, false
+	}
+	return issue, true
+}
+
+// --------------------------------------------------------
+// Analysis
+// --------------------------------------------------------
+
+// AnalyzeDir reads the node and client logs of dir
+func AnalyzeDir(dir string, f Filter) (*Report, error) {
+	files, err := LogFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{
+		Timelines:   make([]Timeline, 0),
+		Issues:      make([]Issue, 0),
+		OtherErrors: make(map[string]int),
+	}
+	for source := range files {
+		report.Sources = append(report.Sources, source)
+	}
+	sort.Strings(report.Sources)
+
+	steps := make(map[int64]map[string]*Step)
+	stepOf := func(seq int64, source string) *Step {
+		if steps[seq] == nil {
+			steps[seq] = make(map[string]*Step)
+		}
+		if steps[seq][source] == nil {
+			steps[seq][source] = &Step{Source: source}
+		}
+		return steps[seq][source]
+	}
+
+	for _, source := range report.Sources {
+		lines, err := readLines(source, files[source])
+		if err != nil {
+			return nil, err
+		}
+		report.Lines += len(lines)
+		last := int64(-1)
+		pending := make([]func(seq int64), 0)
+		for _, line := range lines {
+			line := line
+			if line.Seq >= 0 {
+				last = line.Seq
+				for _, apply := range pending {
+					apply(line.Seq)
+				}
+				pending = pending[:0]
+			}
+			if issue, ok := issueOf(line); ok {
+				if issue.Seq < 0 && issue.Kind != IssueTimerExpired {
+					issue.Seq = last
+				}
+				if f.keeps(issue.Seq) {
+					report.Issues = append(report.Issues, issue)
+				}
+				continue
+			}
+			if line.Level == "ERROR" || line.Level == "WARN" {
+				report.OtherErrors[source]++
+			}
+			for _, e := range events {
+				if !e.pattern.MatchString(line.Msg) {
+					continue
+				}
+				e := e
+				switch {
+				case line.Seq >= 0:
+					e.apply(stepOf(line.Seq, source), line)
+				case e.attach == attachNext:
+					pending = append(pending, func(seq int64) { e.apply(stepOf(seq, source), line) })
+				case last >= 0:
+					e.apply(stepOf(last, source), line)
+				}
+				break
+			}
+		}
+	}
+
+	seqs := make([]int64, 0, len(steps))
+	for seq := range steps {
+		if f.keeps(seq) {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, seq := range seqs {
+		timeline := Timeline{Seq: seq}
+		for _, source := range report.Sources {
+			step := steps[seq][source]
+			if step == nil {
+				continue
+			}
+			timeline.Steps = append(timeline.Steps, step)
+			for _, t := range step.times() {
+				if timeline.Start.IsZero() || t.Before(timeline.Start) {
+					timeline.Start = t
+				}
+			}
+			if strings.HasPrefix(source, "node_") && step.started() && step.Committed == nil {
+				report.Issues = append(report.Issues, Issue{
+					Kind:   IssueNotCommitted,
+					Source: source,
+					Seq:    seq,
+					Detail: "proposal seen but no commit quorum logged",
+				})
+			}
+		}
+		report.Timelines = append(report.Timelines, timeline)
+	}
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		if report.Issues[i].Seq != report.Issues[j].Seq {
+			return report.Issues[i].Seq < report.Issues[j].Seq
+		}
+		return report.Issues[i].Source < report.Issues[j].Source
+	})
+	return report, nil
+}
+
+func (s *Step) times() []time.Time {
+	times := make([]time.Time, 0)
+	for _, t := range []*time.Time{s.Request, s.PreprepareSent, s.PreprepareReceived, s.Prepared, s.Committed, s.ReplySent, s.FirstReply, s.Accepted} {
+		if t != nil {
+			times = append(times, *t)
+		}
+	}
+	return times
+}
+
+// started tells whether a replica saw the proposal of the sequence number
+func (s *Step) started() bool {
+	return s.PreprepareSent != nil || s.PreprepareReceived != nil || s.Prepares > 0
+}
@@ -0,0 +1,165 @@
+package analyze
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --------------------------------------------------------
+// Log Lines
+// --------------------------------------------------------
+
+// Line is one parsed line of a node or client log. Seq is -1 when the line
+// names no sequence number.
+type Line struct {
+	Source string
+	File   string
+	Number int
+	Time   time.Time
+	Level  string
+	Msg    string
+	Seq    int64
+}
+
+var (
+	// [INFO] 2006/01/02 15:04:05 message key=value ...
+	textLine = regexp.MustCompile(`^\[(\w+)\] (\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) (.*)$`)
+	// the sequence number of a line, from the field of the current format, the
+	// "SeqNumber N:" prefix or the text of the older messages
+	seqPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?:^| )seq=(-?\d+)(?: |$)`),
+		regexp.MustCompile(`^SeqNumber (\d+):`),
+		regexp.MustCompile(`sequence number (\d+)`),
+		regexp.MustCompile(`for sequence (\d+)`),
+	}
+)
+
+// parseLine reads the text format, with or without key=value fields, and the
+// JSON format of the logger
+func parseLine(source string, number int, text string) (Line, bool) {
+	line := Line{Source: source, Number: number, Seq: -1}
+	if strings.HasPrefix(text, "{") {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(text), &fields); err != nil {
+			return line, false
+		}
+		line.Level, _ = fields["level"].(string)
+		line.Msg, _ = fields["msg"].(string)
+		if t, ok := fields["time"].(string); ok {
+			line.Time, _ = time.Parse(time.RFC3339Nano, t)
+		}
+		if seq, ok := fields["seq"].(float64); ok {
+			line.Seq = int64(seq)
+		} else {
+			line.Seq = seqOf(line.Msg)
+		}
+		return line, true
+	}
+
+	match := textLine.FindStringSubmatch(text)
+	if match == nil {
+		return line, false
+	}
+	line.Level = match[1]
+	line.Time, _ = time.ParseInLocation("2006/01/02 15:04:05", match[2], time.Local)
+	line.Msg = match[3]
+	line.Seq = seqOf(line.Msg)
+	return line, true
+}
+
+func seqOf(msg string) int64 {
+	for _, pattern := range seqPatterns {
+		if match := pattern.FindStringSubmatch(msg); match != nil {
+			seq, err := strconv.ParseInt(match[1], 10, 64)
+			if err == nil {
+				return seq
+			}
+		}
+	}
+	return -1
+}
+
+// --------------------------------------------------------
+// Log Files
+// --------------------------------------------------------
+
+// LogFiles returns the node and client logs of dir grouped by source, each
+// with its rotated backups first, oldest first
+func LogFiles(dir string) (map[string][]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]string)
+	backups := make(map[string]int)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !(strings.HasPrefix(name, "node_") || strings.HasPrefix(name, "client.")) {
+			continue
+		}
+		base, backup := name, 0
+		if i := strings.Index(name, ".log."); i >= 0 {
+			n, err := strconv.Atoi(name[i+len(".log."):])
+			if err != nil {
+				continue
+			}
+			base, backup = name[:i+len(".log")], n
+		}
+		if !strings.HasSuffix(base, ".log") {
+			continue
+		}
+		source := strings.TrimSuffix(base, ".log")
+		files[source] = append(files[source], filepath.Join(dir, name))
+		backups[filepath.Join(dir, name)] = backup
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no node or client log found in %s", dir)
+	}
+	for _, paths := range files {
+		// node_0.log.2 is older than node_0.log.1, the live file has no suffix
+		sort.Slice(paths, func(i, j int) bool {
+			bi, bj := backups[paths[i]], backups[paths[j]]
+			if bi == 0 || bj == 0 {
+				return bj == 0 && bi != 0
+			}
+			return bi > bj
+		})
+	}
+	return files, nil
+}
+
+// readLines parses every file of source in order, lines of another format
+// are skipped
+func readLines(source string, paths []string) ([]Line, error) {
+	lines := make([]Line, 0)
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+		number := 0
+		for scanner.Scan() {
+			number++
+			if line, ok := parseLine(source, number, scanner.Text()); ok {
+				line.File = filepath.Base(path)
+				lines = append(lines, line)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return lines, nil
+}
@@ -0,0 +1,95 @@
+package analyze
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// --------------------------------------------------------
+// Output
+// --------------------------------------------------------
+
+func WriteJSON(w io.Writer, report *Report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// WriteText prints a table of the timelines, the times of a sequence number
+// are offsets from its first logged step, followed by the issues
+func WriteText(w io.Writer, report *Report, issuesOnly bool) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if !issuesOnly {
+		fmt.Fprintln(tw, "SEQ\tSOURCE\tSTART\tREQUEST\tPREPREPARE\tPREPARES\tPREPARED\tCOMMITS\tCOMMITTED\tREPLY")
+		for _, timeline := range report.Timelines {
+			for i, step := range timeline.Steps {
+				seq, start := "", ""
+				if i == 0 {
+					seq, start = fmt.Sprint(timeline.Seq), timeline.Start.Format("15:04:05.000")
+				}
+				preprepare, reply := "-", since(timeline.Start, step.ReplySent)
+				if step.PreprepareSent != nil {
+					preprepare = "sent " + since(timeline.Start, step.PreprepareSent)
+				} else if step.PreprepareReceived != nil {
+					preprepare = "recv " + since(timeline.Start, step.PreprepareReceived)
+				}
+				if step.Replies > 0 {
+					reply = fmt.Sprintf("%d recv, first %s", step.Replies, since(timeline.Start, step.FirstReply))
+					if step.Accepted != nil {
+						reply += ", accepted " + since(timeline.Start, step.Accepted)
+					}
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%d\t%s\t%s\n", seq, step.Source, start,
+					since(timeline.Start, step.Request), preprepare, step.Prepares,
+					since(timeline.Start, step.Prepared), step.Commits, since(timeline.Start, step.Committed), reply)
+			}
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "%d issues\n", len(report.Issues))
+	for _, issue := range report.Issues {
+		where := issue.Source
+		if issue.File != "" {
+			where = fmt.Sprintf("%s:%d", issue.File, issue.Line)
+		}
+		seq := "-"
+		if issue.Seq >= 0 {
+			seq = fmt.Sprint(issue.Seq)
+		}
+		when := "-"
+		if !issue.Time.IsZero() {
+			when = issue.Time.Format("15:04:05.000")
+		}
+		fmt.Fprintf(tw, "[%s]\tseq %s\t%s\t%s\t%s\n", issue.Kind, seq, when, where, issue.Detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	sources := make([]string, 0, len(report.OtherErrors))
+	for source := range report.OtherErrors {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		fmt.Fprintf(w, "%s: %d other error or warning lines\n", source, report.OtherErrors[source])
+	}
+	fmt.Fprintf(w, "%d lines of %v, %d sequence numbers\n", report.Lines, report.Sources, len(report.Timelines))
+	return nil
+}
+
+// since formats t as an offset from start, "-" when it was not logged
+func since(start time.Time, t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return "+" + t.Sub(start).String()
+}
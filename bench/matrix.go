@@ -0,0 +1,140 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// --------------------------------------------------------
+// Experiment Matrix
+// --------------------------------------------------------
+
+// Fault is a scenario applied to every run of the matrix
+type Fault struct {
+	Name string `json:"name"`
+	// Crash stops this many replicas, the highest ids, so the primary of view 0 keeps running
+	Crash int64 `json:"crash"`
+	// AfterSeconds kills the crashed replicas this long after the client started,
+	// 0 never starts them
+	AfterSeconds int64 `json:"after_seconds"`
+}
+
+// Matrix lists the values every run combines, each combination is run Repeat times
+type Matrix struct {
+	NodeNums     []int64 `json:"node_nums"`
+	BlockSizes   []int64 `json:"block_sizes"`
+	InjectSpeeds []int64 `json:"inject_speeds"`
+	Faults       []Fault `json:"faults"`
+
+	// MaxTxNum of every run, 0 keeps the value of run.json
+	MaxTxNum int64 `json:"max_tx_num"`
+	Repeat   int64 `json:"repeat"`
+	// TimeoutSeconds bounds the client of a run, GraceSeconds the replicas after the client exited
+	TimeoutSeconds int64  `json:"timeout_seconds"`
+	GraceSeconds   int64  `json:"grace_seconds"`
+	OutputDir      string `json:"output_dir"`
+	// Config is passed to every process as flags, e.g. {"wire_format": "protobuf"}
+	Config map[string]string `json:"config"`
+}
+
+// Run is one combination of the matrix
+type Run struct {
+	Name        string
+	NodeNum     int64
+	BlockSize   int64
+	InjectSpeed int64
+	Fault       Fault
+	Repeat      int64
+}
+
+func LoadMatrix(filename string) (*Matrix, error) {
+	jsonData, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading matrix file: %w", err)
+	}
+	m := &Matrix{
+		Repeat:         1,
+		TimeoutSeconds: 300,
+		GraceSeconds:   30,
+		OutputDir:      "results",
+	}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(m); err != nil {
+		return nil, fmt.Errorf("error parsing matrix file %s: %w", filename, err)
+	}
+	if len(m.Faults) == 0 {
+		m.Faults = []Fault{{Name: "none"}}
+	}
+	for i := range m.Faults {
+		if m.Faults[i].Name == "" {
+			m.Faults[i].Name = fmt.Sprintf("crash_%d", m.Faults[i].Crash)
+		}
+	}
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid matrix %s: %w", filename, err)
+	}
+	return m, nil
+}
+
+// Validate reports every invalid field at once
+func (m *Matrix) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(len(m.NodeNums) > 0, "node_nums must not be empty")
+	check(len(m.BlockSizes) > 0, "block_sizes must not be empty")
+	check(len(m.InjectSpeeds) > 0, "inject_speeds must not be empty")
+	for _, n := range m.NodeNums {
+		check(n > 0, "node_nums must be positive, got %d", n)
+		for _, fault := range m.Faults {
+			check(fault.Crash < n, "fault %s crashes %d of %d nodes, the primary has to keep running", fault.Name, fault.Crash, n)
+		}
+	}
+	for _, size := range m.BlockSizes {
+		check(size > 0, "block_sizes must be positive, got %d", size)
+	}
+	for _, speed := range m.InjectSpeeds {
+		check(speed > 0, "inject_speeds must be positive, got %d", speed)
+	}
+	for _, fault := range m.Faults {
+		check(fault.Crash >= 0, "fault %s must not crash a negative number of nodes", fault.Name)
+		check(fault.AfterSeconds >= 0, "fault %s must not have a negative after_seconds", fault.Name)
+	}
+	check(m.MaxTxNum >= 0, "max_tx_num must not be negative, got %d", m.MaxTxNum)
+	check(m.Repeat > 0, "repeat must be positive, got %d", m.Repeat)
+	check(m.TimeoutSeconds > 0, "timeout_seconds must be positive, got %d", m.TimeoutSeconds)
+	check(m.GraceSeconds >= 0, "grace_seconds must not be negative, got %d", m.GraceSeconds)
+	check(m.OutputDir != "", "output_dir must not be empty")
+	return errors.Join(errs...)
+}
+
+// Runs returns every combination in a stable order
+func (m *Matrix) Runs() []Run {
+	var runs []Run
+	for _, n := range m.NodeNums {
+		for _, size := range m.BlockSizes {
+			for _, speed := range m.InjectSpeeds {
+				for _, fault := range m.Faults {
+					for repeat := int64(1); repeat <= m.Repeat; repeat++ {
+						runs = append(runs, Run{
+							Name:        fmt.Sprintf("n%d_b%d_s%d_%s_%d", n, size, speed, fault.Name, repeat),
+							NodeNum:     n,
+							BlockSize:   size,
+							InjectSpeed: speed,
+							Fault:       fault,
+							Repeat:      repeat,
+						})
+					}
+				}
+			}
+		}
+	}
+	return runs
+}
@@ -0,0 +1,354 @@
+package bench
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/michael112233/pbft/config"
+	"github.com/michael112233/pbft/result"
+)
+
+// --------------------------------------------------------
+// Runner
+// --------------------------------------------------------
+
+// Outcome is the result of one run of the matrix
+type Outcome struct {
+	Run      Run
+	Status   string // ok, timeout, interrupted or failed
+	Verified bool
+	// Record is the result record the client wrote, empty if it wrote none
+	Record string
+	TPS    float64
+	P50    float64
+	P99    float64
+}
+
+// Runner spawns the replicas and the client of every run as child processes
+// of the current binary, all on the local network.
+type Runner struct {
+	matrix  *Matrix
+	cfgPath string
+	exe     string
+	dir     string
+
+	procs     map[*exec.Cmd]bool
+	procsLock sync.Mutex
+}
+
+func NewRunner(matrix *Matrix, cfgPath string) (*Runner, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(matrix.OutputDir, "bench_"+time.Now().Format("20060102-150405"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Runner{matrix: matrix, cfgPath: cfgPath, exe: exe, dir: dir, procs: make(map[*exec.Cmd]bool)}, nil
+}
+
+// Dir is where the runner writes records, logs, ledgers and bench.csv
+func (r *Runner) Dir() string {
+	return r.dir
+}
+
+// Run executes every run of the matrix in order, a cancelled ctx kills the
+// processes of the current run and skips the remaining ones
+func (r *Runner) Run(ctx context.Context) []Outcome {
+	runs := r.matrix.Runs()
+	outcomes := make([]Outcome, 0, len(runs))
+	for i, run := range runs {
+		if ctx.Err() != nil {
+			break
+		}
+		fmt.Printf("[%d/%d] %s\n", i+1, len(runs), run.Name)
+		outcome := r.runOne(ctx, run)
+		fmt.Printf("[%d/%d] %s: %s, verified=%v, tps=%.2f, p50=%.2fms, p99=%.2fms\n", i+1, len(runs), run.Name, outcome.Status, outcome.Verified, outcome.TPS, outcome.P50, outcome.P99)
+		outcomes = append(outcomes, outcome)
+		if err := r.writeSummary(outcomes); err != nil {
+			fmt.Printf("error writing bench summary: %v\n", err)
+		}
+	}
+	return outcomes
+}
+
+func (r *Runner) runOne(ctx context.Context, run Run) Outcome {
+	outcome := Outcome{Run: run, Status: "failed"}
+	runDir := filepath.Join(r.dir, run.Name)
+	if err := os.MkdirAll(runDir, 0755); err != nil {
+		fmt.Printf("error creating %s: %v\n", runDir, err)
+		return outcome
+	}
+	args := r.args(run, runDir)
+	config.GenerateLocalNetwork(int(run.NodeNum))
+
+	// the crashed replicas are the highest ids
+	crashed := make(map[int64]bool)
+	for i := int64(0); i < run.Fault.Crash; i++ {
+		crashed[run.NodeNum-1-i] = true
+	}
+	var nodes []*exec.Cmd
+	crashing := make(map[*exec.Cmd]bool)
+	for id := int64(0); id < run.NodeNum; id++ {
+		if crashed[id] && run.Fault.AfterSeconds == 0 {
+			continue
+		}
+		cmd, err := r.start(runDir, fmt.Sprintf("node_%d", id), append([]string{"node", "--node-id=" + strconv.FormatInt(id, 10)}, args...))
+		if err != nil {
+			fmt.Printf("error starting node %d: %v\n", id, err)
+			r.teardown(nodes, 0)
+			return outcome
+		}
+		nodes = append(nodes, cmd)
+		if crashed[id] {
+			crashing[cmd] = true
+		}
+	}
+	for id := int64(0); id < run.NodeNum; id++ {
+		if crashed[id] && run.Fault.AfterSeconds == 0 {
+			continue
+		}
+		addr, _ := config.NodeAddrOf(id)
+		if !waitListening(ctx, addr, 10*time.Second) {
+			fmt.Printf("node %d did not listen on %s\n", id, addr)
+			r.teardown(nodes, 0)
+			return outcome
+		}
+	}
+
+	records := filepath.Join(r.dir, "results.csv")
+	before, _ := lastRecord(records)
+	client, err := r.start(runDir, "client", append([]string{"client"}, args...))
+	if err != nil {
+		fmt.Printf("error starting client: %v\n", err)
+		r.teardown(nodes, 0)
+		return outcome
+	}
+	if len(crashing) > 0 {
+		timer := time.AfterFunc(time.Duration(run.Fault.AfterSeconds)*time.Second, func() {
+			for cmd := range crashing {
+				cmd.Process.Kill()
+			}
+		})
+		defer timer.Stop()
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, time.Duration(r.matrix.TimeoutSeconds)*time.Second)
+	defer cancel()
+	switch err := r.wait(timeout, client); {
+	case ctx.Err() != nil:
+		outcome.Status = "interrupted"
+	case timeout.Err() != nil:
+		outcome.Status = "timeout"
+	case err != nil:
+		fmt.Printf("client failed: %v\n", err)
+	default:
+		outcome.Status = "ok"
+	}
+	r.teardown(nodes, time.Duration(r.matrix.GraceSeconds)*time.Second)
+
+	outcome.Verified = r.verify(runDir)
+	if count, record := lastRecord(records); count > before {
+		outcome.Record = record
+		outcome.TPS, outcome.P50, outcome.P99 = readRecord(filepath.Join(r.dir, record))
+	}
+	return outcome
+}
+
+// args are the flags every process of a run gets
+func (r *Runner) args(run Run, runDir string) []string {
+	args := []string{
+		"--config=" + r.cfgPath,
+		"--mode=local",
+		fmt.Sprintf("--node-num=%d", run.NodeNum),
+		"--faulty-nodes-num=0",
+		fmt.Sprintf("--max-block-size=%d", run.BlockSize),
+		fmt.Sprintf("--inject-speed=%d", run.InjectSpeed),
+		"--ledger-dir=" + filepath.Join(runDir, "ledgers"),
+		"--log-dir=" + filepath.Join(runDir, "logs"),
+		"--result-dir=" + r.dir,
+	}
+	if r.matrix.MaxTxNum > 0 {
+		args = append(args, fmt.Sprintf("--max-tx-num=%d", r.matrix.MaxTxNum))
+	}
+	keys := make([]string, 0, len(r.matrix.Config))
+	for key := range r.matrix.Config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, fmt.Sprintf("--%s=%s", strings.ReplaceAll(key, "_", "-"), r.matrix.Config[key]))
+	}
+	return args
+}
+
+// start runs the binary with args, its output goes to <runDir>/<name>.out
+func (r *Runner) start(runDir, name string, args []string) (*exec.Cmd, error) {
+	out, err := os.Create(filepath.Join(runDir, name+".out"))
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(r.exe, args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		out.Close()
+		return nil, err
+	}
+	r.procsLock.Lock()
+	r.procs[cmd] = true
+	r.procsLock.Unlock()
+	go func() {
+		cmd.Wait()
+		out.Close()
+		r.procsLock.Lock()
+		delete(r.procs, cmd)
+		r.procsLock.Unlock()
+	}()
+	return cmd, nil
+}
+
+func (r *Runner) running(cmd *exec.Cmd) bool {
+	r.procsLock.Lock()
+	defer r.procsLock.Unlock()
+	return r.procs[cmd]
+}
+
+// wait returns once cmd exited, or kills it when ctx is done
+func (r *Runner) wait(ctx context.Context, cmd *exec.Cmd) error {
+	for r.running(cmd) {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Kill()
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if !cmd.ProcessState.Success() {
+		return fmt.Errorf("%s", cmd.ProcessState)
+	}
+	return nil
+}
+
+// teardown asks the replicas to stop with SIGTERM, the client only sends
+// close messages when an operator is set, and kills the ones still running
+// after grace
+func (r *Runner) teardown(nodes []*exec.Cmd, grace time.Duration) {
+	for _, cmd := range nodes {
+		if r.running(cmd) {
+			cmd.Process.Signal(syscall.SIGTERM)
+		}
+	}
+	deadline := time.Now().Add(grace)
+	for _, cmd := range nodes {
+		for r.running(cmd) && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if r.running(cmd) {
+			cmd.Process.Kill()
+		}
+	}
+	for _, cmd := range nodes {
+		for r.running(cmd) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// Kill stops every process the runner started
+func (r *Runner) Kill() {
+	r.procsLock.Lock()
+	defer r.procsLock.Unlock()
+	for cmd := range r.procs {
+		cmd.Process.Kill()
+	}
+}
+
+// verify checks the ledgers of the run with the verify command
+func (r *Runner) verify(runDir string) bool {
+	cmd, err := r.start(runDir, "verify", []string{"verify", "--config=" + r.cfgPath, "--ledger-dir=" + filepath.Join(runDir, "ledgers")})
+	if err != nil {
+		fmt.Printf("error starting verify: %v\n", err)
+		return false
+	}
+	return r.wait(context.Background(), cmd) == nil
+}
+
+func waitListening(ctx context.Context, addr string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+// --------------------------------------------------------
+// Results
+// --------------------------------------------------------
+
+// lastRecord returns the number of rows of the results.csv the clients append
+// to and the record file of the last row
+func lastRecord(path string) (int, string) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, ""
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil || len(rows) < 2 {
+		return 0, ""
+	}
+	last := rows[len(rows)-1]
+	return len(rows) - 1, last[len(last)-1]
+}
+
+func readRecord(path string) (tps, p50, p99 float64) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, 0
+	}
+	record := result.Record{}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return 0, 0, 0
+	}
+	return record.TPS, record.Latency.P50, record.Latency.P99
+}
+
+// writeSummary rewrites bench.csv with one row per finished run
+func (r *Runner) writeSummary(outcomes []Outcome) error {
+	file, err := os.Create(filepath.Join(r.dir, "bench.csv"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := csv.NewWriter(file)
+	w.Write([]string{"run", "node_num", "max_block_size", "inject_speed", "fault", "repeat", "status", "verified", "tps", "latency_p50_ms", "latency_p99_ms", "record"})
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	i := func(v int64) string { return strconv.FormatInt(v, 10) }
+	for _, o := range outcomes {
+		w.Write([]string{
+			o.Run.Name, i(o.Run.NodeNum), i(o.Run.BlockSize), i(o.Run.InjectSpeed), o.Run.Fault.Name, i(o.Run.Repeat),
+			o.Status, strconv.FormatBool(o.Verified), f(o.TPS), f(o.P50), f(o.P99), o.Record,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
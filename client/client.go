@@ -1,51 +1,134 @@
 package client
 
 import (
+	"context"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/michael112233/pbft/config"
 	"github.com/michael112233/pbft/core"
 	"github.com/michael112233/pbft/leader_election"
+	"github.com/michael112233/pbft/ledger"
 	"github.com/michael112233/pbft/logger"
+	"github.com/michael112233/pbft/metrics"
+	"github.com/michael112233/pbft/network"
 )
 
 type Client struct {
+	id          int64
 	addr        string
 	config      *config.Config
 	injectSpeed int64
 	txs         []*core.Transaction
+	reconfigs   []config.ReconfigStep
 	currentView int64
+	// lastView is the highest view of an accepted reply, i.e. the view changes seen by the client
+	lastView int64
 
 	WaitGroup sync.WaitGroup
 
+	// seq -> digest -> replicas that replied with it
+	replies     map[int64]map[string]*core.VoteSet
+	repliesLock sync.Mutex
+	// request id -> when it was sent, for the end-to-end latency, until the result is accepted
+	sentAt  map[int64]time.Time
+	sentNum int
+
 	leaderElection *leader_election.LeaderElection
 	log            *logger.Logger
 	messageHub     *ClientMessageHub
+	ledger         *ledger.Writer
+	metrics        *metrics.Server
+	// operatorKey signs the close messages, without it none are sent
+	operatorKey *network.OperatorKey
 }
 
-func NewClient(addr string, config *config.Config) *Client {
+// NewClient fails if the election method of config is unknown
+func NewClient(id int64, addr string, config *config.Config) (*Client, error) {
+	leaderElection, err := leader_election.NewLeaderElection(config)
+	if err != nil {
+		return nil, err
+	}
 	return &Client{
+		id:          id,
 		addr:        addr,
 		currentView: 0,
 		config:      config,
 
 		WaitGroup: sync.WaitGroup{},
+		replies:   make(map[int64]map[string]*core.VoteSet),
+		sentAt:    make(map[int64]time.Time),
 
-		leaderElection: leader_election.NewLeaderElection(config),
+		leaderElection: leaderElection,
 		log:            logger.NewLogger(0, "client"),
 		messageHub:     NewClientMessageHub(),
-	}
+	}, nil
 }
 
-func (c *Client) Start() {
-	c.messageHub.Start(c, &sync.WaitGroup{})
+// Start listens for replies and injects the transactions in the background
+// until they are sent or ctx is cancelled
+func (c *Client) Start(ctx context.Context) error {
+	if c.config.Operator != "" {
+		key, err := network.LoadOperatorKey(c.config.TLSDir, c.config.Operator)
+		if err != nil {
+			return fmt.Errorf("failed to load operator key, create it with pbft_main keygen: %w", err)
+		}
+		c.operatorKey = key
+	}
+	ledgerWriter, err := ledger.NewWriter(c.config.LedgerDir, ledger.ClientName())
+	if err != nil {
+		c.log.Error("failed to open ledger in %s: %v", c.config.LedgerDir, err)
+	}
+	c.ledger = ledgerWriter
+	c.startMetrics()
+	if err := c.messageHub.Start(c); err != nil {
+		return err
+	}
 
 	c.injectSpeed = c.config.InjectSpeed
-	c.InjectTxs()
+	c.InjectTxs(ctx)
+	return nil
 }
 
-func (c *Client) Stop() {
+// Wait blocks until every request was sent and the result of each one was
+// accepted. It gives up on the missing results after shutdown_timeout or once
+// ctx is cancelled, the message hub stays open to send the close messages.
+func (c *Client) Wait(ctx context.Context) error {
 	c.WaitGroup.Wait()
+	deadline := time.After(time.Duration(c.config.ShutdownTimeout) * time.Second)
+	for {
+		sent, inFlight := c.requests()
+		if ctx.Err() != nil {
+			return fmt.Errorf("interrupted after %d requests, %d without result", sent, inFlight)
+		}
+		if inFlight == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+		case <-deadline:
+			return fmt.Errorf("%d of %d requests without result after %ds", inFlight, sent, c.config.ShutdownTimeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// requests returns how many requests were sent and how many of them have no
+// accepted result yet
+func (c *Client) requests() (int, int) {
+	c.repliesLock.Lock()
+	defer c.repliesLock.Unlock()
+	return c.sentNum, len(c.sentAt)
+}
+
+// Stop closes the connections, the ledger and the metrics server
+func (c *Client) Stop() {
+	c.messageHub.Close()
+	if err := c.ledger.Close(); err != nil {
+		c.log.Error("failed to close ledger: %v", err)
+	}
+	c.metrics.Close()
 	c.log.Debug("client stopped")
 }
 
@@ -53,6 +136,11 @@ func (c *Client) AddTxs(txs []*core.Transaction) {
 	c.txs = txs
 }
 
+// AddReconfigs schedules replica set changes between transaction requests
+func (c *Client) AddReconfigs(steps []config.ReconfigStep) {
+	c.reconfigs = steps
+}
+
 func (c *Client) GetAddr() string {
 	return c.addr
 }
@@ -1,14 +1,11 @@
 package client
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/binary"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"sync"
+	"time"
 
 	"github.com/michael112233/pbft/core"
 	"github.com/michael112233/pbft/logger"
@@ -19,14 +16,16 @@ import (
 // For Data Structure Definition
 // --------------------------------------------------------
 
-var (
-	conns2Node = network.NewConnectionsMap()
-	listenConn net.Listener
-)
+const flushTimeout = 5 * time.Second
 
 type ClientMessageHub struct {
 	exitChan   chan struct{}
 	client_ref *Client
+	conns      *network.ConnManager
+	inbound    *network.Inbound
+	framer     *network.Framer
+	tls        *network.TLSIdentity
+	handlers   map[string]func(interface{})
 
 	log *logger.Logger
 }
@@ -34,220 +33,174 @@ type ClientMessageHub struct {
 func NewClientMessageHub() *ClientMessageHub {
 	return &ClientMessageHub{
 		exitChan: make(chan struct{}, 1),
+		inbound:  network.NewInbound(),
 	}
 }
 
-func (hub *ClientMessageHub) Start(client *Client, wg *sync.WaitGroup) {
+// Start listens on the address of client for replies, it fails if the TLS
+// identity cannot be loaded or the address cannot be listened on
+func (hub *ClientMessageHub) Start(client *Client) error {
 	if client != nil {
 		hub.client_ref = client
 		hub.log = client.log
+		policy, err := network.ParseOverflowPolicy(client.config.SendQueuePolicy)
+		if err != nil {
+			policy = network.PolicyDropOldest
+			hub.log.Error("invalid send queue policy, using %s: err=%v", policy, err)
+		}
+		hub.conns = network.NewConnManager(client.log, network.QueueConfig{
+			Size:   int(client.config.SendQueueSize),
+			Policy: policy,
+		})
+		codec, err := network.GetCodec(client.config.WireFormat)
+		if err != nil {
+			hub.log.Error("invalid wire format, using %s: err=%v", network.DefaultCodec, err)
+			codec, _ = network.GetCodec(network.DefaultCodec)
+		}
+		hub.framer = network.NewFramer(codec, int(client.config.MaxFrameSize))
+		if client.config.TLSEnabled {
+			identity := network.Identity(core.RoleClient, client.id)
+			hub.tls, err = network.LoadTLSIdentity(client.config.TLSDir, identity)
+			if err != nil {
+				return fmt.Errorf("failed to load TLS identity %s from %s: %w", identity, client.config.TLSDir, err)
+			}
+			if err := network.PinTopologyKeys(hub.tls); err != nil {
+				return fmt.Errorf("failed to pin public keys of the topology: %w", err)
+			}
+			hub.conns.SetDialer(hub.tls.Dialer(network.IdentityOfAddr))
+		}
+		hub.registerHandlers()
 		hub.log.Info("clientMessageHub started")
-		wg.Add(1)
-		go hub.listen(hub.client_ref.GetAddr(), wg)
+		return hub.listen(hub.client_ref.GetAddr())
 	}
+	return nil
 }
 
+// Close stops accepting replies and waits for the running handlers, then
+// closes the outbound connections once the queued messages are flushed
 func (hub *ClientMessageHub) Close() {
 	// 关闭所有tcp连接，防止资源泄露
-	hub.log.Debug("nodeMessageHub closing...")
-	for _, conn := range conns2Node.Connections {
-		conn.Close()
+	hub.log.Debug("clientMessageHub closing...")
+	hub.inbound.Close()
+	if hub.conns == nil {
+		return
 	}
-	listenConn.Close()
+	for _, stats := range hub.conns.Stats() {
+		hub.log.Info("send queue stats: %s", stats)
+	}
+	hub.conns.Close()
 	hub.log.Debug("messageHub is close.")
 }
 
+// Flush blocks until every queued message has been written to the nodes
+func (hub *ClientMessageHub) Flush() {
+	hub.conns.Flush(flushTimeout)
+}
+
+// registerHandlers binds every message type the client accepts to its handler
+func (hub *ClientMessageHub) registerHandlers() {
+	hub.handlers = map[string]func(interface{}){
+		core.MsgReplyMessage: func(msg interface{}) {
+			hub.client_ref.HandleReplyMessage(*msg.(*core.ReplyMessage))
+		},
+	}
+}
+
 // --------------------------------------------------------
 // Basic Communication Principles Implementation (like Dial & Listen)
 // --------------------------------------------------------
-func (hub *ClientMessageHub) Dial(addr string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		hub.log.Debug(fmt.Sprintf("DialTCPError: target_addr=%s, err=%v", addr, err))
-		// 再dial一次
-		hub.log.Debug(fmt.Sprintf("Try dial again... target_addr=%s", addr))
-		conn, err = net.Dial("tcp", addr)
-		if err != nil {
-			hub.log.Debug(fmt.Sprintf("DialTCPError: target_addr=%s, err=%v", addr, err))
-			return nil, nil
-		} else {
-			hub.log.Debug(fmt.Sprintf("dial success. target_addr=%s", addr))
-		}
+// Send delivers msg to the replica with id to
+func (hub *ClientMessageHub) Send(msgType string, to int64, msg interface{}, callback func(...interface{})) {
+	messageType, ok := core.LookupMessageByName(msgType)
+	if !ok {
+		hub.log.Error(fmt.Sprintf("encodeMessageErr: unregistered message type %s", msgType))
+		return
 	}
-	return conn, nil
-}
-
-func (hub *ClientMessageHub) packMsg(msgType string, data []byte) []byte {
-	msg := &core.Message{
-		MsgType: msgType,
-		Data:    data,
+	addr, err := network.AddrOf(messageType.To, to)
+	if err != nil {
+		hub.log.Error(fmt.Sprintf("resolveAddrErr: msgType=%s, err=%v", msgType, err))
+		return
 	}
-
-	var buf bytes.Buffer
-	msgEnc := gob.NewEncoder(&buf)
-	err := msgEnc.Encode(msg)
+	frame, err := hub.framer.Encode(messageType, msg)
 	if err != nil {
-		hub.log.Error(fmt.Sprintf("gobEncodeErr: err=%v, msg=%v", err, msg))
+		hub.log.Error(fmt.Sprintf("encodeMessageErr: targetAddr=%s, err=%v", addr, err))
+		return
 	}
-
-	msgBytes := buf.Bytes()
-
-	// 前缀加上长度，防止粘包
-	networkBuf := make([]byte, 4+len(msgBytes))
-	binary.BigEndian.PutUint32(networkBuf[:4], uint32(len(msgBytes)))
-	copy(networkBuf[4:], msgBytes)
-
-	return networkBuf
+	hub.conns.Send(addr, frame)
+	network.CountSent(msgType)
 }
 
-func (hub *ClientMessageHub) Send(msgType string, ip string, msg interface{}, callback func(...interface{})) {
-	switch msgType {
-	case core.MsgRequestMessage:
-		hub.sendRequestMessage(msg)
-	case core.MsgCloseMessage:
-		hub.sendCloseMessage(msg)
-	default:
-		hub.log.Error(fmt.Sprintf("Unknown message type received: msgType=%s", msgType))
+func (hub *ClientMessageHub) listen(addr string) error {
+	var ln net.Listener
+	var err error
+	if hub.tls != nil {
+		ln, err = hub.tls.Listen(addr)
+	} else {
+		ln, err = net.Listen("tcp", addr)
 	}
-}
-
-func (hub *ClientMessageHub) listen(addr string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		hub.log.Error(fmt.Sprintf("Error setting up listener. err: %v", err))
+		return fmt.Errorf("error setting up listener on %s: %w", addr, err)
 	}
 	hub.log.Info(fmt.Sprintf("start listening on %s", addr))
-	listenConn = ln
-	defer ln.Close()
+	hub.inbound.Serve(ln, hub.handleConnection)
+	return nil
+}
 
-	for {
-		// // 超过时间限制没有收到新的连接则退出
-		// ln.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
-		conn, err := ln.Accept()
+func (hub *ClientMessageHub) handleConnection(conn net.Conn) {
+	// with TLS every message has to come from the owner of the client certificate
+	identity, err := hub.tls.PeerIdentity(conn)
+	if err != nil {
+		hub.log.Error(fmt.Sprintf("TLS handshake failed: remote=%s, err=%v", conn.RemoteAddr(), err))
+		return
+	}
+	var peerRole core.Role
+	var peerID int64
+	if identity != "" {
+		peerRole, peerID, err = network.ParseIdentity(identity)
+		if err == nil {
+			_, err = network.AddrOf(peerRole, peerID)
+		}
 		if err != nil {
-			hub.log.Debug("Error accepting connection. Err: " + err.Error())
+			hub.log.Error(fmt.Sprintf("Unknown peer identity: remote=%s, identity=%s, err=%v", conn.RemoteAddr(), identity, err))
 			return
 		}
-		go hub.handleConnection(conn, ln)
 	}
-}
-
-func (hub *ClientMessageHub) unpackMsg(packedMsg []byte) *core.Message {
-	var networkBuf bytes.Buffer
-	networkBuf.Write(packedMsg)
-	msgDec := gob.NewDecoder(&networkBuf)
-
-	var msg core.Message
-	err := msgDec.Decode(&msg)
-	if err != nil {
-		hub.log.Error("unpackMsgErr. Err: " + err.Error() + " msgBytes: " + string(packedMsg))
-	}
-
-	return &msg
-}
 
-func (hub *ClientMessageHub) handleConnection(conn net.Conn, ln net.Listener) {
-	defer conn.Close()
 	for {
-		lenBuf := make([]byte, 4)
-		_, err := io.ReadFull(conn, lenBuf)
+		// any malformed frame drops the connection, the stream cannot be resynchronised
+		messageType, msg, err := hub.framer.Read(conn)
 		if err != nil {
-			if err.Error() == "EOF" {
+			if err == io.EOF {
 				// 发送端主动关闭连接
 				return
 			}
-			hub.log.Test("Error reading from connection. Err: " + err.Error())
+			if errors.Is(err, net.ErrClosed) || hub.inbound.Closed() {
+				// 本端关闭时连接被主动关闭
+				hub.log.Debug(fmt.Sprintf("Connection closed while reading: remote=%s", conn.RemoteAddr()))
+				return
+			}
+			hub.log.Error(fmt.Sprintf("Error reading from connection, dropping it: remote=%s, err=%v", conn.RemoteAddr(), err))
 			return
 		}
-		length := int(binary.BigEndian.Uint32(lenBuf))
-		packedMsg := make([]byte, length)
-		_, err = io.ReadFull(conn, packedMsg)
-		if err != nil {
-			hub.log.Error("Error reading from connection. Err: " + err.Error())
-		}
 
-		msg := hub.unpackMsg(packedMsg)
-		switch msg.MsgType {
-		case core.MsgReplyMessage:
-			hub.handleReplyMessage(msg.Data)
-		default:
-			hub.log.Error(fmt.Sprintf("Unknown message type received: msgType=%s", msg.MsgType))
+		msgType := messageType.Name
+		if identity != "" {
+			sender, ok := msg.(core.Sender)
+			if !ok {
+				hub.log.Error(fmt.Sprintf("Message has no sender, dropping connection: msgType=%s, identity=%s", msgType, identity))
+				return
+			}
+			if messageType.From != peerRole || sender.Sender() != peerID {
+				hub.log.Error(fmt.Sprintf("Message sender does not match connection identity, dropping connection: msgType=%s, from=%s-%d, identity=%s", msgType, messageType.From, sender.Sender(), identity))
+				return
+			}
 		}
-	}
-}
 
-// --------------------------------------------------------
-// Communication for Unmarshalling Received Messages
-// --------------------------------------------------------
-func (hub *ClientMessageHub) handleReplyMessage(dataBytes []byte) {
-	var buf bytes.Buffer
-	buf.Write(dataBytes)
-	dataDec := gob.NewDecoder(&buf)
-
-	var data core.ReplyMessage
-	err := dataDec.Decode(&data)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("handleReplyMessageErr: err=%v, dataBytes=%v", err, dataBytes))
-	}
-	hub.client_ref.HandleReplyMessage(data)
-}
-
-// --------------------------------------------------------
-// Communication for Marshalling Messages to Send
-// --------------------------------------------------------
-func (hub *ClientMessageHub) sendRequestMessage(msg interface{}) {
-	data := msg.(core.RequestMessage)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(&data)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("gobEncodeErr: err=%v, data=%v", err, data))
-	}
-
-	msg_bytes := hub.packMsg("MsgRequestMessage", buf.Bytes())
-
-	addr := data.To
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = hub.Dial(addr)
-		if err != nil || conn == nil {
-			hub.log.Error(fmt.Sprintf("Dial Error. Send Request Message. caller: %s targetAddr: %s", data.From, addr))
-			return
+		handler, ok := hub.handlers[msgType]
+		if !ok {
+			hub.log.Error(fmt.Sprintf("Unknown message type received: msgType=%s", msgType))
+			continue
 		}
-		conns2Node.Add(addr, conn)
+		handler(msg)
 	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
-
-	hub.log.Info(fmt.Sprintf("Msg Sent: MsgRequestMessage, From %s, To %s, Txs %d", data.From, data.To, len(data.Txs)))
 }
-
-func (hub *ClientMessageHub) sendCloseMessage(msg interface{}) {
-	data := msg.(core.CloseMessage)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(&data)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("gobEncodeErr: err=%v, data=%v", err, data))
-	}
-
-	msg_bytes := hub.packMsg("MsgCloseMessage", buf.Bytes())
-
-	addr := data.To
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = hub.Dial(addr)
-		if err != nil || conn == nil {
-			hub.log.Error(fmt.Sprintf("Dial Error. Send Close Message. caller: %s targetAddr: %s", data.From, addr))
-			return
-		}
-		conns2Node.Add(addr, conn)
-	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
-
-	hub.log.Info(fmt.Sprintf("Msg Sent: MsgCloseMessage, From %s, To %s", data.From, data.To))
-}
\ No newline at end of file
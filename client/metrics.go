@@ -0,0 +1,35 @@
+package client
+
+import (
+	"github.com/michael112233/pbft/config"
+	"github.com/michael112233/pbft/metrics"
+)
+
+// --------------------------------------------------------
+// Metrics
+// --------------------------------------------------------
+
+var (
+	sentRequests     = metrics.Counter("pbft_client_requests_sent_total", "Requests sent by the client.")
+	acceptedRequests = metrics.Counter("pbft_client_requests_accepted_total", "Requests whose result was accepted by the client.")
+	acceptedTxs      = metrics.Counter("pbft_client_txs_accepted_total", "Transactions of the accepted requests.")
+	currentView      = metrics.Gauge("pbft_client_view", "View the client sends requests in.")
+)
+
+// startMetrics serves /metrics next to the address of the client unless metrics are disabled
+func (c *Client) startMetrics() {
+	for _, counter := range []*metrics.Family{sentRequests, acceptedRequests, acceptedTxs} {
+		counter.Add(0)
+	}
+	currentView.Set(c.currentView)
+	if c.config.MetricsPortOffset == 0 {
+		return
+	}
+	addr, err := config.MetricsAddrOf(c.addr, c.config.MetricsPortOffset)
+	if err == nil {
+		c.metrics, err = metrics.Serve(addr, c.log)
+	}
+	if err != nil {
+		c.log.Error("failed to serve metrics: %v", err)
+	}
+}
@@ -2,13 +2,81 @@ package client
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/michael112233/pbft/config"
 	"github.com/michael112233/pbft/core"
+	"github.com/michael112233/pbft/ledger"
+	"github.com/michael112233/pbft/result"
 )
 
 func (c *Client) HandleReplyMessage(data core.ReplyMessage) {
-	c.log.Info(fmt.Sprintf("Received reply message from %s, sequence number %d", data.From, data.SequenceNumber))
+	c.log.Info(fmt.Sprintf("Received reply message from %d, sequence number %d", data.From, data.SequenceNumber))
 	Block := core.NewBlock(data.SequenceNumber, data.RequestMessage.Txs, data.RequestMessage.To)
 	Block.AddCommittedNode(data.From)
 	core.Chain.AddBlock(Block)
+	c.acceptReply(data)
+}
+
+// acceptReply records the result in the client ledger once replicas holding
+// more than 1/3 of the voting weight, f+1 of equal weight, replied with the same digest
+func (c *Client) acceptReply(data core.ReplyMessage) {
+	c.repliesLock.Lock()
+	defer c.repliesLock.Unlock()
+
+	if _, ok := c.replies[data.SequenceNumber]; !ok {
+		c.replies[data.SequenceNumber] = make(map[string]*core.VoteSet)
+	}
+	votes, ok := c.replies[data.SequenceNumber][data.Digest]
+	if !ok {
+		votes = core.NewVoteSet()
+		c.replies[data.SequenceNumber][data.Digest] = votes
+	}
+	quorum := core.NewQuorum(config.Members())
+	if quorum.Attested(votes.Voters()) || !votes.Add(data.From) || !quorum.Attested(votes.Voters()) {
+		return
+	}
+
+	c.log.Info(fmt.Sprintf("Accepted result of sequence number %d", data.SequenceNumber))
+	acceptedRequests.Inc()
+	if data.ViewNumber > c.lastView {
+		c.lastView = data.ViewNumber
+		result.SetViewChanges(c.lastView)
+	}
+	acceptedTxs.Add(int64(len(data.RequestMessage.Txs)))
+	if sentAt, ok := c.sentAt[data.RequestMessage.Id]; ok {
+		result.Observe(result.RequestLatency, time.Since(sentAt))
+		delete(c.sentAt, data.RequestMessage.Id)
+	}
+	if data.RequestMessage.Reconfig != nil {
+		c.applyReconfiguration(data.SequenceNumber, data.RequestMessage.Reconfig)
+	}
+	err := c.ledger.Append(ledger.Record{
+		Kind:      ledger.KindAccept,
+		Seq:       data.SequenceNumber,
+		View:      data.ViewNumber,
+		Digest:    data.Digest,
+		RequestID: data.RequestMessage.Id,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		c.log.Error("failed to append accept record for sequence number %d to ledger: %v", data.SequenceNumber, err)
+	}
+}
+
+// applyReconfiguration follows an accepted replica set change with the same
+// checks the replicas apply, so requests and close messages reach the new set
+func (c *Client) applyReconfiguration(seq int64, reconfig *core.Reconfiguration) {
+	members, f, err := reconfig.Next(config.Members())
+	if err == nil && c.leaderElection.LeaderOf(c.currentView, members) != c.leaderElection.GetLeader(c.currentView) {
+		err = fmt.Errorf("the primary of view %d would change", c.currentView)
+	}
+	if err != nil {
+		c.log.Error(fmt.Sprintf("Reconfiguration (%s) of sequence number %d rejected: %v", reconfig, seq, err))
+		return
+	}
+	reconfig.Install(members)
+	c.config.NodeNum = int64(len(members))
+	c.config.FaultyNodesNum = f
+	c.log.Info(fmt.Sprintf("Replica set is now %v with f=%d", members, f))
 }
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -9,36 +10,113 @@ import (
 	"github.com/michael112233/pbft/result"
 )
 
-func (c *Client) InjectTxs() {
+// InjectTxs sends a request of inject_speed transactions every 2 seconds,
+// cancelling ctx stops it between two requests
+func (c *Client) InjectTxs(ctx context.Context) {
 	result.SetStartTime(time.Now())
 	c.WaitGroup.Add(1)
 	go func() {
 		defer c.WaitGroup.Done()
 		var injectTxs []*core.Transaction
+		requestID := int64(0)
 		for i := int64(0); (i+1)*c.injectSpeed <= int64(len(c.txs)); i++ {
+			for _, step := range c.reconfigs {
+				if step.AfterRequest == i {
+					c.sendRequest(requestID, nil, reconfigurationOf(step))
+					requestID++
+					if !sleep(ctx, requestInterval) {
+						return
+					}
+				}
+			}
 			injectTxs = c.txs[i*c.injectSpeed : (i+1)*c.injectSpeed]
-			leader := c.leaderElection.GetLeader(c.currentView)
-			msg := core.RequestMessage{
-				Timestamp: time.Now().Unix(),
-				From:      c.addr,
-				To:        leader,
-				Txs:       injectTxs,
-				Id:        int64(i),
+			c.sendRequest(requestID, injectTxs, nil)
+			requestID++
+			if !sleep(ctx, requestInterval) {
+				return
 			}
-			c.messageHub.Send(core.MsgRequestMessage, c.addr, msg, nil)
-			time.Sleep(2 * time.Second)
 		}
 	}()
 }
 
+const requestInterval = 2 * time.Second
+
+// sleep waits for d and reports false if ctx was cancelled first
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (c *Client) sendRequest(id int64, txs []*core.Transaction, reconfig *core.Reconfiguration) {
+	// with a rotating primary any replica may be the one to propose the request
+	targets := []int64{c.leaderElection.GetLeader(c.currentView)}
+	if c.config.RotationInterval > 0 {
+		targets = config.Members()
+	}
+	msg := core.RequestMessage{
+		Timestamp: time.Now().Unix(),
+		From:      c.id,
+		Txs:       txs,
+		Id:        id,
+		Reconfig:  reconfig,
+	}
+	c.repliesLock.Lock()
+	c.sentAt[id] = time.Now()
+	c.sentNum++
+	c.repliesLock.Unlock()
+	for _, target := range targets {
+		msg.To = target
+		c.messageHub.Send(core.MsgRequestMessage, target, msg, nil)
+	}
+	sentRequests.Inc()
+	to := fmt.Sprint(msg.To)
+	if len(targets) > 1 {
+		to = fmt.Sprintf("all %v", targets)
+	}
+	if reconfig != nil {
+		c.log.Info(fmt.Sprintf("Msg Sent: MsgRequestMessage, From %d, To %s, Reconfiguration %s", msg.From, to, reconfig))
+	} else {
+		c.log.Info(fmt.Sprintf("Msg Sent: MsgRequestMessage, From %d, To %s, Txs %d", msg.From, to, len(msg.Txs)))
+	}
+}
+
+func reconfigurationOf(step config.ReconfigStep) *core.Reconfiguration {
+	reconfig := &core.Reconfiguration{
+		Remove:         step.Remove,
+		FaultyNodesNum: step.FaultyNodesNum,
+	}
+	for _, node := range step.Add {
+		reconfig.Add = append(reconfig.Add, core.Member{ID: node.ID, Addr: node.Addr})
+	}
+	return reconfig
+}
+
+// BroadcastClose asks every member to stop, replicas only accept close
+// messages signed by an operator
 func (c *Client) BroadcastClose() {
-	for _, addr := range config.NodeAddr {
+	if c.operatorKey == nil {
+		c.log.Info("No operator is set, the replicas are not sent close messages")
+		return
+	}
+	for _, nodeID := range config.Members() {
 		closeMsg := core.CloseMessage{
 			Timestamp: time.Now().Unix(),
-			From:      c.addr,
-			To:        addr,
+			From:      c.id,
+			To:        nodeID,
+			Operator:  c.operatorKey.Name,
+		}
+		signature, err := c.operatorKey.Sign(closeMsg.SignedBytes())
+		if err != nil {
+			c.log.Error(fmt.Sprintf("failed to sign close message to node %d: %v", nodeID, err))
+			continue
 		}
-		c.log.Info(fmt.Sprintf("Send close message to %s", addr))
-		c.messageHub.Send(core.MsgCloseMessage, addr, closeMsg, nil)
+		closeMsg.Signature = signature
+		c.log.Info(fmt.Sprintf("Send close message to node %d", nodeID))
+		c.messageHub.Send(core.MsgCloseMessage, nodeID, closeMsg, nil)
 	}
+	c.messageHub.Flush()
 }
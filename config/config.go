@@ -1,44 +1,287 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
 )
 
+// Config holds the parameters of a run. Values come from the defaults, then
+// run.json, then PBFT_<FIELD> environment variables, then command line flags.
 type Config struct {
 	DataDir      string `json:"data_dir"`
+	LedgerDir    string `json:"ledger_dir" short:"d"`
 	MaxTxNum     int64  `json:"max_tx_num"`
 	InjectSpeed  int64  `json:"inject_speed"`
 	MaxBlockSize int64  `json:"max_block_size"`
 
+	ExperimentMode string `json:"experiment_mode" flag:"mode" short:"m"`
+
 	NodeNum int64 `json:"node_num"`
 
-	FaultyNodesNum int64
+	// 0 means the largest f tolerated by node_num, i.e. (node_num-1)/3
+	FaultyNodesNum int64 `json:"faulty_nodes_num"`
 
 	ElectionMethod string `json:"election_method"`
+	// RotationInterval k > 0 rotates the primary every k sequence numbers, 0 keeps it until a view change
+	RotationInterval int64 `json:"rotation_interval"`
+
+	// ReconfigFile lists the replica set changes the client submits, see config/reconfig.go
+	ReconfigFile string `json:"reconfig_file"`
 
 	ExpireTime          int64 `json:"expire_time"`
 	SeqNumberUpperBound int64 `json:"seq_number_upper_bound"`
 	SeqNumberLowerBound int64 `json:"seq_number_lower_bound"`
 	CheckpointInterval  int64 `json:"checkpoint_interval"`
+
+	TLSEnabled      bool   `json:"tls_enabled"`
+	TLSDir          string `json:"tls_dir"`
+	WireFormat      string `json:"wire_format"`
+	MaxFrameSize    int64  `json:"max_frame_size"`
+	SendQueueSize   int64  `json:"send_queue_size"`
+	SendQueuePolicy string `json:"send_queue_policy"`
+
+	LogLevel      string `json:"log_level"`
+	LogFormat     string `json:"log_format"`
+	LogOutput     string `json:"log_output"`
+	LogDir        string `json:"log_dir"`
+	LogMaxSize    int64  `json:"log_max_size"`
+	LogMaxBackups int64  `json:"log_max_backups"`
+
+	// ResultDir receives a JSON record and a results.csv row per client run, empty disables it
+	ResultDir string `json:"result_dir"`
+
+	// MetricsPortOffset > 0 serves /metrics on the port of every endpoint plus the offset, 0 disables it
+	MetricsPortOffset int64 `json:"metrics_port_offset"`
+	// AdminPortOffset > 0 serves the admin API of every node on its port plus the offset, 0 disables it
+	AdminPortOffset int64 `json:"admin_port_offset"`
+	// ShutdownTimeout bounds in seconds how long a stopping node drains its consensus instances and send queues
+	ShutdownTimeout int64 `json:"shutdown_timeout"`
+
+	// Operators lists, comma separated, the operators whose keys in tls_dir may stop and steer a replica, empty rejects every close message and admin request
+	Operators string `json:"operators"`
+	// Operator names the key in tls_dir the client and the admin command sign with
+	Operator string `json:"operator"`
+}
+
+// Default returns the configuration used for every field run.json leaves out
+func Default() *Config {
+	return &Config{
+		DataDir:             "data/len3_data.csv",
+		LedgerDir:           "ledgers",
+		MaxTxNum:            64000,
+		InjectSpeed:         2000,
+		MaxBlockSize:        1000,
+		ExperimentMode:      "local",
+		NodeNum:             4,
+		ElectionMethod:      "round_robin",
+		ExpireTime:          10,
+		SeqNumberUpperBound: 300000,
+		SeqNumberLowerBound: 1000,
+		CheckpointInterval:  4,
+		TLSDir:              "certs",
+		WireFormat:          "gob",
+		MaxFrameSize:        16 * 1024 * 1024,
+		SendQueueSize:       1024,
+		SendQueuePolicy:     "drop_oldest",
+		LogLevel:            "info",
+		LogFormat:           "text",
+		LogOutput:           "file",
+		LogDir:              "logs",
+		LogMaxSize:          100,
+		LogMaxBackups:       3,
+		ResultDir:           "results",
+		MetricsPortOffset:   10,
+		ShutdownTimeout:     20,
+	}
 }
 
-func ReadCfg(filename string) *Config {
+// Load reads filename on top of the defaults and applies the environment and
+// the flags of fs that were set on the command line. fs may be nil. The
+// result is not validated yet, since a topology file can still change it.
+func Load(filename string, fs *pflag.FlagSet) (*Config, error) {
+	config := Default()
+
 	jsonData, err := os.ReadFile(filename)
 	if err != nil {
-		fmt.Printf("error reading json file: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", filename, err)
 	}
 
-	// 创建新的Config实例
-	config := &Config{}
-	err = json.Unmarshal(jsonData, config)
-	if err != nil {
-		fmt.Printf("error unmarshaling json: %v\n", err)
-		os.Exit(1)
+	if err := config.applyEnv(); err != nil {
+		return nil, err
+	}
+	if fs != nil {
+		if err := config.applyFlags(fs); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// Validate fills in derived values and reports every invalid field at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if c.FaultyNodesNum == 0 {
+		c.FaultyNodesNum = (c.NodeNum - 1) / 3
+	}
+
+	check(c.DataDir != "", "data_dir must not be empty")
+	check(c.LedgerDir != "", "ledger_dir must not be empty")
+	check(c.MaxTxNum > 0, "max_tx_num must be positive, got %d", c.MaxTxNum)
+	check(c.InjectSpeed > 0, "inject_speed must be positive, got %d", c.InjectSpeed)
+	check(c.MaxBlockSize > 0, "max_block_size must be positive, got %d", c.MaxBlockSize)
+	check(c.ExperimentMode == "local" || c.ExperimentMode == "remote", "experiment_mode must be local or remote, got %q", c.ExperimentMode)
+	check(c.NodeNum > 0, "node_num must be positive, got %d", c.NodeNum)
+	check(c.FaultyNodesNum >= 0, "faulty_nodes_num must not be negative, got %d", c.FaultyNodesNum)
+	check(c.NodeNum >= 3*c.FaultyNodesNum+1, "node_num %d cannot tolerate %d faulty nodes, at least 3f+1=%d nodes are needed", c.NodeNum, c.FaultyNodesNum, 3*c.FaultyNodesNum+1)
+	check(c.ElectionMethod != "", "election_method must not be empty")
+	check(c.RotationInterval >= 0, "rotation_interval must not be negative, got %d", c.RotationInterval)
+	check(c.RotationInterval == 0 || c.ReconfigFile == "", "rotation_interval cannot be combined with reconfig_file")
+	check(c.ExpireTime > 0, "expire_time must be positive, got %d", c.ExpireTime)
+	check(c.SeqNumberLowerBound >= 0, "seq_number_lower_bound must not be negative, got %d", c.SeqNumberLowerBound)
+	check(c.SeqNumberLowerBound < c.SeqNumberUpperBound, "seq_number_lower_bound %d must be below seq_number_upper_bound %d", c.SeqNumberLowerBound, c.SeqNumberUpperBound)
+	check(c.CheckpointInterval > 0, "checkpoint_interval must be positive, got %d", c.CheckpointInterval)
+	check(!c.TLSEnabled || c.TLSDir != "", "tls_dir must not be empty when tls_enabled is set")
+	check(c.WireFormat != "", "wire_format must not be empty")
+	check(c.MaxFrameSize > 0, "max_frame_size must be positive, got %d", c.MaxFrameSize)
+	check(c.SendQueueSize > 0, "send_queue_size must be positive, got %d", c.SendQueueSize)
+	check(c.SendQueuePolicy != "", "send_queue_policy must not be empty")
+	check(c.LogFormat == "text" || c.LogFormat == "json", "log_format must be text or json, got %q", c.LogFormat)
+	check(c.LogOutput == "file" || c.LogOutput == "stderr", "log_output must be file or stderr, got %q", c.LogOutput)
+	check(c.LogOutput != "file" || c.LogDir != "", "log_dir must not be empty when log_output is file")
+	check(c.LogMaxSize >= 0, "log_max_size must not be negative, got %d", c.LogMaxSize)
+	check(c.LogMaxBackups >= 0, "log_max_backups must not be negative, got %d", c.LogMaxBackups)
+	check(c.MetricsPortOffset >= 0, "metrics_port_offset must not be negative, got %d", c.MetricsPortOffset)
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout must not be negative, got %d", c.ShutdownTimeout)
+	check(c.AdminPortOffset >= 0, "admin_port_offset must not be negative, got %d", c.AdminPortOffset)
+	check(c.AdminPortOffset == 0 || c.AdminPortOffset != c.MetricsPortOffset, "admin_port_offset must differ from metrics_port_offset, both are %d", c.AdminPortOffset)
+	check((c.Operators == "" && c.Operator == "") || c.TLSDir != "", "tls_dir must not be empty when operators or operator is set")
+	for _, name := range c.OperatorNames() {
+		check(!strings.ContainsAny(name, " /\\"), "operators must be names without spaces or slashes, got %q", name)
 	}
+	check(!strings.ContainsAny(c.Operator, " /\\"), "operator must be a name without spaces or slashes, got %q", c.Operator)
 
-	config.FaultyNodesNum = (config.NodeNum - 1) / 3
-	return config
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// OperatorNames splits operators
+func (c *Config) OperatorNames() []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(c.Operators, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// --------------------------------------------------------
+// Environment & Flag Overrides
+// --------------------------------------------------------
+
+// every json field of Config can be overridden by PBFT_<FIELD> and --<field>,
+// with underscores replaced by dashes in the flag name
+type field struct {
+	key   string
+	flag  string
+	short string
+	value reflect.Value
+}
+
+func (c *Config) fields() []field {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	fields := make([]field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("json")
+		name := t.Field(i).Tag.Get("flag")
+		if name == "" {
+			name = strings.ReplaceAll(key, "_", "-")
+		}
+		fields = append(fields, field{
+			key:   key,
+			flag:  name,
+			short: t.Field(i).Tag.Get("short"),
+			value: v.Field(i),
+		})
+	}
+	return fields
+}
+
+func (f field) set(s string) error {
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(s)
+	case reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", s, f.key, err)
+		}
+		f.value.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", s, f.key, err)
+		}
+		f.value.SetBool(b)
+	}
+	return nil
+}
+
+func (c *Config) applyEnv() error {
+	for _, f := range c.fields() {
+		if s, ok := os.LookupEnv("PBFT_" + strings.ToUpper(f.key)); ok {
+			if err := f.set(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) applyFlags(fs *pflag.FlagSet) error {
+	for _, f := range c.fields() {
+		if fs.Changed(f.flag) {
+			if err := f.set(fs.Lookup(f.flag).Value.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BindFlags registers one flag per config field on fs, defaults are shown from Default()
+func BindFlags(fs *pflag.FlagSet) {
+	for _, f := range Default().fields() {
+		usage := fmt.Sprintf("overrides %s of the config file", f.key)
+		switch f.value.Kind() {
+		case reflect.String:
+			fs.StringP(f.flag, f.short, f.value.String(), usage)
+		case reflect.Int64:
+			fs.Int64P(f.flag, f.short, f.value.Int(), usage)
+		case reflect.Bool:
+			fs.BoolP(f.flag, f.short, f.value.Bool(), usage)
+		}
+	}
 }
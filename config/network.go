@@ -2,26 +2,190 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
 )
 
 var (
+	ClientID   int64
 	ClientAddr string
-	NodeAddr   map[int]string
+	// NodeAddr is the address book of every replica this process knows,
+	// including standby replicas that are not members yet. Once nodes are
+	// running use NodeAddrOf and AddNodeAddr, since reconfiguration updates it.
+	NodeAddr map[int]string
+
+	// members is the current replica set, a subset of the ids in NodeAddr
+	members []int64
+	// weights of the replicas given in the topology, the others weigh 1
+	weights map[int]int64
+	// endpoint address -> metrics address given in the topology
+	metricsAddrs map[string]string
+	// node address -> admin address given in the topology
+	adminAddrs  map[string]string
+	networkLock sync.RWMutex
 )
 
 func GenerateLocalNetwork(nodeNum int) {
 	localIp := "localhost:"
+	ClientID = 0
 	ClientAddr = localIp + "20000"
-	NodeAddr = make(map[int]string)
+	addrs := make(map[int]string)
 	for i := 0; i < nodeNum; i++ {
-		NodeAddr[i] = fmt.Sprintf("%s%d", localIp, 28000+i*100)
+		addrs[i] = fmt.Sprintf("%s%d", localIp, 28000+i*100)
 	}
+	setNetwork(addrs, nil)
 }
 
 func GenerateRemoteNetwork(nodeNum int) {
+	ClientID = 0
 	ClientAddr = "172.17.8.1:20000"
-	NodeAddr = make(map[int]string)
+	addrs := make(map[int]string)
 	for i := 0; i < nodeNum; i++ {
-		NodeAddr[i] = fmt.Sprintf("172.17.8.%d:28000", i+2)
+		addrs[i] = fmt.Sprintf("172.17.8.%d:28000", i+2)
+	}
+	setNetwork(addrs, nil)
+}
+
+// setNetwork installs the address book, every replica not listed in standby is a member
+func setNetwork(addrs map[int]string, standby map[int]bool) {
+	networkLock.Lock()
+	defer networkLock.Unlock()
+	NodeAddr = addrs
+	weights = make(map[int]int64)
+	metricsAddrs = make(map[string]string)
+	adminAddrs = make(map[string]string)
+	members = make([]int64, 0, len(addrs))
+	for id := range addrs {
+		if !standby[id] {
+			members = append(members, int64(id))
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i] < members[j] })
+}
+
+// --------------------------------------------------------
+// Membership
+// --------------------------------------------------------
+
+// NodeAddrOf returns the address of replica id from the address book
+func NodeAddrOf(id int64) (string, bool) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	addr, ok := NodeAddr[int(id)]
+	return addr, ok
+}
+
+// AddNodeAddr adds or replaces the address of replica id in the address book
+func AddNodeAddr(id int64, addr string) {
+	networkLock.Lock()
+	defer networkLock.Unlock()
+	NodeAddr[int(id)] = addr
+}
+
+// NodeIDs returns every replica id of the address book in ascending order
+func NodeIDs() []int64 {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	ids := make([]int64, 0, len(NodeAddr))
+	for id := range NodeAddr {
+		ids = append(ids, int64(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Members returns the ids of the current replica set in ascending order
+func Members() []int64 {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	return append([]int64(nil), members...)
+}
+
+func IsMember(id int64) bool {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	for _, member := range members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+// SetWeight sets the election weight of replica id
+func SetWeight(id int64, weight int64) {
+	networkLock.Lock()
+	defer networkLock.Unlock()
+	weights[int(id)] = weight
+}
+
+// WeightOf returns the election weight of replica id, 1 unless the topology sets one
+func WeightOf(id int64) int64 {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	if weight, ok := weights[int(id)]; ok {
+		return weight
+	}
+	return 1
+}
+
+// SetMetricsAddr makes the endpoint at addr serve its metrics on metricsAddr
+func SetMetricsAddr(addr, metricsAddr string) {
+	networkLock.Lock()
+	defer networkLock.Unlock()
+	metricsAddrs[addr] = metricsAddr
+}
+
+// MetricsAddrOf returns where the endpoint listening on addr serves its
+// metrics, the topology may set it, otherwise it is the port of addr plus offset
+func MetricsAddrOf(addr string, offset int64) (string, error) {
+	networkLock.RLock()
+	metricsAddr, ok := metricsAddrs[addr]
+	networkLock.RUnlock()
+	if ok {
+		return metricsAddr, nil
 	}
+	return offsetAddr(addr, offset)
+}
+
+// SetAdminAddr makes the node at addr serve its admin API on adminAddr
+func SetAdminAddr(addr, adminAddr string) {
+	networkLock.Lock()
+	defer networkLock.Unlock()
+	adminAddrs[addr] = adminAddr
+}
+
+// AdminAddrOf returns where the node listening on addr serves its admin API,
+// the topology may set it, otherwise it is the port of addr plus offset
+func AdminAddrOf(addr string, offset int64) (string, error) {
+	networkLock.RLock()
+	adminAddr, ok := adminAddrs[addr]
+	networkLock.RUnlock()
+	if ok {
+		return adminAddr, nil
+	}
+	return offsetAddr(addr, offset)
+}
+
+func offsetAddr(addr string, offset int64) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.ParseInt(port, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid port in %s: %v", addr, err)
+	}
+	return net.JoinHostPort(host, strconv.FormatInt(p+offset, 10)), nil
+}
+
+// SetMembers replaces the replica set, every id must be in the address book
+func SetMembers(ids []int64) {
+	sorted := append([]int64(nil), ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	networkLock.Lock()
+	members = sorted
+	networkLock.Unlock()
 }
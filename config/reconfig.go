@@ -0,0 +1,45 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// --------------------------------------------------------
+// Reconfiguration Schedule
+// --------------------------------------------------------
+
+// ReconfigStep is one change of the replica set the client submits during a run
+type ReconfigStep struct {
+	// AfterRequest is the number of transaction requests injected before the step
+	AfterRequest int64          `json:"after_request"`
+	Add          []NodeEndpoint `json:"add,omitempty"`
+	Remove       []int64        `json:"remove,omitempty"`
+	// FaultyNodesNum 0 means (n-1)/3 of the new replica set
+	FaultyNodesNum int64 `json:"faulty_nodes_num,omitempty"`
+}
+
+// LoadReconfigSchedule reads the steps of reconfig_file, an empty filename means no step
+func LoadReconfigSchedule(filename string) ([]ReconfigStep, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	jsonData, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading reconfiguration schedule: %v", err)
+	}
+	steps := make([]ReconfigStep, 0)
+	if err := json.Unmarshal(jsonData, &steps); err != nil {
+		return nil, fmt.Errorf("error unmarshaling reconfiguration schedule %s: %v", filename, err)
+	}
+	for i, step := range steps {
+		if step.AfterRequest < 0 {
+			return nil, fmt.Errorf("reconfiguration step %d: after_request must not be negative", i)
+		}
+		if len(step.Add) == 0 && len(step.Remove) == 0 && step.FaultyNodesNum == 0 {
+			return nil, fmt.Errorf("reconfiguration step %d changes nothing", i)
+		}
+	}
+	return steps, nil
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// --------------------------------------------------------
+// Cluster Topology
+// --------------------------------------------------------
+
+// Topology lists every endpoint of a cluster, so nodes can run on any set of
+// machines and ports without touching the code.
+type Topology struct {
+	Nodes   []NodeEndpoint   `json:"nodes"`
+	Clients []ClientEndpoint `json:"clients"`
+}
+
+type NodeEndpoint struct {
+	ID   int64  `json:"id"`
+	Addr string `json:"addr"`
+	// PublicKey is the path of the PEM certificate the node must present when TLS is enabled
+	PublicKey string `json:"public_key,omitempty"`
+	// Standby nodes are known but join the replica set only through a reconfiguration
+	Standby bool `json:"standby,omitempty"`
+	// Weight is used by the weighted election method, 0 means 1
+	Weight int64 `json:"weight,omitempty"`
+	// MetricsAddr replaces the address derived from metrics_port_offset
+	MetricsAddr string `json:"metrics_addr,omitempty"`
+	// AdminAddr replaces the address derived from admin_port_offset
+	AdminAddr string `json:"admin_addr,omitempty"`
+}
+
+type ClientEndpoint struct {
+	ID          int64  `json:"id"`
+	Addr        string `json:"addr"`
+	PublicKey   string `json:"public_key,omitempty"`
+	MetricsAddr string `json:"metrics_addr,omitempty"`
+}
+
+// NodePublicKeys maps node ids to the pinned certificate paths of the loaded topology
+var NodePublicKeys map[int]string
+
+// ClientPublicKey is the pinned certificate path of the client, if any
+var ClientPublicKey string
+
+func LoadTopology(filename string) (*Topology, error) {
+	jsonData, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading topology file: %v", err)
+	}
+	topology := &Topology{}
+	if err := json.Unmarshal(jsonData, topology); err != nil {
+		return nil, fmt.Errorf("error unmarshaling topology %s: %v", filename, err)
+	}
+	if err := topology.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid topology %s: %v", filename, err)
+	}
+	return topology, nil
+}
+
+// Validate checks that node ids are 0..n-1 without duplicates and that every
+// endpoint has a distinct address.
+func (t *Topology) Validate() error {
+	if len(t.Nodes) == 0 {
+		return fmt.Errorf("no nodes defined")
+	}
+	if len(t.Clients) == 0 {
+		return fmt.Errorf("no clients defined")
+	}
+	ids := make(map[int64]bool)
+	addrs := make(map[string]bool)
+	for _, node := range t.Nodes {
+		if node.ID < 0 || node.ID >= int64(len(t.Nodes)) {
+			return fmt.Errorf("node id %d out of range, ids must be 0..%d", node.ID, len(t.Nodes)-1)
+		}
+		if ids[node.ID] {
+			return fmt.Errorf("node id %d defined twice", node.ID)
+		}
+		ids[node.ID] = true
+		if node.Addr == "" {
+			return fmt.Errorf("node %d has no address", node.ID)
+		}
+		if node.Weight < 0 {
+			return fmt.Errorf("node %d has a negative weight", node.ID)
+		}
+		if addrs[node.Addr] {
+			return fmt.Errorf("address %s used twice", node.Addr)
+		}
+		addrs[node.Addr] = true
+	}
+	if t.MemberNum() == 0 {
+		return fmt.Errorf("every node is standby")
+	}
+	for _, client := range t.Clients {
+		if client.Addr == "" {
+			return fmt.Errorf("client %d has no address", client.ID)
+		}
+		if addrs[client.Addr] {
+			return fmt.Errorf("address %s used twice", client.Addr)
+		}
+		addrs[client.Addr] = true
+	}
+	return nil
+}
+
+// Apply installs the topology as the network of this process. The first
+// client endpoint is the one the client listens on.
+func (t *Topology) Apply() {
+	addrs := make(map[int]string)
+	standby := make(map[int]bool)
+	NodePublicKeys = make(map[int]string)
+	for _, node := range t.Nodes {
+		addrs[int(node.ID)] = node.Addr
+		standby[int(node.ID)] = node.Standby
+		if node.PublicKey != "" {
+			NodePublicKeys[int(node.ID)] = node.PublicKey
+		}
+	}
+	setNetwork(addrs, standby)
+	for _, node := range t.Nodes {
+		if node.Weight > 0 {
+			SetWeight(node.ID, node.Weight)
+		}
+		if node.MetricsAddr != "" {
+			SetMetricsAddr(node.Addr, node.MetricsAddr)
+		}
+		if node.AdminAddr != "" {
+			SetAdminAddr(node.Addr, node.AdminAddr)
+		}
+	}
+	if t.Clients[0].MetricsAddr != "" {
+		SetMetricsAddr(t.Clients[0].Addr, t.Clients[0].MetricsAddr)
+	}
+	ClientID = t.Clients[0].ID
+	ClientAddr = t.Clients[0].Addr
+	ClientPublicKey = t.Clients[0].PublicKey
+}
+
+// MemberNum returns the number of nodes that are members from the start
+func (t *Topology) MemberNum() int {
+	num := 0
+	for _, node := range t.Nodes {
+		if !node.Standby {
+			num++
+		}
+	}
+	return num
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/michael112233/pbft/config"
+	"github.com/michael112233/pbft/network"
+)
+
+// --------------------------------------------------------
+// Admin Requests
+// --------------------------------------------------------
+
+const adminTimeout = 5 * time.Second
+
+// adminRequests maps the requests of the admin command to their method, the
+// path is the request name
+var adminRequests = map[string]string{
+	"status":   http.MethodGet,
+	"dump":     http.MethodGet,
+	"pause":    http.MethodPost,
+	"resume":   http.MethodPost,
+	"shutdown": http.MethodPost,
+}
+
+var adminRequestNames = []string{"status", "dump", "pause", "resume", "shutdown"}
+
+// runAdmin sends request to the admin API of replica nodeID, or of every
+// member for -1, signed with the key of operator if one is set
+func runAdmin(cfg *config.Config, nodeID int64, request string) {
+	method, ok := adminRequests[request]
+	if !ok {
+		fmt.Printf("unknown request %q, expected one of %s\n", request, strings.Join(adminRequestNames, ", "))
+		os.Exit(2)
+	}
+	if cfg.AdminPortOffset == 0 {
+		fmt.Println("the admin API is disabled, admin_port_offset is 0")
+		os.Exit(2)
+	}
+	var key *network.OperatorKey
+	if cfg.Operator != "" {
+		var err error
+		if key, err = network.LoadOperatorKey(cfg.TLSDir, cfg.Operator); err != nil {
+			fmt.Printf("error loading operator key: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	nodeIDs := []int64{nodeID}
+	if nodeID == -1 {
+		nodeIDs = config.Members()
+	}
+	failed := false
+	httpClient := &http.Client{Timeout: adminTimeout}
+	for _, id := range nodeIDs {
+		body, err := adminRequest(httpClient, key, id, method, "/"+request, cfg.AdminPortOffset)
+		if err != nil {
+			fmt.Printf("node %d: %v\n", id, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("node %d: %s", id, body)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func adminRequest(httpClient *http.Client, key *network.OperatorKey, nodeID int64, method string, path string, offset int64) ([]byte, error) {
+	addr, ok := config.NodeAddrOf(nodeID)
+	if !ok {
+		return nil, fmt.Errorf("unknown node %d", nodeID)
+	}
+	adminAddr, err := config.AdminAddrOf(addr, offset)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, "http://"+adminAddr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		if err := key.SignAdminRequest(req, nodeID); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
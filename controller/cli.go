@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/michael112233/pbft/analyze"
+	"github.com/michael112233/pbft/config"
+	"github.com/michael112233/pbft/inspect"
+	"github.com/spf13/pflag"
+)
+
+// --------------------------------------------------------
+// Command Line
+// --------------------------------------------------------
+
+const defaultConfigPath = "config/run.json"
+
+// command is one subcommand of pbft_main. Every command accepts --config and
+// the flags of the config fields, the others are added by flags.
+type command struct {
+	name    string
+	summary string
+	// topology commands accept --topology
+	topology bool
+	flags    func(fs *pflag.FlagSet)
+	run      func(cfg *config.Config)
+}
+
+func commands() []*command {
+	var nodeID int64
+	var matrixPath string
+	var cfgFlag *pflag.Flag
+	var show string
+	var asJSON bool
+	filter := inspect.NoFilter()
+	var logFilter analyze.Filter
+	var issuesOnly bool
+	var request string
+	return []*command{
+		{
+			name:     "node",
+			summary:  "run the replica given by --node-id",
+			topology: true,
+			flags: func(fs *pflag.FlagSet) {
+				fs.Int64VarP(&nodeID, "node-id", "n", 0, "id of the replica")
+			},
+			run: func(cfg *config.Config) { runNode(nodeID, cfg) },
+		},
+		{
+			name:     "client",
+			summary:  "inject the transactions of data_dir and collect the replies",
+			topology: true,
+			run:      runClient,
+		},
+		{
+			name:    "verify",
+			summary: "check the ledgers in ledger_dir against the safety invariants",
+			run:     runVerify,
+		},
+		{
+			name:    "inspect",
+			summary: "print the blocks, transactions, checkpoints, views or balances in the ledger of a replica",
+			flags: func(fs *pflag.FlagSet) {
+				fs.Int64VarP(&nodeID, "node-id", "n", 0, "id of the replica whose ledger is read")
+				fs.StringVar(&show, "show", inspect.ShowBlocks, "what to print: "+strings.Join(inspect.Shows, ", "))
+				fs.Int64Var(&filter.FromSeq, "from-seq", -1, "first sequence number, -1 for the first one")
+				fs.Int64Var(&filter.ToSeq, "to-seq", -1, "last sequence number, -1 for the last one")
+				fs.Int64Var(&filter.View, "view", -1, "only records of this view, -1 for every view")
+				fs.StringVar(&filter.Account, "account", "", "only blocks and transactions touching this account")
+				fs.BoolVar(&asJSON, "json", false, "print JSON instead of a table")
+			},
+			run: func(cfg *config.Config) { runInspect(cfg, nodeID, show, filter, asJSON) },
+		},
+		{
+			name:    "analyze",
+			summary: "rebuild the per sequence number timelines of the logs in log_dir and flag issues",
+			flags: func(fs *pflag.FlagSet) {
+				fs.Int64Var(&logFilter.FromSeq, "from-seq", -1, "first sequence number, -1 for the first one")
+				fs.Int64Var(&logFilter.ToSeq, "to-seq", -1, "last sequence number, -1 for the last one")
+				fs.BoolVar(&issuesOnly, "issues-only", false, "print the issues without the timelines")
+				fs.BoolVar(&asJSON, "json", false, "print JSON instead of a table")
+			},
+			run: func(cfg *config.Config) { runAnalyze(cfg, logFilter, issuesOnly, asJSON) },
+		},
+		{
+			name:     "admin",
+			summary:  "send a request to the admin API of a replica, signed by operator",
+			topology: true,
+			flags: func(fs *pflag.FlagSet) {
+				fs.Int64VarP(&nodeID, "node-id", "n", -1, "id of the replica, -1 for every member")
+				fs.StringVar(&request, "request", "status", "request to send: "+strings.Join(adminRequestNames, ", "))
+			},
+			run: func(cfg *config.Config) { runAdmin(cfg, nodeID, request) },
+		},
+		{
+			name:     "keygen",
+			summary:  "create a CA and a certificate per endpoint and the operator keys in tls_dir",
+			topology: true,
+			run:      runKeygen,
+		},
+		{
+			name:    "bench",
+			summary: "run every combination of an experiment matrix with local processes",
+			flags: func(fs *pflag.FlagSet) {
+				fs.StringVar(&matrixPath, "matrix", "config/bench.json", "experiment matrix")
+				// the processes of a run load the same config file
+				cfgFlag = fs.Lookup("config")
+			},
+			run: func(cfg *config.Config) { runBench(cfg, matrixPath, cfgFlag.Value.String()) },
+		},
+	}
+}
+
+// Main runs the command named by the first argument, e.g.
+// pbft_main node --node-id 1 --config config/run.json
+func Main(args []string) {
+	program := filepath.Base(os.Args[0])
+	args = legacyRole(args)
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		if len(args) > 1 {
+			args = []string{args[1], "--help"}
+		} else {
+			usage(program)
+			return
+		}
+	}
+
+	var cmd *command
+	for _, c := range commands() {
+		if c.name == args[0] {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		usage(program)
+		os.Exit(2)
+	}
+
+	fs := pflag.NewFlagSet(cmd.name, pflag.ContinueOnError)
+	fs.SortFlags = false
+	cfgPath := fs.StringP("config", "c", defaultConfigPath, "config file")
+	topologyPath := new(string)
+	if cmd.topology {
+		fs.StringVarP(topologyPath, "topology", "t", "", "cluster topology file listing node and client addresses")
+	}
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	// every field of the config file can also be set by a flag, e.g. --mode remote or --ledger-dir out
+	config.BindFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags]\n\n%s\n\nFlags:\n%s", program, cmd.name, cmd.summary, fs.FlagUsages())
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		if err == pflag.ErrHelp {
+			return
+		}
+		os.Exit(2)
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments %v\n", fs.Args())
+		fs.Usage()
+		os.Exit(2)
+	}
+	cmd.run(setup(*cfgPath, *topologyPath, fs))
+}
+
+func usage(program string) {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", program)
+	for _, c := range commands() {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> --help' for the flags of a command.\n", program)
+}
+
+// legacyRole turns the old "--role <role>" form into the command of the role,
+// which defaulted to node
+func legacyRole(args []string) []string {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args
+	}
+	role := "node"
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		switch {
+		case (args[i] == "-r" || args[i] == "--role") && i+1 < len(args):
+			role = args[i+1]
+			i++
+		case strings.HasPrefix(args[i], "--role="):
+			role = strings.TrimPrefix(args[i], "--role=")
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	if len(args) == 0 || (len(args) == 1 && (args[0] == "-h" || args[0] == "--help")) {
+		return args
+	}
+	fmt.Fprintf(os.Stderr, "--role is deprecated, use: %s %s [flags]\n", filepath.Base(os.Args[0]), role)
+	return append([]string{role}, rest...)
+}
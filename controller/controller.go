@@ -1,75 +1,305 @@
 package controller
 
 import (
-	"time"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"github.com/michael112233/pbft/analyze"
+	"github.com/michael112233/pbft/bench"
 	"github.com/michael112233/pbft/client"
 	"github.com/michael112233/pbft/config"
 	"github.com/michael112233/pbft/core"
 	"github.com/michael112233/pbft/data"
+	"github.com/michael112233/pbft/inspect"
+	"github.com/michael112233/pbft/leader_election"
 	"github.com/michael112233/pbft/logger"
+	"github.com/michael112233/pbft/network"
 	"github.com/michael112233/pbft/node"
 	"github.com/michael112233/pbft/result"
+	"github.com/michael112233/pbft/verify"
+	"github.com/spf13/pflag"
 )
 
 var log = logger.NewLogger(0, "controller")
 
+// signalContext is cancelled by SIGINT or SIGTERM, a second signal kills the
+// process while it is still shutting down
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
 func runNode(nodeID int64, cfg *config.Config) {
-	Node := node.NewNode(nodeID, cfg)
-	Node.Start()
-
-	// Keep the node process alive until a stop signal is received
-	for {
-		select {
-		case <-Node.StopChan:
-			time.Sleep(20 * time.Second)
-			Node.Stop()
-			return
-		default:
-			time.Sleep(1 * time.Second)
-		}
+	ctx, stop := signalContext()
+	defer stop()
+
+	// Run returns once the node has drained and closed everything it opened
+	n, err := node.NewNode(nodeID, cfg)
+	if err == nil {
+		err = n.Run(ctx)
+	}
+	if err != nil {
+		log.Error("node %d: %v", nodeID, err)
+		fmt.Println(err)
+		os.Exit(1)
 	}
 }
 
 func runClient(cfg *config.Config) {
-	defer result.PrintResult()
+	ctx, stop := signalContext()
+	defer stop()
 
 	// Init a blockchain (no FinishInjecting usage)
 	core.NewBlockchain(cfg)
 
 	// Init a client
-	client := client.NewClient(config.ClientAddr, cfg)
+	client, err := client.NewClient(config.ClientID, config.ClientAddr, cfg)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
 	// Get the transaction details
-	txs := data.ReadData(cfg.MaxTxNum)
+	txs := data.ReadData(cfg.DataDir, cfg.MaxTxNum)
 	client.AddTxs(txs)
-	client.Start()
+	reconfigs, err := config.LoadReconfigSchedule(cfg.ReconfigFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	client.AddReconfigs(reconfigs)
+	if err := client.Start(ctx); err != nil {
+		client.Stop()
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	// Wait for client's injection goroutine(s) to finish
-	// client.Stop() waits for WaitGroup and then returns; message hub remains available to send close messages
-	client.Stop()
+	// Wait for the injection and the results of the requests in flight, an
+	// interrupted run still closes the nodes and writes its record
+	waitErr := client.Wait(ctx)
+
+	// the record ends with the last request, not with the close messages
+	record := result.NewRecord(cfg)
 
 	// Broadcast close to all nodes after injection completes
 	client.BroadcastClose()
+	client.Stop()
+
+	if cfg.ResultDir != "" {
+		path, err := record.Write(cfg.ResultDir)
+		if err != nil {
+			log.Error("failed to write result record to %s: %v", cfg.ResultDir, err)
+		} else {
+			log.Info("result record written to %s", path)
+		}
+	}
+	result.PrintResult()
+	if waitErr != nil {
+		log.Error("client: %v", waitErr)
+		fmt.Println(waitErr)
+		os.Exit(1)
+	}
+}
+
+func runVerify(cfg *config.Config) {
+	report, err := verify.CheckDir(cfg.LedgerDir)
+	if err != nil {
+		fmt.Printf("error reading ledgers: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("checked %d replicas, %d commits, %d client-accepted results\n", report.Replicas, report.Commits, report.Accepted)
+	for _, violation := range report.Violations {
+		fmt.Println(violation.String())
+	}
+	if !report.OK() {
+		fmt.Printf("%d invariant violations found\n", len(report.Violations))
+		os.Exit(1)
+	}
+	fmt.Println("all invariants hold")
+}
+
+// runInspect prints one view of the ledger replica nodeID wrote into ledger_dir
+func runInspect(cfg *config.Config, nodeID int64, show string, filter inspect.Filter, asJSON bool) {
+	records, err := inspect.Load(cfg.LedgerDir, nodeID)
+	if err != nil {
+		fmt.Printf("error reading ledger: %v\n", err)
+		os.Exit(1)
+	}
+	rows, err := inspect.Inspect(records, show, filter)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if asJSON {
+		err = inspect.WriteJSON(os.Stdout, rows)
+	} else {
+		err = inspect.WriteText(os.Stdout, rows)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// runAnalyze prints the timelines and issues found in the logs of log_dir
+func runAnalyze(cfg *config.Config, filter analyze.Filter, issuesOnly bool, asJSON bool) {
+	report, err := analyze.AnalyzeDir(cfg.LogDir, filter)
+	if err != nil {
+		fmt.Printf("error reading logs: %v\n", err)
+		os.Exit(1)
+	}
+	if asJSON {
+		err = analyze.WriteJSON(os.Stdout, report)
+	} else {
+		err = analyze.WriteText(os.Stdout, report, issuesOnly)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
 
-func Main(nodeID int64, role, mode, cfgPath string) {
-	cfg := config.ReadCfg(cfgPath)
+// runBench runs every combination of the matrix with local child processes,
+// Ctrl+C kills the current run and skips the rest. All processes share
+// tls_dir, so the keys of the operators are created when they are missing.
+func runBench(cfg *config.Config, matrixPath, cfgPath string) {
+	matrix, err := bench.LoadMatrix(matrixPath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	created, err := network.GenerateMissingOperatorKeys(cfg.TLSDir, cfg.OperatorNames())
+	if err != nil {
+		fmt.Printf("error generating operator keys: %v\n", err)
+		os.Exit(1)
+	}
+	if len(created) > 0 {
+		fmt.Printf("generated keys of operators %s in %s\n", strings.Join(created, ", "), cfg.TLSDir)
+	}
+	runner, err := bench.NewRunner(matrix, cfgPath)
+	if err != nil {
+		fmt.Printf("error preparing bench: %v\n", err)
+		os.Exit(1)
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		runner.Kill()
+	}()
+
+	outcomes := runner.Run(ctx)
+	failed := 0
+	for _, outcome := range outcomes {
+		if outcome.Status != "ok" || !outcome.Verified {
+			failed++
+		}
+	}
+	fmt.Printf("%d runs, %d failed, results in %s\n", len(outcomes), failed, runner.Dir())
+	if failed > 0 || ctx.Err() != nil {
+		os.Exit(1)
+	}
+}
+
+// runKeygen creates a local CA and one certificate per node and for the client
+func runKeygen(cfg *config.Config) {
+	hostsOf := func(addr string) []string {
+		hosts := []string{"localhost", "127.0.0.1"}
+		if host, _, err := net.SplitHostPort(addr); err == nil && host != "localhost" {
+			hosts = append(hosts, host)
+		}
+		return hosts
+	}
+
+	identities := map[string][]string{
+		network.Identity(core.RoleClient, config.ClientID): hostsOf(config.ClientAddr),
+	}
+	for id, addr := range config.NodeAddr {
+		identities[network.Identity(core.RoleNode, int64(id))] = hostsOf(addr)
+	}
+	if err := network.GenerateCertificates(cfg.TLSDir, identities); err != nil {
+		fmt.Printf("error generating certificates: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("generated CA and %d certificates in %s\n", len(identities), cfg.TLSDir)
+	if operators := cfg.OperatorNames(); len(operators) > 0 {
+		if err := network.GenerateOperatorKeys(cfg.TLSDir, operators); err != nil {
+			fmt.Printf("error generating operator keys: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("generated keys of operators %s in %s\n", strings.Join(operators, ", "), cfg.TLSDir)
+	}
+}
+
+// validate checks the config together with the options only the network,
+// leader_election and logger packages know
+func validate(cfg *config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if _, err := network.GetCodec(cfg.WireFormat); err != nil {
+		return fmt.Errorf("invalid config: wire_format: %w", err)
+	}
+	if _, err := network.ParseOverflowPolicy(cfg.SendQueuePolicy); err != nil {
+		return fmt.Errorf("invalid config: send_queue_policy: %w", err)
+	}
+	if _, err := leader_election.GetStrategy(cfg.ElectionMethod); err != nil {
+		return fmt.Errorf("invalid config: election_method: %w", err)
+	}
+	if _, err := logger.ParseLevel(cfg.LogLevel); err != nil {
+		return fmt.Errorf("invalid config: log_level: %w", err)
+	}
+	return nil
+}
 
-	// mode -> network structure
-	switch mode {
-	case "local":
-		config.GenerateLocalNetwork(int(cfg.NodeNum))
-	case "remote":
-		config.GenerateRemoteNetwork(int(cfg.NodeNum))
+// setup loads the config of a command, applies the topology and configures
+// the logger and the network, every error exits the process
+func setup(cfgPath, topologyPath string, flags *pflag.FlagSet) *config.Config {
+	cfg, err := config.Load(cfgPath, flags)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
-	// if mode == "local", then all nodes are running on the same machin
-	// role -> system role
-	switch role {
-	case "node":
-		runNode(nodeID, cfg)
-	case "client":
-		runClient(cfg)
+	// topology file or experiment mode -> network structure
+	if topologyPath != "" {
+		topology, err := config.LoadTopology(topologyPath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		topology.Apply()
+		if cfg.NodeNum != int64(topology.MemberNum()) {
+			log.Warn("node_num %d overridden by the %d member nodes of topology %s", cfg.NodeNum, topology.MemberNum(), topologyPath)
+			cfg.NodeNum = int64(topology.MemberNum())
+		}
+	}
+	if err := validate(cfg); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := logger.Configure(logOptions(cfg)); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	watchLogLevel()
+	if topologyPath == "" {
+		switch cfg.ExperimentMode {
+		case "local":
+			config.GenerateLocalNetwork(int(cfg.NodeNum))
+		case "remote":
+			config.GenerateRemoteNetwork(int(cfg.NodeNum))
+		}
 	}
+	return cfg
 }
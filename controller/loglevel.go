@@ -0,0 +1,17 @@
+package controller
+
+import (
+	"github.com/michael112233/pbft/config"
+	"github.com/michael112233/pbft/logger"
+)
+
+func logOptions(cfg *config.Config) logger.Options {
+	return logger.Options{
+		Level:      cfg.LogLevel,
+		Format:     cfg.LogFormat,
+		Output:     cfg.LogOutput,
+		Dir:        cfg.LogDir,
+		MaxSize:    cfg.LogMaxSize,
+		MaxBackups: int(cfg.LogMaxBackups),
+	}
+}
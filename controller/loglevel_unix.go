@@ -0,0 +1,31 @@
+//go:build !windows
+
+package controller
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/michael112233/pbft/logger"
+)
+
+// watchLogLevel switches between debug and the configured log level on
+// SIGUSR1, so a running replica can be inspected without a restart:
+//
+//	kill -USR1 <pid>
+func watchLogLevel() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			next := slog.LevelDebug
+			if logger.GetLevel() == slog.LevelDebug {
+				next = logger.ConfiguredLevel()
+			}
+			logger.SetLevel(next)
+			log.Warn("log level set to %s", next)
+		}
+	}()
+}
@@ -0,0 +1,4 @@
+package controller
+
+// watchLogLevel is not available without SIGUSR1
+func watchLogLevel() {}
@@ -4,16 +4,16 @@ type Block struct {
 	SequenceNumber int64
 	Transactions   []*Transaction
 
-	proposedLeader string
-	committedNode  []string
+	proposedLeader int64
+	committedNode  []int64
 }
 
-func NewBlock(sequenceNumber int64, txs []*Transaction, leader string) *Block {
+func NewBlock(sequenceNumber int64, txs []*Transaction, leader int64) *Block {
 	block := &Block{
 		SequenceNumber: sequenceNumber,
 		Transactions:   txs,
 		proposedLeader: leader,
-		committedNode:  make([]string, 0),
+		committedNode:  make([]int64, 0),
 	}
 
 	return block
@@ -23,6 +23,6 @@ func (b *Block) AddTransaction(txs []*Transaction) {
 	b.Transactions = append(b.Transactions, txs...)
 }
 
-func (b *Block) AddCommittedNode(node string) {
+func (b *Block) AddCommittedNode(node int64) {
 	b.committedNode = append(b.committedNode, node)
 }
@@ -39,7 +39,7 @@ func (b *Blockchain) AddBlock(block *Block) {
 		b.logger.Info("current committed: %v to block %d", existingBlock.committedNode, block.SequenceNumber)
 	} else {
 		b.Blocks = append(b.Blocks, block)
-		b.logger.Info("add block %d, who committed: %v, who proposed: %s", block.SequenceNumber, block.committedNode, block.proposedLeader)
+		b.logger.Info("add block %d, who committed: %v, who proposed: %d", block.SequenceNumber, block.committedNode, block.proposedLeader)
 		result.AddCommittedTransactionNum(int64(len(block.Transactions)))
 		if b.cfg.MaxTxNum == result.GetCommittedTransactionNum() {
 			b.logger.Info("finish injecting: %d=%d", b.cfg.MaxTxNum, result.GetCommittedTransactionNum())
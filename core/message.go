@@ -1,22 +1,24 @@
 package core
 
-type Message struct {
-	MsgType string
-	Data    []byte
-}
+import (
+	"errors"
+	"fmt"
+)
 
 type RequestMessage struct {
 	Timestamp int64
-	From      string
-	To        string
+	From      int64
+	To        int64
 	Txs       []*Transaction
 	Id        int64
+	// Reconfig is set on requests that change the replica set instead of executing transactions
+	Reconfig *Reconfiguration
 }
 
 type PreprepareMessage struct {
 	Timestamp      int64
-	From           string
-	To             string
+	From           int64
+	To             int64
 	SequenceNumber int64
 	ViewNumber     int64
 	Digest         string
@@ -25,8 +27,8 @@ type PreprepareMessage struct {
 
 type PrepareMessage struct {
 	Timestamp      int64
-	From           string
-	To             string
+	From           int64
+	To             int64
 	SequenceNumber int64
 	ViewNumber     int64
 	Digest         string
@@ -35,8 +37,8 @@ type PrepareMessage struct {
 
 type CommitMessage struct {
 	Timestamp      int64
-	From           string
-	To             string
+	From           int64
+	To             int64
 	SequenceNumber int64
 	ViewNumber     int64
 	Digest         string
@@ -45,24 +47,28 @@ type CommitMessage struct {
 
 type ReplyMessage struct {
 	Timestamp      int64
-	From           string
-	To             string
+	From           int64
+	To             int64
 	SequenceNumber int64
 	ViewNumber     int64
 	Digest         string
 	RequestMessage *RequestMessage
 }
 
+// CloseMessage stops the replica To. With operators configured it must be
+// signed by one of them, Signature covers SignedBytes.
 type CloseMessage struct {
 	Timestamp int64
-	From      string
-	To        string
+	From      int64
+	To        int64
+	Operator  string
+	Signature []byte
 }
 
 type ViewChangeMessage struct {
 	Timestamp           int64
-	From                string
-	To                  string
+	From                int64
+	To                  int64
 	CheckpointSeqNumber int64
 	ViewNumber          int64
 	CheckpointMsgNumber int32
@@ -71,8 +77,125 @@ type ViewChangeMessage struct {
 
 type CheckpointMessage struct {
 	Timestamp      int64
-	From           string
-	To             string
+	From           int64
+	To             int64
+	SequenceNumber int64
+	Digest         string
+}
+
+// StateRequestMessage is sent by a replica joining the replica set
+type StateRequestMessage struct {
+	Timestamp int64
+	From      int64
+	To        int64
+	// FromSequenceNumber is the first committed sequence number the joiner
+	// still needs, 0 asks for the history from its start
+	FromSequenceNumber int64
+}
+
+// StateResponseMessage carries one chunk of the committed history, starting
+// at FromSequenceNumber, towards SequenceNumber, the last stable checkpoint
+// or where the replica set last changed, together with the set at that point.
+// The chunk reaching SequenceNumber completes the state.
+type StateResponseMessage struct {
+	Timestamp          int64
+	From               int64
+	To                 int64
+	SequenceNumber     int64
+	ViewNumber         int64
+	Digest             string
+	Members            []Member
+	FaultyNodesNum     int64
+	History            []*CommittedRequest
+	FromSequenceNumber int64
+}
+
+// Complete reports whether the chunk ends the state transfer
+func (m *StateResponseMessage) Complete() bool {
+	return len(m.History) == 0 || m.History[len(m.History)-1].SequenceNumber >= m.SequenceNumber
+}
+
+// HandoffMessage is sent by the primary of a rotation term to the primary of
+// the next term once it proposed the last sequence number of its term
+type HandoffMessage struct {
+	Timestamp      int64
+	From           int64
+	To             int64
+	SequenceNumber int64
+	ViewNumber     int64
+	Digest         string
+}
+
+// CommittedRequest is one entry of the committed history
+type CommittedRequest struct {
 	SequenceNumber int64
+	ViewNumber     int64
 	Digest         string
+	RequestMessage *RequestMessage
+}
+
+// Sender is implemented by every protocol message. Sender returns the id of
+// the replica or client the message claims to come from, which the transport
+// checks against the identity of the connection when TLS is enabled.
+type Sender interface {
+	Sender() int64
+}
+
+func (m *RequestMessage) Sender() int64       { return m.From }
+func (m *PreprepareMessage) Sender() int64    { return m.From }
+func (m *PrepareMessage) Sender() int64       { return m.From }
+func (m *CommitMessage) Sender() int64        { return m.From }
+func (m *ReplyMessage) Sender() int64         { return m.From }
+func (m *CloseMessage) Sender() int64         { return m.From }
+func (m *ViewChangeMessage) Sender() int64    { return m.From }
+func (m *CheckpointMessage) Sender() int64    { return m.From }
+func (m *StateRequestMessage) Sender() int64  { return m.From }
+func (m *StateResponseMessage) Sender() int64 { return m.From }
+func (m *HandoffMessage) Sender() int64       { return m.From }
+
+// Validator is implemented by messages whose handlers rely on nested fields.
+// Decoding rejects a message whose Validate returns an error, so a Byzantine
+// peer cannot crash a replica with a nil request or transaction.
+type Validator interface {
+	Validate() error
+}
+
+func validateRequest(request *RequestMessage) error {
+	if request == nil {
+		return errors.New("missing request message")
+	}
+	return request.Validate()
+}
+
+func (m *RequestMessage) Validate() error {
+	for i, tx := range m.Txs {
+		if tx == nil || tx.Amount == nil {
+			return fmt.Errorf("transaction %d is incomplete", i)
+		}
+	}
+	return nil
+}
+
+func (m *PreprepareMessage) Validate() error { return validateRequest(m.RequestMessage) }
+func (m *PrepareMessage) Validate() error    { return validateRequest(m.RequestMessage) }
+func (m *CommitMessage) Validate() error     { return validateRequest(m.RequestMessage) }
+func (m *ReplyMessage) Validate() error      { return validateRequest(m.RequestMessage) }
+
+func (m *StateResponseMessage) Validate() error {
+	for i, entry := range m.History {
+		if entry == nil {
+			return fmt.Errorf("history entry %d is missing", i)
+		}
+		if err := validateRequest(entry.RequestMessage); err != nil {
+			return fmt.Errorf("history entry %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// SignedBytes are the bytes an operator signs to stop replica To, the
+// timestamp and the target keep a captured message from stopping another
+// replica or a restarted one later
+func (m *CloseMessage) SignedBytes() []byte {
+	return []byte(fmt.Sprintf("close %d %d %d %s", m.Timestamp, m.From, m.To, m.Operator))
 }
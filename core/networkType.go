@@ -9,4 +9,9 @@ const (
 	MsgCloseMessage      string = "MsgCloseMessage"
 	MsgViewChangeMessage string = "MsgViewChangeMessage"
 	MsgCheckpointMessage string = "MsgCheckpointMessage"
+
+	MsgStateRequestMessage  string = "MsgStateRequestMessage"
+	MsgStateResponseMessage string = "MsgStateResponseMessage"
+
+	MsgHandoffMessage string = "MsgHandoffMessage"
 )
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"sort"
+
+	"github.com/michael112233/pbft/config"
+)
+
+// --------------------------------------------------------
+// Weighted Quorum
+// --------------------------------------------------------
+
+// Quorum holds the voting weights of a replica set, taken from the weight of
+// every replica in the topology. Replicas form a quorum once they carry more
+// than 2/3 of the total weight: two quorums then share more than 1/3 of it,
+// more than the faulty replicas may hold. With a weight of 1 everywhere this
+// is the usual 2f+1 out of 3f+1.
+type Quorum struct {
+	weights map[int64]int64
+	total   int64
+}
+
+func NewQuorum(members []int64) *Quorum {
+	q := &Quorum{weights: make(map[int64]int64, len(members))}
+	for _, id := range members {
+		weight := config.WeightOf(id)
+		q.weights[id] = weight
+		q.total += weight
+	}
+	return q
+}
+
+func (q *Quorum) Total() int64 {
+	return q.total
+}
+
+// WeightOf sums the weight of ids, replicas outside the replica set weigh nothing
+func (q *Quorum) WeightOf(ids []int64) int64 {
+	weight := int64(0)
+	for _, id := range ids {
+		weight += q.weights[id]
+	}
+	return weight
+}
+
+// Reached reports whether ids carry more than 2/3 of the total weight
+func (q *Quorum) Reached(ids []int64) bool {
+	return 3*q.WeightOf(ids) > 2*q.total
+}
+
+// Attested reports whether ids carry more than 1/3 of the total weight, so at
+// least one of them is correct. With a weight of 1 everywhere this is f+1.
+func (q *Quorum) Attested(ids []int64) bool {
+	return 3*q.WeightOf(ids) > q.total
+}
+
+// --------------------------------------------------------
+// Vote Set
+// --------------------------------------------------------
+
+// VoteSet collects the votes of distinct replicas for the same value, so a
+// replica sending its vote twice is counted once.
+type VoteSet struct {
+	voters   map[int64]bool
+	complete bool
+}
+
+func NewVoteSet() *VoteSet {
+	return &VoteSet{voters: make(map[int64]bool)}
+}
+
+// Add records the vote of id, it returns false if id already voted
+func (v *VoteSet) Add(id int64) bool {
+	if v.voters[id] {
+		return false
+	}
+	v.voters[id] = true
+	return true
+}
+
+func (v *VoteSet) Has(id int64) bool {
+	return v.voters[id]
+}
+
+func (v *VoteSet) Size() int {
+	return len(v.voters)
+}
+
+// Voters returns the ids that voted in ascending order
+func (v *VoteSet) Voters() []int64 {
+	ids := make([]int64, 0, len(v.voters))
+	for id := range v.voters {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Complete reports whether the votes just became a quorum of q. It returns
+// true only once, so the caller acts on a quorum exactly once however many
+// votes arrive after it.
+func (v *VoteSet) Complete(q *Quorum) bool {
+	if v.complete || !q.Reached(v.Voters()) {
+		return false
+	}
+	v.complete = true
+	return true
+}
+
+// IsComplete reports whether Complete already returned true
+func (v *VoteSet) IsComplete() bool {
+	return v.complete
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/michael112233/pbft/config"
+)
+
+// --------------------------------------------------------
+// Membership Reconfiguration
+// --------------------------------------------------------
+
+// Member is a replica of the replica set
+type Member struct {
+	ID   int64
+	Addr string
+}
+
+// Reconfiguration is carried by a request committed at sequence number s and
+// changes the replica set once s + checkpoint_interval is committed.
+type Reconfiguration struct {
+	// Addr may be empty when the address book already knows the replica
+	Add    []Member
+	Remove []int64
+	// FaultyNodesNum 0 means (n-1)/3 of the new replica set. Quorums follow
+	// the voting weight of the members, f only bounds the size of the new set
+	// and the matching states a joining replica waits for.
+	FaultyNodesNum int64
+}
+
+func (r *Reconfiguration) String() string {
+	add := make([]int64, 0, len(r.Add))
+	for _, member := range r.Add {
+		add = append(add, member.ID)
+	}
+	return fmt.Sprintf("add %v, remove %v, f %d", add, r.Remove, r.FaultyNodesNum)
+}
+
+// Next returns the replica set and f after applying r to members. It does not
+// change anything, so every replica rejects an invalid change in the same way.
+func (r *Reconfiguration) Next(members []int64) ([]int64, int64, error) {
+	set := make(map[int64]bool, len(members))
+	for _, id := range members {
+		set[id] = true
+	}
+	for _, id := range r.Remove {
+		if !set[id] {
+			return nil, 0, fmt.Errorf("node %d is not a member", id)
+		}
+		delete(set, id)
+	}
+	for _, member := range r.Add {
+		if set[member.ID] {
+			return nil, 0, fmt.Errorf("node %d is already a member", member.ID)
+		}
+		if _, known := config.NodeAddrOf(member.ID); member.Addr == "" && !known {
+			return nil, 0, fmt.Errorf("node %d has no address", member.ID)
+		}
+		set[member.ID] = true
+	}
+
+	next := make([]int64, 0, len(set))
+	for id := range set {
+		next = append(next, id)
+	}
+	sort.Slice(next, func(i, j int) bool { return next[i] < next[j] })
+
+	f := r.FaultyNodesNum
+	if f == 0 {
+		f = (int64(len(next)) - 1) / 3
+	}
+	if f < 0 || int64(len(next)) < 3*f+1 {
+		return nil, 0, fmt.Errorf("%d nodes cannot tolerate %d faulty nodes", len(next), f)
+	}
+	return next, f, nil
+}
+
+// Install makes the replica set of this process the given one
+func (r *Reconfiguration) Install(members []int64) {
+	for _, member := range r.Add {
+		if member.Addr != "" {
+			config.AddNodeAddr(member.ID, member.Addr)
+		}
+	}
+	config.SetMembers(members)
+}
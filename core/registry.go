@@ -0,0 +1,93 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+)
+
+// --------------------------------------------------------
+// Message Type Registry
+// --------------------------------------------------------
+
+// MessageID is the numeric type tag written in front of every message on the wire
+type MessageID uint8
+
+// Role tells whether the From or To id of a message names a replica or a client
+type Role uint8
+
+const (
+	RoleNode Role = iota
+	RoleClient
+)
+
+func (r Role) String() string {
+	if r == RoleClient {
+		return "client"
+	}
+	return "node"
+}
+
+type MessageType struct {
+	ID   MessageID
+	Name string
+	From Role
+	To   Role
+	// New returns a pointer to a zero value the wire format decodes into
+	New func() interface{}
+}
+
+var (
+	messageTypesByID   = make(map[MessageID]*MessageType)
+	messageTypesByName = make(map[string]*MessageType)
+	registryLock       sync.RWMutex
+)
+
+// RegisterMessage makes a message type known to every wire format. Adding a
+// new protocol message only needs a struct, a name and a call to RegisterMessage.
+func RegisterMessage(id MessageID, name string, from Role, to Role, newFn func() interface{}) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if existing, ok := messageTypesByID[id]; ok {
+		panic(fmt.Sprintf("message id %d registered twice (%s and %s)", id, existing.Name, name))
+	}
+	if _, ok := messageTypesByName[name]; ok {
+		panic(fmt.Sprintf("message type %s registered twice", name))
+	}
+	messageType := &MessageType{
+		ID:   id,
+		Name: name,
+		From: from,
+		To:   to,
+		New:  newFn,
+	}
+	messageTypesByID[id] = messageType
+	messageTypesByName[name] = messageType
+}
+
+func LookupMessageByID(id MessageID) (*MessageType, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	messageType, ok := messageTypesByID[id]
+	return messageType, ok
+}
+
+func LookupMessageByName(name string) (*MessageType, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	messageType, ok := messageTypesByName[name]
+	return messageType, ok
+}
+
+func init() {
+	RegisterMessage(1, MsgRequestMessage, RoleClient, RoleNode, func() interface{} { return &RequestMessage{} })
+	RegisterMessage(2, MsgPreprepareMessage, RoleNode, RoleNode, func() interface{} { return &PreprepareMessage{} })
+	RegisterMessage(3, MsgPrepareMessage, RoleNode, RoleNode, func() interface{} { return &PrepareMessage{} })
+	RegisterMessage(4, MsgCommitMessage, RoleNode, RoleNode, func() interface{} { return &CommitMessage{} })
+	RegisterMessage(5, MsgReplyMessage, RoleNode, RoleClient, func() interface{} { return &ReplyMessage{} })
+	RegisterMessage(6, MsgCloseMessage, RoleClient, RoleNode, func() interface{} { return &CloseMessage{} })
+	RegisterMessage(7, MsgViewChangeMessage, RoleNode, RoleNode, func() interface{} { return &ViewChangeMessage{} })
+	RegisterMessage(8, MsgCheckpointMessage, RoleNode, RoleNode, func() interface{} { return &CheckpointMessage{} })
+	RegisterMessage(9, MsgStateRequestMessage, RoleNode, RoleNode, func() interface{} { return &StateRequestMessage{} })
+	RegisterMessage(10, MsgStateResponseMessage, RoleNode, RoleNode, func() interface{} { return &StateResponseMessage{} })
+	RegisterMessage(11, MsgHandoffMessage, RoleNode, RoleNode, func() interface{} { return &HandoffMessage{} })
+}
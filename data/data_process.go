@@ -9,14 +9,11 @@ import (
 	"github.com/michael112233/pbft/logger"
 )
 
-const (
-	DataDir = "data/len3_data.csv"
-)
-
 var log = logger.NewLogger(0, "data")
 
-func ReadData(maxTxNum int64) []*core.Transaction {
-	csvFile, err := os.Open(DataDir)
+// ReadData reads at most maxTxNum transactions from the csv file at path
+func ReadData(path string, maxTxNum int64) []*core.Transaction {
+	csvFile, err := os.Open(path)
 	if err != nil {
 		log.Error("failed to open csv file: %v", err)
 		return nil
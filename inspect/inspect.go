@@ -0,0 +1,255 @@
+package inspect
+
+import (
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"sort"
+
+	"github.com/michael112233/pbft/core"
+	"github.com/michael112233/pbft/ledger"
+)
+
+// --------------------------------------------------------
+// Filter Definition
+// --------------------------------------------------------
+
+const (
+	ShowBlocks      string = "blocks"
+	ShowTxs         string = "txs"
+	ShowCheckpoints string = "checkpoints"
+	ShowViews       string = "views"
+	ShowBalances    string = "balances"
+)
+
+// Shows lists the views of a ledger Inspect understands
+var Shows = []string{ShowBlocks, ShowTxs, ShowCheckpoints, ShowViews, ShowBalances}
+
+// Filter selects the records of a ledger, a negative bound or view and an
+// empty account select everything
+type Filter struct {
+	FromSeq int64
+	ToSeq   int64
+	View    int64
+	Account string
+}
+
+func NoFilter() Filter {
+	return Filter{FromSeq: -1, ToSeq: -1, View: -1}
+}
+
+func (f Filter) inRange(seq int64) bool {
+	return (f.FromSeq < 0 || seq >= f.FromSeq) && (f.ToSeq < 0 || seq <= f.ToSeq)
+}
+
+func (f Filter) matches(record ledger.Record) bool {
+	return f.inRange(record.Seq) && (f.View < 0 || record.View == f.View)
+}
+
+func (f Filter) touches(tx *core.Transaction) bool {
+	return f.Account == "" || tx.Sender == f.Account || tx.Receiver == f.Account
+}
+
+// Load reads the ledger replica nodeID wrote into dir
+func Load(dir string, nodeID int64) ([]ledger.Record, error) {
+	return ledger.ReadFile(filepath.Join(dir, ledger.NodeName(nodeID)+".jsonl"))
+}
+
+// --------------------------------------------------------
+// Views of a Ledger
+// --------------------------------------------------------
+
+type Block struct {
+	Seq       int64  `json:"seq"`
+	View      int64  `json:"view"`
+	Digest    string `json:"digest"`
+	RequestID int64  `json:"request_id"`
+	TxNum     int    `json:"tx_num"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type Tx struct {
+	Seq      int64    `json:"seq"`
+	Index    int      `json:"index"`
+	Sender   string   `json:"sender"`
+	Receiver string   `json:"receiver"`
+	Amount   *big.Int `json:"amount"`
+}
+
+type Checkpoint struct {
+	Seq       int64  `json:"seq"`
+	View      int64  `json:"view"`
+	Digest    string `json:"digest"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// ViewSpan is the run of blocks a replica committed in one view, followed by
+// the replica set once a reconfiguration took effect in it
+type ViewSpan struct {
+	View        int64   `json:"view"`
+	FirstSeq    int64   `json:"first_seq"`
+	LastSeq     int64   `json:"last_seq"`
+	Blocks      int     `json:"blocks"`
+	Members     []int64 `json:"members,omitempty"`
+	FaultyNodes int64   `json:"faulty_nodes,omitempty"`
+}
+
+type Balance struct {
+	Account  string   `json:"account"`
+	Balance  *big.Int `json:"balance"`
+	Sent     int      `json:"sent"`
+	Received int      `json:"received"`
+}
+
+func Blocks(records []ledger.Record, f Filter) []Block {
+	blocks := make([]Block, 0)
+	for _, record := range records {
+		if record.Kind != ledger.KindCommit || !f.matches(record) {
+			continue
+		}
+		if f.Account != "" && !touchesAny(record.Txs, f) {
+			continue
+		}
+		blocks = append(blocks, Block{
+			Seq:       record.Seq,
+			View:      record.View,
+			Digest:    record.Digest,
+			RequestID: record.RequestID,
+			TxNum:     len(record.Txs),
+			Timestamp: record.Timestamp,
+		})
+	}
+	return blocks
+}
+
+func touchesAny(txs []*core.Transaction, f Filter) bool {
+	for _, tx := range txs {
+		if f.touches(tx) {
+			return true
+		}
+	}
+	return false
+}
+
+func Txs(records []ledger.Record, f Filter) []Tx {
+	txs := make([]Tx, 0)
+	for _, record := range records {
+		if record.Kind != ledger.KindCommit || !f.matches(record) {
+			continue
+		}
+		for i, tx := range record.Txs {
+			if !f.touches(tx) {
+				continue
+			}
+			txs = append(txs, Tx{
+				Seq:      record.Seq,
+				Index:    i,
+				Sender:   tx.Sender,
+				Receiver: tx.Receiver,
+				Amount:   tx.Amount,
+			})
+		}
+	}
+	return txs
+}
+
+func Checkpoints(records []ledger.Record, f Filter) []Checkpoint {
+	checkpoints := make([]Checkpoint, 0)
+	for _, record := range records {
+		if record.Kind != ledger.KindCheckpoint || !f.matches(record) {
+			continue
+		}
+		checkpoints = append(checkpoints, Checkpoint{
+			Seq:       record.Seq,
+			View:      record.View,
+			Digest:    record.Digest,
+			Timestamp: record.Timestamp,
+		})
+	}
+	return checkpoints
+}
+
+// Views groups the commits by view in ledger order, a view the replica
+// returns to starts a new span
+func Views(records []ledger.Record, f Filter) []ViewSpan {
+	spans := make([]ViewSpan, 0)
+	for _, record := range records {
+		if !f.matches(record) {
+			continue
+		}
+		switch record.Kind {
+		case ledger.KindCommit:
+			if len(spans) == 0 || spans[len(spans)-1].View != record.View {
+				spans = append(spans, ViewSpan{View: record.View, FirstSeq: record.Seq})
+			}
+			span := &spans[len(spans)-1]
+			span.LastSeq = record.Seq
+			span.Blocks++
+		case ledger.KindReconfig:
+			if len(spans) == 0 {
+				spans = append(spans, ViewSpan{View: record.View, FirstSeq: record.Seq, LastSeq: record.Seq})
+			}
+			spans[len(spans)-1].Members = record.Members
+			spans[len(spans)-1].FaultyNodes = record.FaultyNodes
+		}
+	}
+	return spans
+}
+
+// Balances replays the transactions committed up to f.ToSeq on accounts
+// starting with the balance of core.NewAccount. The view and the lower bound
+// of f do not apply, a balance depends on every earlier block.
+func Balances(records []ledger.Record, f Filter) []Balance {
+	accounts := make(map[string]*Balance)
+	accountOf := func(name string) *Balance {
+		if accounts[name] == nil {
+			accounts[name] = &Balance{Account: name, Balance: core.NewAccount().GetBalance()}
+		}
+		return accounts[name]
+	}
+	for _, record := range records {
+		if record.Kind != ledger.KindCommit || (f.ToSeq >= 0 && record.Seq > f.ToSeq) {
+			continue
+		}
+		for _, tx := range record.Txs {
+			sender, receiver := accountOf(tx.Sender), accountOf(tx.Receiver)
+			if tx.Amount != nil {
+				sender.Balance.Sub(sender.Balance, tx.Amount)
+				receiver.Balance.Add(receiver.Balance, tx.Amount)
+			}
+			sender.Sent++
+			receiver.Received++
+		}
+	}
+
+	balances := make([]Balance, 0, len(accounts))
+	for name, balance := range accounts {
+		if f.Account == "" || name == f.Account {
+			balances = append(balances, *balance)
+		}
+	}
+	sort.Slice(balances, func(i, j int) bool { return balances[i].Account < balances[j].Account })
+	return balances
+}
+
+// --------------------------------------------------------
+// Inspect
+// --------------------------------------------------------
+
+// Inspect returns the view show of records, a slice of Block, Tx,
+// Checkpoint, ViewSpan or Balance
+func Inspect(records []ledger.Record, show string, f Filter) (interface{}, error) {
+	switch show {
+	case ShowBlocks:
+		return Blocks(records, f), nil
+	case ShowTxs:
+		return Txs(records, f), nil
+	case ShowCheckpoints:
+		return Checkpoints(records, f), nil
+	case ShowViews:
+		return Views(records, f), nil
+	case ShowBalances:
+		return Balances(records, f), nil
+	}
+	return nil, fmt.Errorf("unknown view %q, want one of %v", show, Shows)
+}
@@ -0,0 +1,63 @@
+package inspect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// --------------------------------------------------------
+// Output
+// --------------------------------------------------------
+
+// WriteJSON writes the result of Inspect as an indented JSON array
+func WriteJSON(w io.Writer, result interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
+
+// WriteText writes the result of Inspect as a table
+func WriteText(w io.Writer, result interface{}) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	switch rows := result.(type) {
+	case []Block:
+		fmt.Fprintln(tw, "SEQ\tVIEW\tREQUEST\tTXS\tTIME\tDIGEST")
+		for _, b := range rows {
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%s\t%s\n", b.Seq, b.View, b.RequestID, b.TxNum, timeOf(b.Timestamp), b.Digest)
+		}
+	case []Tx:
+		fmt.Fprintln(tw, "SEQ\tINDEX\tSENDER\tRECEIVER\tAMOUNT")
+		for _, tx := range rows {
+			fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\n", tx.Seq, tx.Index, tx.Sender, tx.Receiver, tx.Amount)
+		}
+	case []Checkpoint:
+		fmt.Fprintln(tw, "SEQ\tVIEW\tTIME\tDIGEST")
+		for _, c := range rows {
+			fmt.Fprintf(tw, "%d\t%d\t%s\t%s\n", c.Seq, c.View, timeOf(c.Timestamp), c.Digest)
+		}
+	case []ViewSpan:
+		fmt.Fprintln(tw, "VIEW\tFIRST SEQ\tLAST SEQ\tBLOCKS\tMEMBERS")
+		for _, v := range rows {
+			members := "-"
+			if len(v.Members) > 0 {
+				members = fmt.Sprintf("%v f=%d", v.Members, v.FaultyNodes)
+			}
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%s\n", v.View, v.FirstSeq, v.LastSeq, v.Blocks, members)
+		}
+	case []Balance:
+		fmt.Fprintln(tw, "ACCOUNT\tBALANCE\tSENT\tRECEIVED")
+		for _, b := range rows {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", b.Account, b.Balance, b.Sent, b.Received)
+		}
+	default:
+		return fmt.Errorf("cannot print %T", result)
+	}
+	return tw.Flush()
+}
+
+func timeOf(unix int64) string {
+	return time.Unix(unix, 0).Format("2006-01-02 15:04:05")
+}
@@ -1,33 +1,87 @@
 package leader_election
 
 import (
-	"os"
+	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/michael112233/pbft/config"
-	"github.com/michael112233/pbft/logger"
 )
 
-var log = logger.NewLogger(0, "leader_election")
+// --------------------------------------------------------
+// Election Strategy
+// --------------------------------------------------------
 
-type LeaderElection struct {
-	method  string
-	nodeNum int64
+// Strategy picks the primary of a view. It must be deterministic: every
+// replica and the client call it with the same view and replica set and must
+// get the same id. members is never empty and sorted ascending.
+type Strategy interface {
+	Leader(viewId int64, members []int64) int64
 }
 
-func NewLeaderElection(config *config.Config) *LeaderElection {
-	return &LeaderElection{
-		method:  config.ElectionMethod,
-		nodeNum: config.NodeNum,
+var (
+	strategies    = make(map[string]Strategy)
+	strategiesMux sync.RWMutex
+)
+
+// Register makes a strategy available as election_method name
+func Register(name string, strategy Strategy) {
+	strategiesMux.Lock()
+	defer strategiesMux.Unlock()
+	strategies[name] = strategy
+}
+
+func GetStrategy(name string) (Strategy, error) {
+	strategiesMux.RLock()
+	defer strategiesMux.RUnlock()
+	strategy, ok := strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown election method %q, available: %v", name, methods())
 	}
+	return strategy, nil
+}
+
+func methods() []string {
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	Register("round_robin", RoundRobin{})
+	Register("weighted", Weighted{})
+}
+
+// --------------------------------------------------------
+// Leader Election
+// --------------------------------------------------------
+
+type LeaderElection struct {
+	method   string
+	strategy Strategy
 }
 
-func (l *LeaderElection) GetLeader(viewId int64) string {
-	switch l.method {
-	case "round_robin":
-		return l.GetFromRoundRobin(viewId)
-	default:
-		log.Error("invalid election method: %s", l.method)
-		os.Exit(1)
-		return ""
+func NewLeaderElection(config *config.Config) (*LeaderElection, error) {
+	strategy, err := GetStrategy(config.ElectionMethod)
+	if err != nil {
+		return nil, fmt.Errorf("invalid election method: %w", err)
 	}
+	return &LeaderElection{
+		method:   config.ElectionMethod,
+		strategy: strategy,
+	}, nil
+}
+
+// GetLeader returns the primary of a view among the current replica set
+func (l *LeaderElection) GetLeader(viewId int64) int64 {
+	return l.LeaderOf(viewId, config.Members())
+}
+
+// LeaderOf returns the primary of a view among the given replica set, which
+// lets a reconfiguration check its effect on the primary before installing it.
+func (l *LeaderElection) LeaderOf(viewId int64, members []int64) int64 {
+	return l.strategy.Leader(viewId, members)
 }
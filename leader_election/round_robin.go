@@ -1,7 +1,12 @@
 package leader_election
 
-import "github.com/michael112233/pbft/config"
+// RoundRobin lets every member lead in turn
+type RoundRobin struct{}
 
-func (l *LeaderElection) GetFromRoundRobin(viewId int64) string {
-	return config.NodeAddr[int(viewId%l.nodeNum)]
+func (RoundRobin) Leader(viewId int64, members []int64) int64 {
+	return GetFromRoundRobin(viewId, members)
+}
+
+func GetFromRoundRobin(viewId int64, members []int64) int64 {
+	return members[viewId%int64(len(members))]
 }
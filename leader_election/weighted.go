@@ -0,0 +1,22 @@
+package leader_election
+
+import "github.com/michael112233/pbft/config"
+
+// Weighted is round robin where every member leads as many views in a row as
+// its weight in the topology, members without a weight count 1.
+type Weighted struct{}
+
+func (Weighted) Leader(viewId int64, members []int64) int64 {
+	total := int64(0)
+	for _, member := range members {
+		total += config.WeightOf(member)
+	}
+	slot := viewId % total
+	for _, member := range members {
+		slot -= config.WeightOf(member)
+		if slot < 0 {
+			return member
+		}
+	}
+	return members[len(members)-1]
+}
@@ -0,0 +1,203 @@
+package ledger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/michael112233/pbft/core"
+)
+
+// --------------------------------------------------------
+// Record Definition
+// --------------------------------------------------------
+
+const (
+	KindCommit     string = "commit"
+	KindCheckpoint string = "checkpoint"
+	KindAccept     string = "accept"
+	KindReconfig   string = "reconfig"
+)
+
+const (
+	clientName = "client"
+	nodePrefix = "node_"
+	fileSuffix = ".jsonl"
+)
+
+// Record is one line of a committed history file. Replicas write commit,
+// checkpoint and reconfig records in execution order; the client writes accept
+// records once f+1 matching replies have been received for a sequence number.
+// A reconfig record lists the replica set in effect after its sequence number.
+type Record struct {
+	Kind      string              `json:"kind"`
+	Seq       int64               `json:"seq"`
+	View      int64               `json:"view"`
+	Digest    string              `json:"digest,omitempty"`
+	RequestID int64               `json:"request_id"`
+	Txs       []*core.Transaction `json:"txs,omitempty"`
+	Timestamp int64               `json:"timestamp"`
+
+	Members     []int64 `json:"members,omitempty"`
+	FaultyNodes int64   `json:"faulty_nodes,omitempty"`
+}
+
+// History is the set of ledgers found in one output directory.
+type History struct {
+	Replicas map[int64][]Record
+	Client   []Record
+}
+
+// ReplicaIDs returns the replica ids of the history in ascending order.
+func (h *History) ReplicaIDs() []int64 {
+	ids := make([]int64, 0, len(h.Replicas))
+	for id := range h.Replicas {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// --------------------------------------------------------
+// Writer
+// --------------------------------------------------------
+
+type Writer struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewWriter truncates and opens <dir>/<name>.jsonl for appending records.
+func NewWriter(dir string, name string) (*Writer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, name+fileSuffix), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		file: file,
+		enc:  json.NewEncoder(file),
+	}, nil
+}
+
+// NodeName returns the ledger name used by replica nodeID.
+func NodeName(nodeID int64) string {
+	return fmt.Sprintf("%s%d", nodePrefix, nodeID)
+}
+
+// ClientName returns the ledger name used by the client.
+func ClientName() string {
+	return clientName
+}
+
+// Append writes a record. A nil writer silently drops the record so that a
+// replica whose ledger could not be opened keeps running.
+func (w *Writer) Append(record Record) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	return w.enc.Encode(&record)
+}
+
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	// the ledger is the record of what was committed, it has to survive the process
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	return err
+}
+
+// --------------------------------------------------------
+// Reader
+// --------------------------------------------------------
+
+// ReadFile reads every record of a single ledger file.
+func ReadFile(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := make([]Record, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 256*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// ReadDir loads node_<id>.jsonl and client.jsonl from dir.
+func ReadDir(dir string) (*History, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	history := &History{
+		Replicas: make(map[int64][]Record),
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		switch {
+		case name == clientName+fileSuffix:
+			history.Client, err = ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(name, nodePrefix):
+			id, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, nodePrefix), fileSuffix), 10, 64)
+			if err != nil {
+				continue
+			}
+			history.Replicas[id], err = ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(history.Replicas) == 0 {
+		return nil, fmt.Errorf("no replica ledger found in %s", dir)
+	}
+	return history, nil
+}
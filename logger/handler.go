@@ -0,0 +1,80 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// textHandler keeps the classic "[INFO] 2006/01/02 15:04:05 message" lines
+// and appends the fields of the record as key=value.
+type textHandler struct {
+	w        io.Writer
+	level    slog.Leveler
+	withRole bool
+	mu       *sync.Mutex
+}
+
+func (h *textHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "[%s] %s %s", levelName(r.Level), r.Time.Format("2006/01/02 15:04:05"), strings.TrimRight(r.Message, "\n"))
+	r.Attrs(func(a slog.Attr) bool {
+		// a log file already belongs to one role and node
+		if !h.withRole && (a.Key == "role" || a.Key == "node") {
+			return true
+		}
+		value := a.Value.String()
+		if strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&buf, " %s=%s", a.Key, value)
+		return true
+	})
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+// jsonHandler remembers its writer so Configure can close it
+type jsonHandler struct {
+	*slog.JSONHandler
+	w io.Writer
+}
+
+func replaceLevel(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if l, ok := a.Value.Any().(slog.Level); ok {
+			return slog.String(slog.LevelKey, levelName(l))
+		}
+	}
+	return a
+}
+
+func handlerWriter(handler slog.Handler) io.Writer {
+	switch h := handler.(type) {
+	case *textHandler:
+		return h.w
+	case *jsonHandler:
+		return h.w
+	}
+	return nil
+}
@@ -1,86 +1,233 @@
 package logger
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
+// LevelTest sits between info and warn, it is used by the Test method
+const LevelTest = slog.Level(2)
+
+// Options selects where and how every logger of the process writes
+type Options struct {
+	Level  string
+	Format string // text or json
+	Output string // file or stderr
+	Dir    string
+	// MaxSize in megabytes after which a log file is rotated, 0 disables rotation
+	MaxSize    int64
+	MaxBackups int
+}
+
+// DefaultOptions are used until Configure is called
+func DefaultOptions() Options {
+	return Options{
+		Level:      "info",
+		Format:     "text",
+		Output:     "file",
+		Dir:        "logs",
+		MaxSize:    100,
+		MaxBackups: 3,
+	}
+}
+
+var (
+	options = DefaultOptions()
+	level   = new(slog.LevelVar)
+	// log file path -> handler writing into it
+	handlers    = make(map[string]slog.Handler)
+	handlerLock sync.Mutex
+)
+
+// Configure applies opts to every logger, including the ones created before
+func Configure(opts Options) error {
+	parsed, err := ParseLevel(opts.Level)
+	if err != nil {
+		return err
+	}
+	handlerLock.Lock()
+	defer handlerLock.Unlock()
+	for _, handler := range handlers {
+		if closer, ok := handlerWriter(handler).(*rotatingFile); ok {
+			closer.Close()
+		}
+	}
+	handlers = make(map[string]slog.Handler)
+	options = opts
+	level.Set(parsed)
+	return nil
+}
+
+// SetLevel changes the minimum level of every logger at runtime
+func SetLevel(l slog.Level) {
+	level.Set(l)
+}
+
+func GetLevel() slog.Level {
+	return level.Level()
+}
+
+// ConfiguredLevel returns the level given to Configure
+func ConfiguredLevel() slog.Level {
+	handlerLock.Lock()
+	defer handlerLock.Unlock()
+	parsed, _ := ParseLevel(options.Level)
+	return parsed
+}
+
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "test":
+		return LevelTest, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected debug, info, test, warn or error", s)
+}
+
+func levelName(l slog.Level) string {
+	if l == LevelTest {
+		return "TEST"
+	}
+	return l.String()
+}
+
+// --------------------------------------------------------
+// Logger
+// --------------------------------------------------------
+
 type Logger struct {
-	infoLogger  *log.Logger
-	debugLogger *log.Logger
-	warnLogger  *log.Logger
-	errorLogger *log.Logger
-	testLogger  *log.Logger
+	role   string
+	nodeID int64
+	attrs  []slog.Attr
 }
 
 // Init 初始化日志系统，为每个节点创建日志文件
 func NewLogger(nodeID int64, role string) *Logger {
-	// 创建logs目录
-	os.MkdirAll("logs", 0755)
-	logFile := ""
+	return &Logger{role: role, nodeID: nodeID}
+}
+
+// With returns a logger adding the key/value pairs to every record, e.g.
+// log.With("seq", seq, "view", view)
+func (l *Logger) With(args ...interface{}) *Logger {
+	record := slog.Record{}
+	record.Add(args...)
+	attrs := append([]slog.Attr(nil), l.attrs...)
+	record.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return &Logger{role: l.role, nodeID: l.nodeID, attrs: attrs}
+}
+
+// Enabled reports whether records of lvl are written, so callers can skip expensive formatting
+func (l *Logger) Enabled(lvl slog.Level) bool {
+	return lvl >= level.Level()
+}
 
-	// 生成日志文件名
-	switch role {
+// 生成日志文件名
+func (l *Logger) fileName() string {
+	switch l.role {
 	case "node":
-		logFile = fmt.Sprintf("logs/node_%d.log", nodeID)
+		return fmt.Sprintf("node_%d.log", l.nodeID)
 	case "client":
-		logFile = "logs/client.log"
+		return "client.log"
 	case "blockchain":
-		logFile = "logs/blockchain.log"
+		return "blockchain.log"
 	case "result":
-		logFile = "logs/result.log"
+		return "result.log"
 	default:
-		logFile = "logs/others.log"
+		return "others.log"
 	}
+}
 
-	// 打开日志文件
-	file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatal("Failed to open log file:", err)
+func (l *Logger) handler() slog.Handler {
+	handlerLock.Lock()
+	defer handlerLock.Unlock()
+	path := "-"
+	if options.Output != "stderr" {
+		path = filepath.Join(options.Dir, l.fileName())
 	}
+	if handler, ok := handlers[path]; ok {
+		return handler
+	}
+
+	handler := newHandler(path)
+	handlers[path] = handler
+	return handler
+}
 
-	l := &Logger{
-		infoLogger:  log.New(file, "[INFO] ", log.LstdFlags),
-		debugLogger: log.New(file, "[DEBUG] ", log.LstdFlags),
-		warnLogger:  log.New(file, "[WARN] ", log.LstdFlags),
-		errorLogger: log.New(file, "[ERROR] ", log.LstdFlags),
-		testLogger:  log.New(file, "[TEST] ", log.LstdFlags),
+func newHandler(path string) slog.Handler {
+	var w io.Writer = os.Stderr
+	if path != "-" {
+		file, err := openRotatingFile(path, options.MaxSize*1024*1024, options.MaxBackups)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open log file %s, logging to stderr: %v\n", path, err)
+		} else {
+			w = file
+		}
 	}
-	return l
+	if options.Format == "json" {
+		return &jsonHandler{JSONHandler: slog.NewJSONHandler(w, &slog.HandlerOptions{
+			Level:       level,
+			ReplaceAttr: replaceLevel,
+		}), w: w}
+	}
+	// lines of different roles only share a stream on stderr
+	return &textHandler{w: w, level: level, withRole: path == "-", mu: &sync.Mutex{}}
+}
+
+func (l *Logger) log(lvl slog.Level, format string, args ...interface{}) {
+	if !l.Enabled(lvl) {
+		return
+	}
+	msg := format
+	if len(args) > 0 {
+		msg = fmt.Sprintf(format, args...)
+	}
+	record := slog.NewRecord(time.Now(), lvl, msg, 0)
+	record.AddAttrs(slog.String("role", l.role))
+	if l.role == "node" {
+		record.AddAttrs(slog.Int64("node", l.nodeID))
+	}
+	record.AddAttrs(l.attrs...)
+	l.handler().Handle(context.Background(), record)
 }
 
 // Info 记录信息日志
 func (l *Logger) Info(format string, args ...interface{}) {
-	if l.infoLogger != nil {
-		l.infoLogger.Printf(format, args...)
-	}
+	l.log(slog.LevelInfo, format, args...)
 }
 
 // Debug 记录调试日志
 func (l *Logger) Debug(format string, args ...interface{}) {
-	if l.debugLogger != nil {
-		l.debugLogger.Printf(format, args...)
-	}
+	l.log(slog.LevelDebug, format, args...)
 }
 
 // Warn 记录警告日志
 func (l *Logger) Warn(format string, args ...interface{}) {
-	if l.warnLogger != nil {
-		l.warnLogger.Printf(format, args...)
-	}
+	l.log(slog.LevelWarn, format, args...)
 }
 
 // Error 记录错误日志
 func (l *Logger) Error(format string, args ...interface{}) {
-	if l.errorLogger != nil {
-		l.errorLogger.Printf(format, args...)
-	}
+	l.log(slog.LevelError, format, args...)
 }
 
 // Test 记录测试日志
 func (l *Logger) Test(format string, args ...interface{}) {
-	if l.testLogger != nil {
-		l.testLogger.Printf(format, args...)
-	}
+	l.log(LevelTest, format, args...)
 }
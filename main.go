@@ -1,25 +1,12 @@
 package main
 
 import (
-	"github.com/michael112233/pbft/controller"
-	"github.com/spf13/pflag"
-)
+	"os"
 
-const (
-	cfgPath = "config/run.json"
+	"github.com/michael112233/pbft/controller"
 )
 
-type Args struct {
-	Role    string
-	Mode    string
-	NodeNum int64
-}
-
-var role = pflag.StringP("role", "r", "node", "role type (node or client)")
-var mode = pflag.StringP("mode", "m", "local", "mode (local or remote)")
-var nodeID = pflag.Int64P("node-id", "n", 0, "node id, if role is client, no need to input")
-
+// pbft_main <command> [flags], see controller/cli.go for the commands
 func main() {
-	pflag.Parse()
-	controller.Main(*nodeID, *role, *mode, cfgPath)
+	controller.Main(os.Args[1:])
 }
@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/michael112233/pbft/result"
+)
+
+// --------------------------------------------------------
+// Registry
+// --------------------------------------------------------
+
+// Family is a named metric whose samples differ by their labels. Labels are
+// given as key/value pairs, e.g. Inc("type", "MsgPrepareMessage").
+type Family struct {
+	name    string
+	help    string
+	kind    string
+	samples map[string]*atomic.Int64
+	collect func() []Sample
+	lock    sync.Mutex
+}
+
+// Sample is one value of a family computed at scrape time
+type Sample struct {
+	Labels []string
+	Value  int64
+}
+
+var (
+	families     = make(map[string]*Family)
+	familiesLock sync.Mutex
+)
+
+func register(name, help, kind string, collect func() []Sample) *Family {
+	familiesLock.Lock()
+	defer familiesLock.Unlock()
+	if f, ok := families[name]; ok {
+		return f
+	}
+	f := &Family{name: name, help: help, kind: kind, samples: make(map[string]*atomic.Int64), collect: collect}
+	families[name] = f
+	return f
+}
+
+// Counter returns the counter family called name, registering it on first use
+func Counter(name, help string) *Family {
+	return register(name, help, "counter", nil)
+}
+
+// Gauge returns the gauge family called name, registering it on first use
+func Gauge(name, help string) *Family {
+	return register(name, help, "gauge", nil)
+}
+
+// CounterFunc registers a counter family whose samples are read from collect on every scrape
+func CounterFunc(name, help string, collect func() []Sample) {
+	register(name, help, "counter", collect)
+}
+
+// GaugeFunc registers a gauge family whose samples are read from collect on every scrape
+func GaugeFunc(name, help string, collect func() []Sample) {
+	register(name, help, "gauge", collect)
+}
+
+func (f *Family) value(labels []string) *atomic.Int64 {
+	key := formatLabels(labels)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.samples[key] == nil {
+		f.samples[key] = new(atomic.Int64)
+	}
+	return f.samples[key]
+}
+
+func (f *Family) Add(delta int64, labels ...string) {
+	f.value(labels).Add(delta)
+}
+
+func (f *Family) Inc(labels ...string) {
+	f.value(labels).Add(1)
+}
+
+func (f *Family) Set(v int64, labels ...string) {
+	f.value(labels).Store(v)
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// --------------------------------------------------------
+// Text Exposition
+// --------------------------------------------------------
+
+// Write prints every family and the latency histograms of the result package
+// in the Prometheus text format
+func Write(w io.Writer) {
+	familiesLock.Lock()
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	familiesLock.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		familiesLock.Lock()
+		f := families[name]
+		familiesLock.Unlock()
+		f.write(w)
+	}
+	for _, s := range result.Snapshots() {
+		writeHistogram(w, s)
+	}
+}
+
+func (f *Family) write(w io.Writer) {
+	lines := make(map[string]int64)
+	if f.collect != nil {
+		for _, sample := range f.collect() {
+			lines[formatLabels(sample.Labels)] = sample.Value
+		}
+	} else {
+		f.lock.Lock()
+		for labels, v := range f.samples {
+			lines[labels] = v.Load()
+		}
+		f.lock.Unlock()
+	}
+	// families of the other role are linked into every binary but never touched
+	if len(lines) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(lines))
+	for labels := range lines {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	for _, labels := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", f.name, labels, lines[labels])
+	}
+}
+
+// writeHistogram exposes a result histogram in seconds with cumulative buckets
+func writeHistogram(w io.Writer, s result.HistogramSnapshot) {
+	name := fmt.Sprintf("pbft_%s_seconds", s.Name)
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.ReplaceAll(s.Name, "_", " "))
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	cumulative := 0
+	for _, bucket := range s.Buckets {
+		cumulative += bucket.Count
+		le := "+Inf"
+		if bucket.UpperBound != math.MaxInt64 {
+			le = fmt.Sprint(bucket.UpperBound.Seconds())
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum %g\n", name, s.Sum.Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, s.Count)
+}
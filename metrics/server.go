@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/michael112233/pbft/logger"
+)
+
+// Server serves /metrics over plain HTTP
+type Server struct {
+	server *http.Server
+	log    *logger.Logger
+}
+
+// Serve starts listening on addr in the background
+func Serve(addr string, log *logger.Logger) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+	s := &Server{server: &http.Server{Handler: mux}, log: log}
+	go func() {
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Error("metrics server stopped: %v", err)
+		}
+	}()
+	log.Info("serving metrics on http://%s/metrics", ln.Addr())
+	return s, nil
+}
+
+// Close stops the server, a nil server is ignored so callers need not check
+// whether metrics are enabled
+func (s *Server) Close() {
+	if s == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.server.Shutdown(ctx)
+}
@@ -0,0 +1,384 @@
+package network
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michael112233/pbft/logger"
+)
+
+const (
+	defaultQueueSize  = 1024
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Second
+	dialTimeout       = 3 * time.Second
+	flushTimeout      = 5 * time.Second
+	// blockRecheck is how often a blocked sender checks whether its peer
+	// became unreachable
+	blockRecheck = 100 * time.Millisecond
+)
+
+// Dialer opens an outbound connection, plain TCP unless SetDialer installs another one.
+type Dialer func(addr string) (net.Conn, error)
+
+// ConnManager keeps one persistent outbound connection per peer. Every peer
+// owns a FIFO queue drained by its own writer goroutine, which (re)dials the
+// peer with exponential backoff whenever the connection is missing or broken.
+type ConnManager struct {
+	mu      sync.Mutex
+	peers   map[string]*peer
+	closed  bool
+	wg      sync.WaitGroup
+	pending atomic.Int64
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	queueSize  int
+	policy     OverflowPolicy
+	dial       Dialer
+
+	log *logger.Logger
+}
+
+type peer struct {
+	addr     string
+	queue    chan []byte
+	exitChan chan struct{}
+
+	connLock sync.Mutex
+	conn     net.Conn
+
+	sent     atomic.Int64
+	dropped  atomic.Int64
+	maxDepth atomic.Int64
+	// pending counts the queued messages and the one being written,
+	// unreachable is set while the last dial failed
+	pending     atomic.Int64
+	unreachable atomic.Bool
+}
+
+func NewConnManager(log *logger.Logger, queue QueueConfig) *ConnManager {
+	if queue.Size <= 0 {
+		queue.Size = defaultQueueSize
+	}
+	if queue.Policy == "" {
+		queue.Policy = PolicyDropOldest
+	}
+	cm := &ConnManager{
+		peers:      make(map[string]*peer),
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+		queueSize:  queue.Size,
+		policy:     queue.Policy,
+		dial: func(addr string) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, dialTimeout)
+		},
+		log: log,
+	}
+	registerQueueMetrics(cm)
+	return cm
+}
+
+// SetDialer replaces the dialer used for new connections, e.g. by a TLS dialer.
+func (cm *ConnManager) SetDialer(dial Dialer) {
+	cm.mu.Lock()
+	cm.dial = dial
+	cm.mu.Unlock()
+}
+
+// Send enqueues an already packed message for addr. The writer goroutine of
+// the peer is created on first use. When the queue of the peer is full the
+// configured overflow policy applies, so only PolicyBlock can stall the caller,
+// and only while the peer is reachable.
+func (cm *ConnManager) Send(addr string, msg []byte) {
+	cm.mu.Lock()
+	if cm.closed {
+		cm.mu.Unlock()
+		return
+	}
+	p, ok := cm.peers[addr]
+	if !ok {
+		p = &peer{
+			addr:     addr,
+			queue:    make(chan []byte, cm.queueSize),
+			exitChan: make(chan struct{}),
+		}
+		cm.peers[addr] = p
+		cm.wg.Add(1)
+		go cm.writeLoop(p)
+	}
+	cm.mu.Unlock()
+
+	cm.count(p, 1)
+	switch cm.policy {
+	case PolicyBlock:
+		for {
+			select {
+			case p.queue <- msg:
+				return
+			default:
+			}
+			// waiting for a crashed peer would stall the sender for good
+			if p.unreachable.Load() {
+				cm.count(p, -1)
+				messagesDropped.Inc()
+				if p.dropped.Add(1)%100 == 1 {
+					cm.log.Warn("send queue of unreachable %s is full (%d messages), dropped %d messages so far", addr, cm.queueSize, p.dropped.Load())
+				}
+				return
+			}
+			select {
+			case p.queue <- msg:
+				return
+			case <-p.exitChan:
+				cm.count(p, -1)
+				return
+			case <-time.After(blockRecheck):
+			}
+		}
+	case PolicyDisconnect:
+		select {
+		case p.queue <- msg:
+		default:
+			cm.count(p, -1)
+			p.dropped.Add(1)
+			messagesDropped.Inc()
+			cm.log.Warn("send queue of %s is full (%d messages), disconnecting peer", addr, cm.queueSize)
+			cm.Remove(addr)
+			return
+		}
+	default:
+		for enqueued := false; !enqueued; {
+			select {
+			case p.queue <- msg:
+				enqueued = true
+			default:
+				select {
+				case <-p.queue:
+					cm.count(p, -1)
+					messagesDropped.Inc()
+					if p.dropped.Add(1)%100 == 1 {
+						cm.log.Warn("send queue of %s is full (%d messages), dropped %d oldest messages so far", addr, cm.queueSize, p.dropped.Load())
+					}
+				default:
+				}
+			}
+		}
+	}
+
+	depth := int64(len(p.queue))
+	for max := p.maxDepth.Load(); depth > max && !p.maxDepth.CompareAndSwap(max, depth); max = p.maxDepth.Load() {
+	}
+}
+
+// count keeps the pending messages of the manager and of the peer in step
+func (cm *ConnManager) count(p *peer, delta int64) {
+	cm.pending.Add(delta)
+	p.pending.Add(delta)
+}
+
+// Flush waits until every queued message has been written or timeout elapses.
+// Messages for peers that cannot be dialed are not waited for, Flush reports
+// false if any are left.
+func (cm *ConnManager) Flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for cm.pending.Load() > 0 {
+		reachable, unreachable := cm.pendingByReach()
+		if reachable == 0 {
+			cm.log.Warn("flush gave up on %d messages queued for unreachable peers", unreachable)
+			return false
+		}
+		if time.Now().After(deadline) {
+			cm.log.Warn("flush timed out with %d messages still queued", cm.pending.Load())
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func (cm *ConnManager) pendingByReach() (reachable int64, unreachable int64) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, p := range cm.peers {
+		if p.unreachable.Load() {
+			unreachable += p.pending.Load()
+		} else {
+			reachable += p.pending.Load()
+		}
+	}
+	return reachable, unreachable
+}
+
+// Remove closes the connection to addr and stops its writer goroutine.
+// Queued messages that were not written yet are dropped.
+func (cm *ConnManager) Remove(addr string) {
+	cm.mu.Lock()
+	p, ok := cm.peers[addr]
+	if ok {
+		delete(cm.peers, addr)
+	}
+	cm.mu.Unlock()
+	if ok {
+		close(p.exitChan)
+		p.closeConn()
+	}
+}
+
+// Close gives queued messages a chance to be written, then closes every peer
+// connection and waits for the writer goroutines.
+func (cm *ConnManager) Close() {
+	cm.CloseAfter(flushTimeout)
+}
+
+// CloseAfter is Close with timeout instead of the default flush timeout
+func (cm *ConnManager) CloseAfter(timeout time.Duration) {
+	cm.Flush(timeout)
+
+	cm.mu.Lock()
+	cm.closed = true
+	peers := cm.peers
+	cm.peers = make(map[string]*peer)
+	cm.mu.Unlock()
+
+	for _, p := range peers {
+		close(p.exitChan)
+		p.closeConn()
+	}
+	cm.wg.Wait()
+}
+
+// Connected reports whether a live connection to addr currently exists.
+func (cm *ConnManager) Connected(addr string) bool {
+	cm.mu.Lock()
+	p, ok := cm.peers[addr]
+	cm.mu.Unlock()
+	if !ok {
+		return false
+	}
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	return p.conn != nil
+}
+
+// --------------------------------------------------------
+// Per-Peer Writer
+// --------------------------------------------------------
+
+func (cm *ConnManager) writeLoop(p *peer) {
+	defer cm.wg.Done()
+	for {
+		select {
+		case <-p.exitChan:
+			cm.discard(p)
+			return
+		case msg := <-p.queue:
+			cm.deliver(p, msg)
+			cm.count(p, -1)
+		}
+	}
+}
+
+// discard drops the messages left in the queue of a removed peer.
+func (cm *ConnManager) discard(p *peer) {
+	for {
+		select {
+		case <-p.queue:
+			cm.count(p, -1)
+		default:
+			return
+		}
+	}
+}
+
+// deliver writes msg to the peer, reconnecting until it succeeds or the peer is removed.
+func (cm *ConnManager) deliver(p *peer, msg []byte) {
+	backoff := cm.minBackoff
+	for {
+		conn := cm.connect(p)
+		if conn != nil {
+			_, err := conn.Write(msg)
+			if err == nil {
+				p.sent.Add(1)
+				bytesSent.Add(int64(len(msg)))
+				return
+			}
+			cm.log.Debug("write to %s failed, dropping connection: err=%v", p.addr, err)
+			p.dropConn(conn)
+		}
+
+		select {
+		case <-p.exitChan:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > cm.maxBackoff {
+			backoff = cm.maxBackoff
+		}
+	}
+}
+
+// connect returns the current connection of the peer, dialing a new one if needed.
+func (cm *ConnManager) connect(p *peer) net.Conn {
+	p.connLock.Lock()
+	conn := p.conn
+	p.connLock.Unlock()
+	if conn != nil {
+		return conn
+	}
+
+	cm.mu.Lock()
+	dial := cm.dial
+	cm.mu.Unlock()
+	conn, err := dial(p.addr)
+	if err != nil {
+		p.unreachable.Store(true)
+		cm.log.Debug("DialTCPError: target_addr=%s, err=%v", p.addr, err)
+		return nil
+	}
+	p.unreachable.Store(false)
+	cm.log.Debug("dial success. target_addr=%s", p.addr)
+
+	p.connLock.Lock()
+	select {
+	case <-p.exitChan:
+		// the peer was removed while dialing
+		p.connLock.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	p.conn = conn
+	p.connLock.Unlock()
+
+	// peers never write on our outbound connections, so a returning read means the connection is dead
+	go func() {
+		io.Copy(io.Discard, conn)
+		p.dropConn(conn)
+	}()
+	return conn
+}
+
+// dropConn closes conn and forgets it if it is still the current connection of the peer.
+func (p *peer) dropConn(conn net.Conn) {
+	p.connLock.Lock()
+	if p.conn == conn {
+		p.conn = nil
+	}
+	p.connLock.Unlock()
+	conn.Close()
+}
+
+func (p *peer) closeConn() {
+	p.connLock.Lock()
+	conn := p.conn
+	p.conn = nil
+	p.connLock.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
@@ -0,0 +1,86 @@
+package network
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/michael112233/pbft/config"
+	"github.com/michael112233/pbft/core"
+)
+
+// --------------------------------------------------------
+// Address Resolution
+// --------------------------------------------------------
+
+// Protocol messages only carry replica and client ids, the transport maps them
+// to the addresses of the loaded topology.
+
+// AddrOf returns the listening address of the replica or client with the given id
+func AddrOf(role core.Role, id int64) (string, error) {
+	if role == core.RoleClient {
+		if id != config.ClientID {
+			return "", fmt.Errorf("unknown client %d", id)
+		}
+		return config.ClientAddr, nil
+	}
+	addr, ok := config.NodeAddrOf(id)
+	if !ok {
+		return "", fmt.Errorf("unknown node %d", id)
+	}
+	return addr, nil
+}
+
+// --------------------------------------------------------
+// Transport Identities
+// --------------------------------------------------------
+
+// Identity is the common name of the TLS certificate of a replica or client,
+// e.g. node-2 or client-0.
+func Identity(role core.Role, id int64) string {
+	return fmt.Sprintf("%s-%d", role, id)
+}
+
+// ParseIdentity is the inverse of Identity, it only accepts the exact common
+// name Identity gives, so node-2xyz or node-02 are not node 2
+func ParseIdentity(identity string) (core.Role, int64, error) {
+	for _, role := range []core.Role{core.RoleNode, core.RoleClient} {
+		rest, ok := strings.CutPrefix(identity, role.String()+"-")
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil || Identity(role, id) != identity {
+			break
+		}
+		return role, id, nil
+	}
+	return core.RoleNode, 0, fmt.Errorf("malformed identity %q", identity)
+}
+
+// IdentityOfAddr returns the identity listening on addr, or "" for an unknown address
+func IdentityOfAddr(addr string) string {
+	if addr == config.ClientAddr {
+		return Identity(core.RoleClient, config.ClientID)
+	}
+	for _, id := range config.NodeIDs() {
+		if nodeAddr, _ := config.NodeAddrOf(id); nodeAddr == addr {
+			return Identity(core.RoleNode, id)
+		}
+	}
+	return ""
+}
+
+// PinTopologyKeys requires every endpoint with a public key in the topology
+// to present exactly that certificate
+func PinTopologyKeys(t *TLSIdentity) error {
+	for id, path := range config.NodePublicKeys {
+		if err := t.Pin(Identity(core.RoleNode, int64(id)), path); err != nil {
+			return err
+		}
+	}
+	if config.ClientPublicKey != "" {
+		return t.Pin(Identity(core.RoleClient, config.ClientID), config.ClientPublicKey)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/michael112233/pbft/core"
+)
+
+func TestParseIdentity(t *testing.T) {
+	tests := []struct {
+		identity string
+		role     core.Role
+		id       int64
+		ok       bool
+	}{
+		{"node-2", core.RoleNode, 2, true},
+		{"node-0", core.RoleNode, 0, true},
+		{"client-0", core.RoleClient, 0, true},
+		{"node-2xyz", 0, 0, false},
+		{"node-02", 0, 0, false},
+		{"node-+2", 0, 0, false},
+		{"node-", 0, 0, false},
+		{"node 2", 0, 0, false},
+		{"client-1/node-2", 0, 0, false},
+		{"operator-2", 0, 0, false},
+	}
+	for _, tt := range tests {
+		role, id, err := ParseIdentity(tt.identity)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseIdentity(%q) err=%v, want ok=%v", tt.identity, err, tt.ok)
+			continue
+		}
+		if tt.ok && (role != tt.role || id != tt.id) {
+			t.Errorf("ParseIdentity(%q) = %s-%d, want %s-%d", tt.identity, role, id, tt.role, tt.id)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package network
+
+import (
+	"net"
+	"sync"
+)
+
+// --------------------------------------------------------
+// Inbound Connections
+// --------------------------------------------------------
+
+// Inbound accepts the connections of a listener and keeps track of them and
+// of their goroutines, so a hub can close every one of them and wait until
+// no handler is running anymore.
+type Inbound struct {
+	mu     sync.Mutex
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func NewInbound() *Inbound {
+	return &Inbound{conns: make(map[net.Conn]struct{})}
+}
+
+// Serve accepts connections from ln in the background until Close, handle
+// runs in its own goroutine per connection and the connection is closed
+// when it returns
+func (in *Inbound) Serve(ln net.Listener, handle func(conn net.Conn)) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.closed {
+		ln.Close()
+		return
+	}
+	in.ln = ln
+	in.wg.Add(1)
+	go func() {
+		defer in.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if !in.track(conn) {
+				conn.Close()
+				return
+			}
+			go func() {
+				defer in.wg.Done()
+				defer in.untrack(conn)
+				handle(conn)
+			}()
+		}
+	}()
+}
+
+func (in *Inbound) track(conn net.Conn) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.closed {
+		return false
+	}
+	in.conns[conn] = struct{}{}
+	in.wg.Add(1)
+	return true
+}
+
+func (in *Inbound) untrack(conn net.Conn) {
+	in.mu.Lock()
+	delete(in.conns, conn)
+	in.mu.Unlock()
+	conn.Close()
+}
+
+// Closed reports whether Close was called, reads failing after it are expected
+func (in *Inbound) Closed() bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.closed
+}
+
+// Close stops accepting, closes every open connection and waits for the
+// accept loop and every handler to return
+func (in *Inbound) Close() {
+	in.mu.Lock()
+	if !in.closed {
+		in.closed = true
+		if in.ln != nil {
+			in.ln.Close()
+		}
+		for conn := range in.conns {
+			conn.Close()
+		}
+	}
+	in.mu.Unlock()
+	in.wg.Wait()
+}
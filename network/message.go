@@ -0,0 +1,132 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/michael112233/pbft/core"
+)
+
+// --------------------------------------------------------
+// Framing
+// --------------------------------------------------------
+
+// A frame on the wire is
+//
+//	| length (uint32) | version (uint8) | message id (uint8) | body | crc32 (uint32) |
+//
+// All integers are big endian. length counts everything after itself, the
+// body is the message encoded with the configured codec and the checksum is
+// the IEEE CRC-32 of version, message id and body.
+const (
+	ProtocolVersion     = 2
+	DefaultMaxFrameSize = 16 * 1024 * 1024
+
+	lengthSize   = 4
+	headerSize   = 2
+	checksumSize = 4
+)
+
+var (
+	ErrFrameTooLarge    = errors.New("frame exceeds the maximum frame size")
+	ErrFrameTooShort    = errors.New("frame is shorter than its header")
+	ErrVersionMismatch  = errors.New("unsupported protocol version")
+	ErrChecksumMismatch = errors.New("frame checksum mismatch")
+)
+
+// Framer turns messages into frames and back. Every error returned by Read
+// means the stream can no longer be trusted and the connection must be dropped.
+type Framer struct {
+	Codec        Codec
+	MaxFrameSize int
+}
+
+func NewFramer(codec Codec, maxFrameSize int) *Framer {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	return &Framer{
+		Codec:        codec,
+		MaxFrameSize: maxFrameSize,
+	}
+}
+
+// Encode encodes msg and wraps it into a frame.
+func (f *Framer) Encode(messageType *core.MessageType, msg interface{}) ([]byte, error) {
+	msgType := messageType.Name
+	body, err := f.Codec.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("%s encode %s: %v", f.Codec.Name(), msgType, err)
+	}
+	length := headerSize + len(body) + checksumSize
+	if length > f.MaxFrameSize {
+		return nil, fmt.Errorf("%s of %d bytes: %w", msgType, length, ErrFrameTooLarge)
+	}
+
+	frame := make([]byte, lengthSize+length)
+	binary.BigEndian.PutUint32(frame[:lengthSize], uint32(length))
+	frame[lengthSize] = ProtocolVersion
+	frame[lengthSize+1] = byte(messageType.ID)
+	copy(frame[lengthSize+headerSize:], body)
+	checksum := crc32.ChecksumIEEE(frame[lengthSize : len(frame)-checksumSize])
+	binary.BigEndian.PutUint32(frame[len(frame)-checksumSize:], checksum)
+	return frame, nil
+}
+
+// Read reads and decodes one frame. The length is checked before anything is
+// allocated, so a peer cannot make the replica allocate more than MaxFrameSize.
+func (f *Framer) Read(r io.Reader) (*core.MessageType, interface{}, error) {
+	lenBuf := make([]byte, lengthSize)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		return nil, nil, err
+	}
+	length := binary.BigEndian.Uint32(lenBuf)
+	if uint64(length) > uint64(f.MaxFrameSize) {
+		return nil, nil, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, length, f.MaxFrameSize)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	bytesReceived.Add(int64(lengthSize + len(payload)))
+	messageType, msg, err := f.Decode(payload)
+	if err == nil {
+		messagesReceived.Inc("type", messageType.Name)
+	}
+	return messageType, msg, err
+}
+
+// Decode decodes a frame without its length prefix.
+func (f *Framer) Decode(payload []byte) (*core.MessageType, interface{}, error) {
+	if len(payload) < headerSize+checksumSize {
+		return nil, nil, ErrFrameTooShort
+	}
+	content := payload[:len(payload)-checksumSize]
+	if crc32.ChecksumIEEE(content) != binary.BigEndian.Uint32(payload[len(payload)-checksumSize:]) {
+		return nil, nil, ErrChecksumMismatch
+	}
+	if content[0] != ProtocolVersion {
+		return nil, nil, fmt.Errorf("%w %d", ErrVersionMismatch, content[0])
+	}
+
+	messageType, ok := core.LookupMessageByID(core.MessageID(content[1]))
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown message id %d", content[1])
+	}
+	msg := messageType.New()
+	if err := f.Codec.Unmarshal(content[headerSize:], msg); err != nil {
+		return messageType, nil, fmt.Errorf("%s decode %s: %v", f.Codec.Name(), messageType.Name, err)
+	}
+	if validator, ok := msg.(core.Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return messageType, nil, fmt.Errorf("invalid %s: %v", messageType.Name, err)
+		}
+	}
+	return messageType, msg, nil
+}
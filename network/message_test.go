@@ -0,0 +1,135 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	"github.com/michael112233/pbft/core"
+)
+
+// The framer parses bytes straight off the network, these fuzz targets make
+// sure no input can crash a replica and that everything it accepts can be
+// sent on again.
+
+const fuzzMaxFrameSize = 64 * 1024
+
+func fuzzFramers() []*Framer {
+	framers := make([]*Framer, 0)
+	for _, name := range []string{"gob", "json", "protobuf"} {
+		codec, err := GetCodec(name)
+		if err != nil {
+			panic(err)
+		}
+		framers = append(framers, NewFramer(codec, fuzzMaxFrameSize))
+	}
+	return framers
+}
+
+// seedFrames returns a valid frame of every sample message in every wire
+// format, followed by frames with a bad checksum, version, message id or length
+func seedFrames(t testing.TB) [][]byte {
+	frames := make([][]byte, 0)
+	samples := sampleMessages()
+	for _, framer := range fuzzFramers() {
+		for _, messageType := range registeredMessages() {
+			frame, err := framer.Encode(messageType, samples[messageType.ID])
+			if err != nil {
+				t.Fatalf("encode %s with %s: %v", messageType.Name, framer.Codec.Name(), err)
+			}
+			frames = append(frames, frame)
+		}
+	}
+
+	valid := frames[0]
+	badChecksum := bytes.Clone(valid)
+	badChecksum[len(badChecksum)-1] ^= 0xff
+	badVersion := resealed(valid, func(content []byte) { content[0] = ProtocolVersion + 1 })
+	badID := resealed(valid, func(content []byte) { content[1] = 0xff })
+	tooLong := bytes.Clone(valid)
+	binary.BigEndian.PutUint32(tooLong, uint32(len(valid)))
+	tooShort := bytes.Clone(valid)
+	binary.BigEndian.PutUint32(tooShort, headerSize+checksumSize-1)
+	tooLarge := bytes.Clone(valid)
+	binary.BigEndian.PutUint32(tooLarge, fuzzMaxFrameSize+1)
+	return append(frames, badChecksum, badVersion, badID, tooLong, tooShort, tooLarge, valid[:len(valid)-1], valid[:2])
+}
+
+// resealed copies frame, applies change to version, message id and body and
+// fixes the checksum so only the change is wrong
+func resealed(frame []byte, change func(content []byte)) []byte {
+	frame = bytes.Clone(frame)
+	content := frame[lengthSize : len(frame)-checksumSize]
+	change(content)
+	binary.BigEndian.PutUint32(frame[len(frame)-checksumSize:], crc32.ChecksumIEEE(content))
+	return frame
+}
+
+// checkDecoded fails unless an accepted message can be framed and decoded again
+func checkDecoded(t *testing.T, framer *Framer, messageType *core.MessageType, msg interface{}) {
+	if messageType == nil || msg == nil {
+		t.Fatalf("%s accepted a frame without a message", framer.Codec.Name())
+	}
+	frame, err := framer.Encode(messageType, msg)
+	if errors.Is(err, ErrFrameTooLarge) {
+		// codecs do not encode a message back to the same size
+		return
+	}
+	if err != nil {
+		t.Fatalf("%s cannot encode the %s it accepted: %v", framer.Codec.Name(), messageType.Name, err)
+	}
+	if _, _, err := framer.Decode(frame[lengthSize:]); err != nil {
+		t.Fatalf("%s rejects the %s it encoded from an accepted frame: %v", framer.Codec.Name(), messageType.Name, err)
+	}
+}
+
+func FuzzFramerDecode(f *testing.F) {
+	for _, frame := range seedFrames(f) {
+		if len(frame) >= lengthSize {
+			f.Add(frame[lengthSize:])
+		}
+	}
+	framers := fuzzFramers()
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		for _, framer := range framers {
+			messageType, msg, err := framer.Decode(payload)
+			if err != nil {
+				continue
+			}
+			checkDecoded(t, framer, messageType, msg)
+		}
+	})
+}
+
+func FuzzFramerRead(f *testing.F) {
+	for _, frame := range seedFrames(f) {
+		f.Add(frame)
+	}
+	framers := fuzzFramers()
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		for _, framer := range framers {
+			r := bytes.NewReader(stream)
+			messageType, msg, err := framer.Read(r)
+			if len(stream) >= lengthSize {
+				length := binary.BigEndian.Uint32(stream)
+				if length > fuzzMaxFrameSize && !errors.Is(err, ErrFrameTooLarge) {
+					t.Fatalf("%s read a frame of %d bytes: err=%v", framer.Codec.Name(), length, err)
+				}
+			}
+			if err != nil {
+				if err == io.EOF && len(stream) != 0 {
+					t.Fatalf("%s reported EOF in the middle of a frame", framer.Codec.Name())
+				}
+				continue
+			}
+			// Read must consume exactly one frame
+			if consumed := len(stream) - r.Len(); consumed != lengthSize+int(binary.BigEndian.Uint32(stream)) {
+				t.Fatalf("%s consumed %d bytes of a %d byte frame", framer.Codec.Name(), consumed, lengthSize+binary.BigEndian.Uint32(stream))
+			}
+			checkDecoded(t, framer, messageType, msg)
+		}
+	})
+}
@@ -0,0 +1,38 @@
+package network
+
+import (
+	"github.com/michael112233/pbft/metrics"
+)
+
+// --------------------------------------------------------
+// Metrics
+// --------------------------------------------------------
+
+var (
+	messagesSent     = metrics.Counter("pbft_messages_sent_total", "Messages handed to the send queues by type.")
+	messagesReceived = metrics.Counter("pbft_messages_received_total", "Messages read from the network by type.")
+	bytesSent        = metrics.Counter("pbft_bytes_sent_total", "Frame bytes written to peer connections.")
+	bytesReceived    = metrics.Counter("pbft_bytes_received_total", "Frame bytes read from peer connections.")
+	messagesDropped  = metrics.Counter("pbft_messages_dropped_total", "Queued messages dropped because a send queue overflowed.")
+)
+
+// CountSent records a message of msgType handed to the send queues
+func CountSent(msgType string) {
+	messagesSent.Inc("type", msgType)
+}
+
+// registerQueueMetrics exposes the send queues of cm, a process has a single
+// connection manager so the first one registered is the one scraped
+func registerQueueMetrics(cm *ConnManager) {
+	for _, counter := range []*metrics.Family{bytesSent, bytesReceived, messagesDropped} {
+		counter.Add(0)
+	}
+	metrics.GaugeFunc("pbft_send_queue_depth", "Messages waiting in the send queue of each peer.", func() []metrics.Sample {
+		stats := cm.Stats()
+		samples := make([]metrics.Sample, 0, len(stats))
+		for _, s := range stats {
+			samples = append(samples, metrics.Sample{Labels: []string{"peer", s.Addr}, Value: int64(s.Depth)})
+		}
+		return samples
+	})
+}
@@ -0,0 +1,235 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------
+// Operator Keys
+// --------------------------------------------------------
+
+// An operator signs the requests that stop or steer a replica, i.e. close
+// messages and the POST requests of the admin API. The key pair of operator
+// <name> is <tls_dir>/operator-<name>.key and operator-<name>.pub.
+const (
+	// operatorMaxAge bounds how far the timestamp of a signed request may be
+	// from the clock of the replica
+	operatorMaxAge = time.Minute
+
+	HeaderOperator  = "X-Pbft-Operator"
+	HeaderTimestamp = "X-Pbft-Timestamp"
+	HeaderSignature = "X-Pbft-Signature"
+)
+
+func operatorKeyFile(dir string, name string) string {
+	return filepath.Join(dir, "operator-"+name+".key")
+}
+
+func operatorPubFile(dir string, name string) string {
+	return filepath.Join(dir, "operator-"+name+".pub")
+}
+
+// GenerateOperatorKeys creates a key pair per operator name in dir
+func GenerateOperatorKeys(dir string, names []string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, name := range names {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			return err
+		}
+		if err := writePEM(operatorPubFile(dir, name), "PUBLIC KEY", der, 0644); err != nil {
+			return err
+		}
+		if err := writeKey(operatorKeyFile(dir, name), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GenerateMissingOperatorKeys creates a key pair for every name that has
+// neither a private nor a public key in dir and returns those names. Existing
+// keys are kept, a replica only holding the public key is left alone.
+func GenerateMissingOperatorKeys(dir string, names []string) ([]string, error) {
+	missing := make([]string, 0)
+	for _, name := range names {
+		_, keyErr := os.Stat(operatorKeyFile(dir, name))
+		_, pubErr := os.Stat(operatorPubFile(dir, name))
+		if errors.Is(keyErr, fs.ErrNotExist) && errors.Is(pubErr, fs.ErrNotExist) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return missing, nil
+	}
+	return missing, GenerateOperatorKeys(dir, missing)
+}
+
+// OperatorKey is the private key a client or the admin command signs with
+type OperatorKey struct {
+	Name string
+	key  *ecdsa.PrivateKey
+}
+
+// LoadOperatorKey loads <dir>/operator-<name>.key
+func LoadOperatorKey(dir string, name string) (*OperatorKey, error) {
+	block, err := readPEM(operatorKeyFile(dir, name), "EC PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParseECPrivateKey(block)
+	if err != nil {
+		return nil, err
+	}
+	return &OperatorKey{Name: name, key: key}, nil
+}
+
+func (k *OperatorKey) Sign(data []byte) ([]byte, error) {
+	hash := sha256.Sum256(data)
+	return ecdsa.SignASN1(rand.Reader, k.key, hash[:])
+}
+
+// SignAdminRequest adds the operator headers to a request for the admin API
+// of replica nodeID
+func (k *OperatorKey) SignAdminRequest(r *http.Request, nodeID int64) error {
+	timestamp := time.Now().Unix()
+	signature, err := k.Sign(adminSignedBytes(r.Method, r.URL.Path, nodeID, timestamp, k.Name))
+	if err != nil {
+		return err
+	}
+	r.Header.Set(HeaderOperator, k.Name)
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	r.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(signature))
+	return nil
+}
+
+func adminSignedBytes(method string, path string, nodeID int64, timestamp int64, operator string) []byte {
+	return []byte(fmt.Sprintf("admin %s %s %d %d %s", method, path, nodeID, timestamp, operator))
+}
+
+// Operators holds the public keys a replica accepts signed requests from
+type Operators struct {
+	keys map[string]*ecdsa.PublicKey
+	// sha256 of the signed bytes -> timestamp, a request is accepted once.
+	// ECDSA signatures are malleable, so they cannot identify a request.
+	seen     map[[sha256.Size]byte]int64
+	seenLock sync.Mutex
+}
+
+// LoadOperators loads <dir>/operator-<name>.pub of every name
+func LoadOperators(dir string, names []string) (*Operators, error) {
+	operators := &Operators{
+		keys: make(map[string]*ecdsa.PublicKey),
+		seen: make(map[[sha256.Size]byte]int64),
+	}
+	for _, name := range names {
+		block, err := readPEM(operatorPubFile(dir, name), "PUBLIC KEY")
+		if err != nil {
+			return nil, err
+		}
+		pub, err := x509.ParsePKIXPublicKey(block)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an ECDSA public key", operatorPubFile(dir, name))
+		}
+		operators.keys[name] = key
+	}
+	return operators, nil
+}
+
+// Verify checks that operator signed data at timestamp, in unix seconds, and
+// that the same data was not accepted before. Without operators nothing verifies.
+func (o *Operators) Verify(operator string, timestamp int64, data []byte, signature []byte) error {
+	if o == nil {
+		return errors.New("no operators are configured")
+	}
+	if operator == "" {
+		return errors.New("not signed by an operator")
+	}
+	key, ok := o.keys[operator]
+	if !ok {
+		return fmt.Errorf("unknown operator %q", operator)
+	}
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > operatorMaxAge || age < -operatorMaxAge {
+		return fmt.Errorf("timestamp of operator %q is %s off", operator, age.Round(time.Second))
+	}
+	hash := sha256.Sum256(data)
+	if !ecdsa.VerifyASN1(key, hash[:], signature) {
+		return fmt.Errorf("bad signature of operator %q", operator)
+	}
+
+	o.seenLock.Lock()
+	defer o.seenLock.Unlock()
+	for seen, at := range o.seen {
+		if time.Since(time.Unix(at, 0)) > operatorMaxAge {
+			delete(o.seen, seen)
+		}
+	}
+	if _, replayed := o.seen[hash]; replayed {
+		return fmt.Errorf("replayed request of operator %q", operator)
+	}
+	o.seen[hash] = timestamp
+	return nil
+}
+
+// VerifyAdminRequest checks the operator headers of a request for the admin
+// API of replica nodeID and returns the operator who signed it
+func (o *Operators) VerifyAdminRequest(r *http.Request, nodeID int64) (string, error) {
+	if o == nil {
+		return "", errors.New("no operators are configured")
+	}
+	operator := r.Header.Get(HeaderOperator)
+	if operator == "" {
+		return "", errors.New("not signed by an operator")
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s header: %v", HeaderTimestamp, err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get(HeaderSignature))
+	if err != nil {
+		return "", fmt.Errorf("invalid %s header: %v", HeaderSignature, err)
+	}
+	data := adminSignedBytes(r.Method, r.URL.Path, nodeID, timestamp, operator)
+	if err := o.Verify(operator, timestamp, data, signature); err != nil {
+		return "", err
+	}
+	return operator, nil
+}
+
+func readPEM(path string, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("no %s found in %s", blockType, path)
+	}
+	return block.Bytes, nil
+}
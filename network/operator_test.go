@@ -0,0 +1,53 @@
+package network
+
+import (
+	"crypto/elliptic"
+	"encoding/asn1"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestVerifyRejectsMalleatedReplay replays a signed request with the
+// equally valid signature (r, n-s), which must not count as a new request
+func TestVerifyRejectsMalleatedReplay(t *testing.T) {
+	dir := t.TempDir()
+	if err := GenerateOperatorKeys(dir, []string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadOperatorKey(dir, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	operators, err := LoadOperators(dir, []string{"alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamp := time.Now().Unix()
+	data := adminSignedBytes("POST", "/shutdown", 1, timestamp, "alice")
+	signature, err := key.Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+		t.Fatal(err)
+	}
+	sig.S.Sub(elliptic.P256().Params().N, sig.S)
+	malleated, err := asn1.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := operators.Verify("alice", timestamp, data, signature); err != nil {
+		t.Fatalf("first request rejected: %v", err)
+	}
+	for name, replay := range map[string][]byte{"same signature": signature, "malleated signature": malleated} {
+		err := operators.Verify("alice", timestamp, data, replay)
+		if err == nil || !strings.Contains(err.Error(), "replayed") {
+			t.Errorf("replay with the %s: got err=%v, want a replayed request", name, err)
+		}
+	}
+}
@@ -0,0 +1,561 @@
+package network
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/michael112233/pbft/core"
+)
+
+// protobufCodec speaks the schema in proto/pbft.proto so that tools written
+// in other languages can talk to the cluster.
+type protobufCodec struct{}
+
+func init() {
+	RegisterCodec(protobufCodec{})
+}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	var e protoEncoder
+	switch msg := v.(type) {
+	case core.RequestMessage:
+		encodeRequest(&e, &msg)
+	case *core.RequestMessage:
+		encodeRequest(&e, msg)
+	case core.PreprepareMessage:
+		encodePhase(&e, msg.Timestamp, msg.From, msg.To, msg.SequenceNumber, msg.ViewNumber, msg.Digest, msg.RequestMessage)
+	case *core.PreprepareMessage:
+		encodePhase(&e, msg.Timestamp, msg.From, msg.To, msg.SequenceNumber, msg.ViewNumber, msg.Digest, msg.RequestMessage)
+	case core.PrepareMessage:
+		encodePhase(&e, msg.Timestamp, msg.From, msg.To, msg.SequenceNumber, msg.ViewNumber, msg.Digest, msg.RequestMessage)
+	case *core.PrepareMessage:
+		encodePhase(&e, msg.Timestamp, msg.From, msg.To, msg.SequenceNumber, msg.ViewNumber, msg.Digest, msg.RequestMessage)
+	case core.CommitMessage:
+		encodePhase(&e, msg.Timestamp, msg.From, msg.To, msg.SequenceNumber, msg.ViewNumber, msg.Digest, msg.RequestMessage)
+	case *core.CommitMessage:
+		encodePhase(&e, msg.Timestamp, msg.From, msg.To, msg.SequenceNumber, msg.ViewNumber, msg.Digest, msg.RequestMessage)
+	case core.ReplyMessage:
+		encodePhase(&e, msg.Timestamp, msg.From, msg.To, msg.SequenceNumber, msg.ViewNumber, msg.Digest, msg.RequestMessage)
+	case *core.ReplyMessage:
+		encodePhase(&e, msg.Timestamp, msg.From, msg.To, msg.SequenceNumber, msg.ViewNumber, msg.Digest, msg.RequestMessage)
+	case core.CloseMessage:
+		encodeClose(&e, &msg)
+	case *core.CloseMessage:
+		encodeClose(&e, msg)
+	case core.ViewChangeMessage:
+		encodeViewChange(&e, &msg)
+	case *core.ViewChangeMessage:
+		encodeViewChange(&e, msg)
+	case core.CheckpointMessage:
+		encodeCheckpoint(&e, &msg)
+	case *core.CheckpointMessage:
+		encodeCheckpoint(&e, msg)
+	case core.StateRequestMessage:
+		encodeStateRequest(&e, &msg)
+	case *core.StateRequestMessage:
+		encodeStateRequest(&e, msg)
+	case core.StateResponseMessage:
+		encodeStateResponse(&e, &msg)
+	case *core.StateResponseMessage:
+		encodeStateResponse(&e, msg)
+	case core.HandoffMessage:
+		encodeHandoff(&e, &msg)
+	case *core.HandoffMessage:
+		encodeHandoff(&e, msg)
+	default:
+		return nil, fmt.Errorf("protobuf: no schema for %T", v)
+	}
+	return e.buf, nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	switch msg := v.(type) {
+	case *core.RequestMessage:
+		return decodeRequest(data, msg)
+	case *core.PreprepareMessage:
+		return decodePhase(data, &msg.Timestamp, &msg.From, &msg.To, &msg.SequenceNumber, &msg.ViewNumber, &msg.Digest, &msg.RequestMessage)
+	case *core.PrepareMessage:
+		return decodePhase(data, &msg.Timestamp, &msg.From, &msg.To, &msg.SequenceNumber, &msg.ViewNumber, &msg.Digest, &msg.RequestMessage)
+	case *core.CommitMessage:
+		return decodePhase(data, &msg.Timestamp, &msg.From, &msg.To, &msg.SequenceNumber, &msg.ViewNumber, &msg.Digest, &msg.RequestMessage)
+	case *core.ReplyMessage:
+		return decodePhase(data, &msg.Timestamp, &msg.From, &msg.To, &msg.SequenceNumber, &msg.ViewNumber, &msg.Digest, &msg.RequestMessage)
+	case *core.CloseMessage:
+		return decodeClose(data, msg)
+	case *core.ViewChangeMessage:
+		return decodeViewChange(data, msg)
+	case *core.CheckpointMessage:
+		return decodeCheckpoint(data, msg)
+	case *core.StateRequestMessage:
+		return decodeStateRequest(data, msg)
+	case *core.StateResponseMessage:
+		return decodeStateResponse(data, msg)
+	case *core.HandoffMessage:
+		return decodeHandoff(data, msg)
+	default:
+		return fmt.Errorf("protobuf: no schema for %T", v)
+	}
+}
+
+// --------------------------------------------------------
+// Encoders, field numbers follow proto/pbft.proto
+// --------------------------------------------------------
+
+func encodeTransaction(e *protoEncoder, tx *core.Transaction) {
+	if tx == nil {
+		return
+	}
+	e.string(1, tx.Sender)
+	e.string(2, tx.Receiver)
+	if tx.Amount != nil {
+		e.string(3, tx.Amount.String())
+	}
+}
+
+func encodeRequest(e *protoEncoder, msg *core.RequestMessage) {
+	e.int64(1, msg.Timestamp)
+	e.int64(2, msg.From)
+	e.int64(3, msg.To)
+	for _, tx := range msg.Txs {
+		e.message(4, func(nested *protoEncoder) { encodeTransaction(nested, tx) })
+	}
+	e.int64(5, msg.Id)
+	if msg.Reconfig != nil {
+		e.message(6, func(nested *protoEncoder) { encodeReconfiguration(nested, msg.Reconfig) })
+	}
+}
+
+func encodeMember(e *protoEncoder, member core.Member) {
+	e.int64(1, member.ID)
+	e.string(2, member.Addr)
+}
+
+func encodeReconfiguration(e *protoEncoder, reconfig *core.Reconfiguration) {
+	for _, member := range reconfig.Add {
+		e.message(1, func(nested *protoEncoder) { encodeMember(nested, member) })
+	}
+	e.packedInt64(2, reconfig.Remove)
+	e.int64(3, reconfig.FaultyNodesNum)
+}
+
+// encodePhase writes the layout shared by pre-prepare, prepare, commit and reply
+func encodePhase(e *protoEncoder, timestamp int64, from, to, seq, view int64, digest string, request *core.RequestMessage) {
+	e.int64(1, timestamp)
+	e.int64(2, from)
+	e.int64(3, to)
+	e.int64(4, seq)
+	e.int64(5, view)
+	e.string(6, digest)
+	if request != nil {
+		e.message(7, func(nested *protoEncoder) { encodeRequest(nested, request) })
+	}
+}
+
+func encodeClose(e *protoEncoder, msg *core.CloseMessage) {
+	e.int64(1, msg.Timestamp)
+	e.int64(2, msg.From)
+	e.int64(3, msg.To)
+	e.string(4, msg.Operator)
+	e.bytes(5, msg.Signature)
+}
+
+func encodeViewChange(e *protoEncoder, msg *core.ViewChangeMessage) {
+	e.int64(1, msg.Timestamp)
+	e.int64(2, msg.From)
+	e.int64(3, msg.To)
+	e.int64(4, msg.CheckpointSeqNumber)
+	e.int64(5, msg.ViewNumber)
+	e.int64(6, int64(msg.CheckpointMsgNumber))
+	for seq, prepared := range msg.HavePreparedList {
+		e.message(7, func(entry *protoEncoder) {
+			entry.int64(1, seq)
+			entry.bool(2, prepared)
+		})
+	}
+}
+
+func encodeCheckpoint(e *protoEncoder, msg *core.CheckpointMessage) {
+	e.int64(1, msg.Timestamp)
+	e.int64(2, msg.From)
+	e.int64(3, msg.To)
+	e.int64(4, msg.SequenceNumber)
+	e.string(5, msg.Digest)
+}
+
+func encodeHandoff(e *protoEncoder, msg *core.HandoffMessage) {
+	e.int64(1, msg.Timestamp)
+	e.int64(2, msg.From)
+	e.int64(3, msg.To)
+	e.int64(4, msg.SequenceNumber)
+	e.int64(5, msg.ViewNumber)
+	e.string(6, msg.Digest)
+}
+
+func encodeStateRequest(e *protoEncoder, msg *core.StateRequestMessage) {
+	e.int64(1, msg.Timestamp)
+	e.int64(2, msg.From)
+	e.int64(3, msg.To)
+	e.int64(4, msg.FromSequenceNumber)
+}
+
+func encodeStateResponse(e *protoEncoder, msg *core.StateResponseMessage) {
+	e.int64(1, msg.Timestamp)
+	e.int64(2, msg.From)
+	e.int64(3, msg.To)
+	e.int64(4, msg.SequenceNumber)
+	e.int64(5, msg.ViewNumber)
+	e.string(6, msg.Digest)
+	for _, member := range msg.Members {
+		e.message(7, func(nested *protoEncoder) { encodeMember(nested, member) })
+	}
+	e.int64(8, msg.FaultyNodesNum)
+	for _, entry := range msg.History {
+		e.message(9, func(nested *protoEncoder) {
+			nested.int64(1, entry.SequenceNumber)
+			nested.int64(2, entry.ViewNumber)
+			nested.string(3, entry.Digest)
+			if entry.RequestMessage != nil {
+				nested.message(4, func(request *protoEncoder) { encodeRequest(request, entry.RequestMessage) })
+			}
+		})
+	}
+	e.int64(10, msg.FromSequenceNumber)
+}
+
+// --------------------------------------------------------
+// Decoders, unknown fields are skipped
+// --------------------------------------------------------
+
+func setInt64(f protoField, dst *int64) error {
+	if err := f.expect(wireVarint); err != nil {
+		return err
+	}
+	*dst = int64(f.value)
+	return nil
+}
+
+func setString(f protoField, dst *string) error {
+	if err := f.expect(wireBytes); err != nil {
+		return err
+	}
+	*dst = string(f.data)
+	return nil
+}
+
+func setBytes(f protoField, dst *[]byte) error {
+	if err := f.expect(wireBytes); err != nil {
+		return err
+	}
+	*dst = append([]byte(nil), f.data...)
+	return nil
+}
+
+func decodeTransaction(data []byte) (*core.Transaction, error) {
+	tx := &core.Transaction{}
+	err := decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			return setString(f, &tx.Sender)
+		case 2:
+			return setString(f, &tx.Receiver)
+		case 3:
+			var amount string
+			if err := setString(f, &amount); err != nil {
+				return err
+			}
+			value, ok := new(big.Int).SetString(amount, 10)
+			if !ok {
+				return fmt.Errorf("protobuf: invalid transaction amount %q", amount)
+			}
+			tx.Amount = value
+		}
+		return nil
+	})
+	if tx.Amount == nil {
+		tx.Amount = new(big.Int)
+	}
+	return tx, err
+}
+
+func decodeRequest(data []byte, msg *core.RequestMessage) error {
+	return decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			return setInt64(f, &msg.Timestamp)
+		case 2:
+			return setInt64(f, &msg.From)
+		case 3:
+			return setInt64(f, &msg.To)
+		case 4:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			tx, err := decodeTransaction(f.data)
+			if err != nil {
+				return err
+			}
+			msg.Txs = append(msg.Txs, tx)
+		case 5:
+			return setInt64(f, &msg.Id)
+		case 6:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			msg.Reconfig = &core.Reconfiguration{}
+			return decodeReconfiguration(f.data, msg.Reconfig)
+		}
+		return nil
+	})
+}
+
+func decodeMember(data []byte) (core.Member, error) {
+	var member core.Member
+	err := decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			return setInt64(f, &member.ID)
+		case 2:
+			return setString(f, &member.Addr)
+		}
+		return nil
+	})
+	return member, err
+}
+
+func decodeReconfiguration(data []byte, reconfig *core.Reconfiguration) error {
+	return decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			member, err := decodeMember(f.data)
+			if err != nil {
+				return err
+			}
+			reconfig.Add = append(reconfig.Add, member)
+		case 2:
+			ids, err := f.int64s()
+			if err != nil {
+				return err
+			}
+			reconfig.Remove = append(reconfig.Remove, ids...)
+		case 3:
+			return setInt64(f, &reconfig.FaultyNodesNum)
+		}
+		return nil
+	})
+}
+
+func decodePhase(data []byte, timestamp *int64, from, to, seq, view *int64, digest *string, request **core.RequestMessage) error {
+	return decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			return setInt64(f, timestamp)
+		case 2:
+			return setInt64(f, from)
+		case 3:
+			return setInt64(f, to)
+		case 4:
+			return setInt64(f, seq)
+		case 5:
+			return setInt64(f, view)
+		case 6:
+			return setString(f, digest)
+		case 7:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			*request = &core.RequestMessage{}
+			return decodeRequest(f.data, *request)
+		}
+		return nil
+	})
+}
+
+func decodeClose(data []byte, msg *core.CloseMessage) error {
+	return decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			return setInt64(f, &msg.Timestamp)
+		case 2:
+			return setInt64(f, &msg.From)
+		case 3:
+			return setInt64(f, &msg.To)
+		case 4:
+			return setString(f, &msg.Operator)
+		case 5:
+			return setBytes(f, &msg.Signature)
+		}
+		return nil
+	})
+}
+
+func decodeViewChange(data []byte, msg *core.ViewChangeMessage) error {
+	msg.HavePreparedList = make(map[int64]bool)
+	return decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			return setInt64(f, &msg.Timestamp)
+		case 2:
+			return setInt64(f, &msg.From)
+		case 3:
+			return setInt64(f, &msg.To)
+		case 4:
+			return setInt64(f, &msg.CheckpointSeqNumber)
+		case 5:
+			return setInt64(f, &msg.ViewNumber)
+		case 6:
+			var number int64
+			if err := setInt64(f, &number); err != nil {
+				return err
+			}
+			msg.CheckpointMsgNumber = int32(number)
+		case 7:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			var seq int64
+			var prepared bool
+			err := decodeProto(f.data, func(entry protoField) error {
+				switch entry.number {
+				case 1:
+					return setInt64(entry, &seq)
+				case 2:
+					if err := entry.expect(wireVarint); err != nil {
+						return err
+					}
+					prepared = entry.value != 0
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			msg.HavePreparedList[seq] = prepared
+		}
+		return nil
+	})
+}
+
+func decodeCheckpoint(data []byte, msg *core.CheckpointMessage) error {
+	return decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			return setInt64(f, &msg.Timestamp)
+		case 2:
+			return setInt64(f, &msg.From)
+		case 3:
+			return setInt64(f, &msg.To)
+		case 4:
+			return setInt64(f, &msg.SequenceNumber)
+		case 5:
+			return setString(f, &msg.Digest)
+		}
+		return nil
+	})
+}
+
+func decodeHandoff(data []byte, msg *core.HandoffMessage) error {
+	return decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			return setInt64(f, &msg.Timestamp)
+		case 2:
+			return setInt64(f, &msg.From)
+		case 3:
+			return setInt64(f, &msg.To)
+		case 4:
+			return setInt64(f, &msg.SequenceNumber)
+		case 5:
+			return setInt64(f, &msg.ViewNumber)
+		case 6:
+			return setString(f, &msg.Digest)
+		}
+		return nil
+	})
+}
+
+func decodeStateRequest(data []byte, msg *core.StateRequestMessage) error {
+	return decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			return setInt64(f, &msg.Timestamp)
+		case 2:
+			return setInt64(f, &msg.From)
+		case 3:
+			return setInt64(f, &msg.To)
+		case 4:
+			return setInt64(f, &msg.FromSequenceNumber)
+		}
+		return nil
+	})
+}
+
+func decodeCommittedRequest(data []byte) (*core.CommittedRequest, error) {
+	entry := &core.CommittedRequest{}
+	err := decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			return setInt64(f, &entry.SequenceNumber)
+		case 2:
+			return setInt64(f, &entry.ViewNumber)
+		case 3:
+			return setString(f, &entry.Digest)
+		case 4:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			entry.RequestMessage = &core.RequestMessage{}
+			return decodeRequest(f.data, entry.RequestMessage)
+		}
+		return nil
+	})
+	return entry, err
+}
+
+func decodeStateResponse(data []byte, msg *core.StateResponseMessage) error {
+	return decodeProto(data, func(f protoField) error {
+		switch f.number {
+		case 1:
+			return setInt64(f, &msg.Timestamp)
+		case 2:
+			return setInt64(f, &msg.From)
+		case 3:
+			return setInt64(f, &msg.To)
+		case 4:
+			return setInt64(f, &msg.SequenceNumber)
+		case 5:
+			return setInt64(f, &msg.ViewNumber)
+		case 6:
+			return setString(f, &msg.Digest)
+		case 7:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			member, err := decodeMember(f.data)
+			if err != nil {
+				return err
+			}
+			msg.Members = append(msg.Members, member)
+		case 8:
+			return setInt64(f, &msg.FaultyNodesNum)
+		case 9:
+			if err := f.expect(wireBytes); err != nil {
+				return err
+			}
+			entry, err := decodeCommittedRequest(f.data)
+			if err != nil {
+				return err
+			}
+			msg.History = append(msg.History, entry)
+		case 10:
+			return setInt64(f, &msg.FromSequenceNumber)
+		}
+		return nil
+	})
+}
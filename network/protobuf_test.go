@@ -0,0 +1,300 @@
+package network
+
+import (
+	"bufio"
+	"math/big"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/michael112233/pbft/core"
+)
+
+// The protobuf codec is written by hand, these tests keep it in line with
+// proto/pbft.proto: every registered message must survive a round trip, and
+// its encoding must use exactly the field numbers and wire types the schema
+// declares.
+
+func sampleRequest() *core.RequestMessage {
+	return &core.RequestMessage{
+		Timestamp: 1700000000,
+		From:      9,
+		To:        2,
+		Txs: []*core.Transaction{
+			core.NewTransaction("a1", "a2", big.NewInt(42)),
+			core.NewTransaction("a3", "a4", new(big.Int).Lsh(big.NewInt(1), 80)),
+		},
+		Id: 17,
+		Reconfig: &core.Reconfiguration{
+			Add:            []core.Member{{ID: 4, Addr: "localhost:28400"}},
+			Remove:         []int64{1, 3},
+			FaultyNodesNum: 1,
+		},
+	}
+}
+
+// sampleMessages has a message with every field set per registered id
+func sampleMessages() map[core.MessageID]interface{} {
+	return map[core.MessageID]interface{}{
+		1: sampleRequest(),
+		2: &core.PreprepareMessage{Timestamp: 1, From: 2, To: 3, SequenceNumber: 1004, ViewNumber: 5, Digest: "d1", RequestMessage: sampleRequest()},
+		3: &core.PrepareMessage{Timestamp: 1, From: 2, To: 3, SequenceNumber: 1004, ViewNumber: 5, Digest: "d1", RequestMessage: sampleRequest()},
+		4: &core.CommitMessage{Timestamp: 1, From: 2, To: 3, SequenceNumber: 1004, ViewNumber: 5, Digest: "d1", RequestMessage: sampleRequest()},
+		5: &core.ReplyMessage{Timestamp: 1, From: 2, To: 3, SequenceNumber: 1004, ViewNumber: 5, Digest: "d1", RequestMessage: sampleRequest()},
+		6: &core.CloseMessage{Timestamp: 1, From: 2, To: 3, Operator: "alice", Signature: []byte{0x30, 0x01, 0xff}},
+		7: &core.ViewChangeMessage{Timestamp: 1, From: 2, To: 3, CheckpointSeqNumber: 1000, ViewNumber: 5, CheckpointMsgNumber: 3, HavePreparedList: map[int64]bool{1001: true, 1002: true}},
+		8: &core.CheckpointMessage{Timestamp: 1, From: 2, To: 3, SequenceNumber: 1004, Digest: "d1"},
+		9: &core.StateRequestMessage{Timestamp: 1, From: 2, To: 3, FromSequenceNumber: 1003},
+		10: &core.StateResponseMessage{
+			Timestamp:      1,
+			From:           2,
+			To:             3,
+			SequenceNumber: 1004,
+			ViewNumber:     5,
+			Digest:         "d1",
+			Members:        []core.Member{{ID: 0, Addr: "localhost:28000"}, {ID: 4, Addr: "localhost:28400"}},
+			FaultyNodesNum: 1,
+			History: []*core.CommittedRequest{
+				{SequenceNumber: 1003, ViewNumber: 5, Digest: "d0", RequestMessage: sampleRequest()},
+			},
+			FromSequenceNumber: 1003,
+		},
+		11: &core.HandoffMessage{Timestamp: 1, From: 2, To: 3, SequenceNumber: 1004, ViewNumber: 5, Digest: "d1"},
+	}
+}
+
+// registeredMessages returns every registered message type
+func registeredMessages() []*core.MessageType {
+	types := make([]*core.MessageType, 0)
+	for id := 0; id < 256; id++ {
+		if messageType, ok := core.LookupMessageByID(core.MessageID(id)); ok {
+			types = append(types, messageType)
+		}
+	}
+	return types
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	codec := protobufCodec{}
+	samples := sampleMessages()
+	for _, messageType := range registeredMessages() {
+		sample, ok := samples[messageType.ID]
+		if !ok {
+			t.Errorf("no sample for registered message %s", messageType.Name)
+			continue
+		}
+		body, err := codec.Marshal(sample)
+		if err != nil {
+			t.Fatalf("marshal %s: %v", messageType.Name, err)
+		}
+		decoded := messageType.New()
+		if err := codec.Unmarshal(body, decoded); err != nil {
+			t.Fatalf("unmarshal %s: %v", messageType.Name, err)
+		}
+		if !reflect.DeepEqual(decoded, sample) {
+			t.Errorf("%s changed in a round trip:\n got %+v\nwant %+v", messageType.Name, decoded, sample)
+		}
+	}
+}
+
+// --------------------------------------------------------
+// Schema
+// --------------------------------------------------------
+
+type schemaField struct {
+	name     string
+	typ      string
+	repeated bool
+	// key and value type of a map field
+	mapKey   string
+	mapValue string
+}
+
+// schema maps message name -> field number -> field
+type schema map[string]map[int]schemaField
+
+var (
+	messageLine = regexp.MustCompile(`^message (\w+) \{`)
+	fieldLine   = regexp.MustCompile(`^\s*(repeated\s+)?(map<\s*(\w+)\s*,\s*(\w+)\s*>|\w+)\s+(\w+)\s*=\s*(\d+);`)
+)
+
+func loadSchema(t *testing.T) schema {
+	file, err := os.Open("../proto/pbft.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	s := make(schema)
+	var current string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "//") {
+			continue
+		}
+		if m := messageLine.FindStringSubmatch(line); m != nil {
+			current = m[1]
+			s[current] = make(map[int]schemaField)
+			continue
+		}
+		if strings.HasPrefix(line, "}") {
+			current = ""
+			continue
+		}
+		if m := fieldLine.FindStringSubmatch(line); m != nil && current != "" {
+			number, _ := strconv.Atoi(m[6])
+			field := schemaField{name: m[5], typ: m[2], repeated: m[1] != "", mapKey: m[3], mapValue: m[4]}
+			if field.mapKey != "" {
+				field.typ = "map"
+			}
+			s[current][number] = field
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// wireTypesOf lists the wire types a parser must accept for field
+func wireTypesOf(field schemaField) []int {
+	switch field.typ {
+	case "int64", "int32", "uint64", "uint32", "sint64", "sint32", "bool", "enum":
+		if field.repeated {
+			// proto3 packs repeated scalars, parsers accept them unpacked too
+			return []int{wireBytes, wireVarint}
+		}
+		return []int{wireVarint}
+	case "fixed64", "sfixed64", "double":
+		return []int{wireFixed64}
+	case "fixed32", "sfixed32", "float":
+		return []int{wireFixed32}
+	default:
+		// string, bytes, map and nested messages
+		return []int{wireBytes}
+	}
+}
+
+// checkFields walks an encoded message of the schema message name, recording
+// the field numbers seen in seen[name]
+func (s schema) checkFields(t *testing.T, name string, data []byte, seen map[string]map[int]bool) {
+	fields, ok := s[name]
+	if !ok {
+		t.Errorf("message %s is not in the schema", name)
+		return
+	}
+	if seen[name] == nil {
+		seen[name] = make(map[int]bool)
+	}
+	err := decodeProto(data, func(f protoField) error {
+		field, ok := fields[f.number]
+		if !ok {
+			t.Errorf("%s: encoded field %d is not in the schema", name, f.number)
+			return nil
+		}
+		seen[name][f.number] = true
+		wireOK := false
+		for _, wireType := range wireTypesOf(field) {
+			wireOK = wireOK || wireType == f.wireType
+		}
+		if !wireOK {
+			t.Errorf("%s.%s: encoded with wire type %d, the schema declares %s", name, field.name, f.wireType, field.typ)
+			return nil
+		}
+		switch {
+		case field.typ == "map":
+			entry := "map<" + field.mapKey + "," + field.mapValue + ">"
+			if s[entry] == nil {
+				s[entry] = map[int]schemaField{
+					1: {name: "key", typ: field.mapKey},
+					2: {name: "value", typ: field.mapValue},
+				}
+			}
+			s.checkFields(t, entry, f.data, seen)
+		case s[field.typ] != nil:
+			s.checkFields(t, field.typ, f.data, seen)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+	}
+}
+
+func TestProtobufMatchesSchema(t *testing.T) {
+	s := loadSchema(t)
+	codec := protobufCodec{}
+	samples := sampleMessages()
+	seen := make(map[string]map[int]bool)
+	for _, messageType := range registeredMessages() {
+		sample, ok := samples[messageType.ID]
+		if !ok {
+			t.Errorf("no sample for registered message %s", messageType.Name)
+			continue
+		}
+		body, err := codec.Marshal(sample)
+		if err != nil {
+			t.Fatalf("marshal %s: %v", messageType.Name, err)
+		}
+		// registered names carry a Msg prefix, e.g. MsgRequestMessage
+		s.checkFields(t, strings.TrimPrefix(messageType.Name, "Msg"), body, seen)
+	}
+
+	// every sample sets every field, so each field of the schema must have
+	// been written by the codec
+	for name, fields := range s {
+		if seen[name] == nil {
+			t.Errorf("message %s of the schema is never encoded", name)
+			continue
+		}
+		for number, field := range fields {
+			if !seen[name][number] {
+				t.Errorf("%s.%s = %d of the schema is never encoded", name, field.name, number)
+			}
+		}
+	}
+}
+
+// --------------------------------------------------------
+// Fuzzing
+// --------------------------------------------------------
+
+// FuzzProtobufUnmarshal feeds arbitrary bodies to every registered message,
+// anything the codec accepts must encode and decode to the same message again
+func FuzzProtobufUnmarshal(f *testing.F) {
+	codec := protobufCodec{}
+	samples := sampleMessages()
+	for _, messageType := range registeredMessages() {
+		body, err := codec.Marshal(samples[messageType.ID])
+		if err != nil {
+			f.Fatalf("marshal %s: %v", messageType.Name, err)
+		}
+		f.Add(byte(messageType.ID), body)
+		f.Add(byte(messageType.ID), body[:len(body)/2])
+	}
+	f.Add(byte(1), []byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0x0f})
+	f.Add(byte(1), []byte{0x08, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01})
+
+	types := registeredMessages()
+	f.Fuzz(func(t *testing.T, id byte, body []byte) {
+		messageType := types[int(id)%len(types)]
+		msg := messageType.New()
+		if err := codec.Unmarshal(body, msg); err != nil {
+			return
+		}
+		again, err := codec.Marshal(msg)
+		if err != nil {
+			t.Fatalf("cannot marshal the %s it accepted: %v", messageType.Name, err)
+		}
+		decoded := messageType.New()
+		if err := codec.Unmarshal(again, decoded); err != nil {
+			t.Fatalf("rejects the %s it marshalled: %v", messageType.Name, err)
+		}
+		if !reflect.DeepEqual(decoded, msg) {
+			t.Fatalf("%s changed when marshalled again:\n got %+v\nwant %+v", messageType.Name, decoded, msg)
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// --------------------------------------------------------
+// Minimal Protocol Buffers Wire Encoding
+// --------------------------------------------------------
+
+// Only the parts of the protobuf wire format used by proto/pbft.proto are
+// implemented: varints, length-delimited fields and skipping of fixed-size
+// fields written by newer schema versions.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("protobuf: truncated message")
+
+type protoEncoder struct {
+	buf []byte
+}
+
+func (e *protoEncoder) tag(field int, wireType int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field)<<3|uint64(wireType))
+}
+
+func (e *protoEncoder) int64(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.buf = binary.AppendUvarint(e.buf, uint64(v))
+}
+
+// packedInt64 writes a repeated int64 field in the packed form of proto3,
+// zero elements included.
+func (e *protoEncoder) packedInt64(field int, v []int64) {
+	if len(v) == 0 {
+		return
+	}
+	var packed []byte
+	for _, x := range v {
+		packed = binary.AppendUvarint(packed, uint64(x))
+	}
+	e.tag(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(packed)))
+	e.buf = append(e.buf, packed...)
+}
+
+func (e *protoEncoder) bool(field int, v bool) {
+	if !v {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.buf = append(e.buf, 1)
+}
+
+func (e *protoEncoder) string(field int, v string) {
+	if v == "" {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *protoEncoder) bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// message writes a nested message, even an empty one, so that repeated
+// elements keep their position.
+func (e *protoEncoder) message(field int, encode func(*protoEncoder)) {
+	var nested protoEncoder
+	encode(&nested)
+	e.tag(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(nested.buf)))
+	e.buf = append(e.buf, nested.buf...)
+}
+
+// protoField is one decoded field. For varints value holds the number, for
+// length-delimited fields data holds the payload.
+type protoField struct {
+	number   int
+	wireType int
+	value    uint64
+	data     []byte
+}
+
+// decodeProto calls fn for every field of a message in wire order.
+func decodeProto(b []byte, fn func(protoField) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+		field := protoField{
+			number:   int(key >> 3),
+			wireType: int(key & 7),
+		}
+		if field.number <= 0 {
+			return fmt.Errorf("protobuf: invalid field number %d", field.number)
+		}
+
+		switch field.wireType {
+		case wireVarint:
+			field.value, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			field.value = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			field.value = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return errTruncated
+			}
+			field.data = b[n : n+int(length)]
+			b = b[n+int(length):]
+		default:
+			return fmt.Errorf("protobuf: unsupported wire type %d", field.wireType)
+		}
+
+		if err := fn(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// int64s returns the elements of a repeated int64 field, which parsers must
+// accept both packed and as a single unpacked element.
+func (f protoField) int64s() ([]int64, error) {
+	switch f.wireType {
+	case wireVarint:
+		return []int64{int64(f.value)}, nil
+	case wireBytes:
+		var v []int64
+		for b := f.data; len(b) > 0; {
+			x, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, errTruncated
+			}
+			v = append(v, int64(x))
+			b = b[n:]
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("protobuf: field %d has wire type %d, expected a repeated int64", f.number, f.wireType)
+	}
+}
+
+// expect checks that a known field arrived with the wire type of the schema.
+func (f protoField) expect(wireType int) error {
+	if f.wireType != wireType {
+		return fmt.Errorf("protobuf: field %d has wire type %d, expected %d", f.number, f.wireType, wireType)
+	}
+	return nil
+}
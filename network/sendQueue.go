@@ -0,0 +1,80 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+)
+
+// OverflowPolicy decides what happens when a message is sent to a peer whose
+// outbound queue is already full.
+type OverflowPolicy string
+
+const (
+	// PolicyDropOldest discards the oldest queued message to make room.
+	PolicyDropOldest OverflowPolicy = "drop_oldest"
+	// PolicyBlock makes the sender wait until the writer frees a slot. The
+	// message is dropped instead once the peer is unreachable. A slow but
+	// reachable peer stalls the sender, so it is only used when configured.
+	PolicyBlock OverflowPolicy = "block"
+	// PolicyDisconnect drops the connection and every queued message of the peer.
+	PolicyDisconnect OverflowPolicy = "disconnect"
+)
+
+func ParseOverflowPolicy(policy string) (OverflowPolicy, error) {
+	switch OverflowPolicy(policy) {
+	case PolicyDropOldest, PolicyBlock, PolicyDisconnect:
+		return OverflowPolicy(policy), nil
+	case "":
+		return PolicyDropOldest, nil
+	default:
+		return "", fmt.Errorf("unknown send queue policy %q (expected drop_oldest, block or disconnect)", policy)
+	}
+}
+
+type QueueConfig struct {
+	Size   int
+	Policy OverflowPolicy
+}
+
+// QueueStats is a snapshot of the outbound queue of one peer.
+type QueueStats struct {
+	Addr      string
+	Depth     int
+	Capacity  int
+	MaxDepth  int64
+	Sent      int64
+	Dropped   int64
+	Connected bool
+}
+
+func (s QueueStats) String() string {
+	return fmt.Sprintf("peer=%s depth=%d/%d max_depth=%d sent=%d dropped=%d connected=%v", s.Addr, s.Depth, s.Capacity, s.MaxDepth, s.Sent, s.Dropped, s.Connected)
+}
+
+// Stats returns the queue statistics of every known peer ordered by address.
+func (cm *ConnManager) Stats() []QueueStats {
+	cm.mu.Lock()
+	peers := make([]*peer, 0, len(cm.peers))
+	for _, p := range cm.peers {
+		peers = append(peers, p)
+	}
+	cm.mu.Unlock()
+
+	stats := make([]QueueStats, 0, len(peers))
+	for _, p := range peers {
+		p.connLock.Lock()
+		connected := p.conn != nil
+		p.connLock.Unlock()
+		stats = append(stats, QueueStats{
+			Addr:      p.addr,
+			Depth:     len(p.queue),
+			Capacity:  cap(p.queue),
+			MaxDepth:  p.maxDepth.Load(),
+			Sent:      p.sent.Load(),
+			Dropped:   p.dropped.Load(),
+			Connected: connected,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
@@ -0,0 +1,280 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// --------------------------------------------------------
+// Transport Identities
+// --------------------------------------------------------
+
+// Every certificate carries the identity of its owner as common name, so a
+// connection can be tied to the replica (or client) that opened it.
+const (
+	caName       = "ca"
+	certValidity = 10 * 365 * 24 * time.Hour
+	// handshakeTimeout bounds how long an accepted connection may take to
+	// present its certificate before its handler gives up on it
+	handshakeTimeout = 5 * time.Second
+)
+
+func certFile(dir string, identity string) string {
+	return filepath.Join(dir, identity+".pem")
+}
+
+func keyFile(dir string, identity string) string {
+	return filepath.Join(dir, identity+".key")
+}
+
+// TLSIdentity holds the certificate of the local process and the CA every peer certificate must chain to.
+type TLSIdentity struct {
+	Identity string
+	cert     tls.Certificate
+	pool     *x509.CertPool
+	// identity -> certificate the peer must present exactly
+	pinned map[string]*x509.Certificate
+}
+
+// LoadTLSIdentity loads <dir>/ca.pem and <dir>/<identity>.pem/.key.
+func LoadTLSIdentity(dir string, identity string) (*TLSIdentity, error) {
+	caPEM, err := os.ReadFile(certFile(dir, caName))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no CA certificate found in %s", certFile(dir, caName))
+	}
+	cert, err := tls.LoadX509KeyPair(certFile(dir, identity), keyFile(dir, identity))
+	if err != nil {
+		return nil, err
+	}
+	return &TLSIdentity{
+		Identity: identity,
+		cert:     cert,
+		pool:     pool,
+		pinned:   make(map[string]*x509.Certificate),
+	}, nil
+}
+
+// Pin requires identity to present exactly the certificate stored in path,
+// on top of being signed by the CA.
+func (t *TLSIdentity) Pin(identity string, path string) error {
+	certPEM, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("no certificate found in %s", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	t.pinned[identity] = cert
+	return nil
+}
+
+func (t *TLSIdentity) checkPinned(identity string, cert *x509.Certificate) error {
+	pinned, ok := t.pinned[identity]
+	if ok && !bytes.Equal(pinned.Raw, cert.Raw) {
+		return fmt.Errorf("identity %q presented a certificate different from its pinned public key", identity)
+	}
+	return nil
+}
+
+// Listen opens a TLS listener that requires a client certificate signed by the CA.
+func (t *TLSIdentity) Listen(addr string) (net.Listener, error) {
+	return tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{t.cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    t.pool,
+		MinVersion:   tls.VersionTLS12,
+	})
+}
+
+// Dialer returns a dialer that only accepts a server presenting the identity
+// expected(addr) returns for the dialed address.
+func (t *TLSIdentity) Dialer(expected func(addr string) string) Dialer {
+	return func(addr string) (net.Conn, error) {
+		want := expected(addr)
+		if want == "" {
+			return nil, fmt.Errorf("no known identity for %s", addr)
+		}
+		dialer := &net.Dialer{Timeout: dialTimeout}
+		return tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+			Certificates: []tls.Certificate{t.cert},
+			RootCAs:      t.pool,
+			MinVersion:   tls.VersionTLS12,
+			// the identity is checked instead of the host name, so replicas can be reached by any address
+			InsecureSkipVerify: true,
+			VerifyConnection: func(state tls.ConnectionState) error {
+				if err := verifyPeer(state, t.pool, want); err != nil {
+					return err
+				}
+				return t.checkPinned(want, state.PeerCertificates[0])
+			},
+		})
+	}
+}
+
+func verifyPeer(state tls.ConnectionState, pool *x509.CertPool, want string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := state.PeerCertificates[0]
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return err
+	}
+	if leaf.Subject.CommonName != want {
+		return fmt.Errorf("peer presented identity %q, expected %q", leaf.Subject.CommonName, want)
+	}
+	return nil
+}
+
+// PeerIdentity completes the handshake of an accepted connection and returns
+// the identity of the verified client certificate. Plain TCP connections have
+// no identity and return an empty string, also on a nil TLSIdentity. A peer
+// that does not finish the handshake within handshakeTimeout is rejected.
+func (t *TLSIdentity) PeerIdentity(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := tlsConn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return "", err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	if err := tlsConn.SetDeadline(time.Time{}); err != nil {
+		return "", err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("peer presented no certificate")
+	}
+	identity := certs[0].Subject.CommonName
+	if err := t.checkPinned(identity, certs[0]); err != nil {
+		return "", err
+	}
+	return identity, nil
+}
+
+// --------------------------------------------------------
+// Local CA Generation
+// --------------------------------------------------------
+
+// GenerateCertificates creates a CA in dir and signs one certificate per
+// identity, valid for the given host names or IP addresses.
+func GenerateCertificates(dir string, identities map[string][]string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          newSerial(),
+		Subject:               pkix.Name{CommonName: "pbft-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(certValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(certFile(dir, caName), "CERTIFICATE", caDER, 0644); err != nil {
+		return err
+	}
+	if err := writeKey(keyFile(dir, caName), caKey); err != nil {
+		return err
+	}
+
+	for identity, hosts := range identities {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		template := &x509.Certificate{
+			SerialNumber: newSerial(),
+			Subject:      pkix.Name{CommonName: identity},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(certValidity),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			// replicas act as TLS server and client towards each other
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		for _, host := range hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		if err := writePEM(certFile(dir, identity), "CERTIFICATE", der, 0644); err != nil {
+			return err
+		}
+		if err := writeKey(keyFile(dir, identity), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "EC PRIVATE KEY", der, 0600)
+}
+
+func writePEM(path string, blockType string, der []byte, perm os.FileMode) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
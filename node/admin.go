@@ -0,0 +1,310 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/michael112233/pbft/config"
+	"github.com/michael112233/pbft/core"
+)
+
+// --------------------------------------------------------
+// Admin API
+// --------------------------------------------------------
+
+// PeerStatus is the connection of a replica to another member
+type PeerStatus struct {
+	ID         int64  `json:"id"`
+	Addr       string `json:"addr"`
+	Connected  bool   `json:"connected"`
+	QueueDepth int    `json:"queue_depth"`
+	Sent       int64  `json:"sent"`
+	Dropped    int64  `json:"dropped"`
+}
+
+type Status struct {
+	NodeID           int64        `json:"node_id"`
+	View             int64        `json:"view"`
+	Primary          int64        `json:"primary"`
+	Members          []int64      `json:"members"`
+	Joining          bool         `json:"joining"`
+	Paused           bool         `json:"paused"`
+	InViewChange     bool         `json:"in_view_change"`
+	LastPreprepared  int64        `json:"last_preprepared"`
+	LastPrepared     int64        `json:"last_prepared"`
+	LastCommitted    int64        `json:"last_committed"`
+	StableCheckpoint int64        `json:"stable_checkpoint"`
+	PendingRequests  int          `json:"pending_requests"`
+	Peers            []PeerStatus `json:"peers"`
+}
+
+// VoteStatus lists who voted for a digest at a sequence number
+type VoteStatus struct {
+	Seq    int64   `json:"seq"`
+	Digest string  `json:"digest"`
+	Voters []int64 `json:"voters"`
+}
+
+// Dump is the status together with the protocol state a replica keeps for
+// the sequence numbers after its stable checkpoint
+type Dump struct {
+	Status
+	FirstSeq         int64            `json:"first_seq"`
+	Digests          map[int64]string `json:"digests"`
+	Prepared         []int64          `json:"prepared"`
+	Certified        []int64          `json:"certified"`
+	PrepareVotes     []VoteStatus     `json:"prepare_votes"`
+	CommitVotes      []VoteStatus     `json:"commit_votes"`
+	CheckpointVotes  []VoteStatus     `json:"checkpoint_votes"`
+	History          int              `json:"history"`
+	PendingReconfigs int              `json:"pending_reconfigs"`
+	Buffered         int              `json:"buffered"`
+	EarlyPreprepares []int64          `json:"early_preprepares"`
+	ExpireTimers     []string         `json:"expire_timers"`
+}
+
+type adminServer struct {
+	server *http.Server
+}
+
+// startAdmin serves the admin API on the port of the node plus
+// admin_port_offset:
+//
+//	GET  /status       view, primary, sequence numbers, checkpoint and peers
+//	GET  /dump         the status and the per sequence number protocol state
+//	POST /pause        stop handling messages, they wait in the connections
+//	POST /resume       handle messages again
+//	POST /shutdown     drain and stop the node, like a close message
+//
+// Every request but GET /status must be signed by an operator. There is no
+// request to trigger a view change, a replica could leave its view but not
+// install the next one until new view messages exist.
+func (n *Node) startAdmin() {
+	if n.cfg.AdminPortOffset == 0 {
+		return
+	}
+	addr, err := config.AdminAddrOf(n.GetAddr(), n.cfg.AdminPortOffset)
+	if err != nil {
+		n.log.Error("failed to serve admin API: %v", err)
+		return
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		n.log.Error("failed to serve admin API: %v", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", n.adminHandler(http.MethodGet, false, func(string) (interface{}, error) {
+		var status Status
+		n.withState(func() { status = n.status() })
+		return status, nil
+	}))
+	mux.HandleFunc("/dump", n.adminHandler(http.MethodGet, true, func(string) (interface{}, error) {
+		var dump Dump
+		n.withState(func() { dump = n.dump() })
+		return dump, nil
+	}))
+	mux.HandleFunc("/pause", n.adminHandler(http.MethodPost, true, func(string) (interface{}, error) {
+		n.Pause()
+		return map[string]bool{"paused": true}, nil
+	}))
+	mux.HandleFunc("/resume", n.adminHandler(http.MethodPost, true, func(string) (interface{}, error) {
+		n.Resume()
+		return map[string]bool{"paused": false}, nil
+	}))
+	mux.HandleFunc("/shutdown", n.adminHandler(http.MethodPost, true, func(requester string) (interface{}, error) {
+		n.RequestStop("admin API request of " + requester)
+		return map[string]bool{"stopping": true}, nil
+	}))
+
+	n.admin = &adminServer{server: &http.Server{Handler: mux}}
+	go func() {
+		if err := n.admin.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			n.log.Error("admin server stopped: %v", err)
+		}
+	}()
+	n.log.Info("serving admin API on http://%s", ln.Addr())
+}
+
+func (s *adminServer) Close() {
+	if s == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.server.Shutdown(ctx)
+}
+
+// adminHandler answers requests with method by the JSON of handle. A signed
+// request must carry the signature of an operator, handle gets who sent it:
+// the operator or else the remote address.
+func (n *Node) adminHandler(method string, signed bool, handle func(requester string) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("%s needs %s", r.URL.Path, method)})
+			return
+		}
+		requester := r.RemoteAddr
+		if signed {
+			operator, err := n.operators.VerifyAdminRequest(r, n.NodeID)
+			if err != nil {
+				n.log.Warn("Rejected admin request %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+			requester = "operator " + operator
+			n.log.Info("Received admin request %s from %s", r.URL.Path, requester)
+		}
+		result, err := handle(requester)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			result = map[string]string{"error": err.Error()}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	}
+}
+
+// --------------------------------------------------------
+// Pause and Resume
+// --------------------------------------------------------
+
+// Pause holds handleMessageLock until Resume, every handler blocks and the
+// messages wait in the connections. Timers keep running.
+func (n *Node) Pause() {
+	n.adminLock.Lock()
+	defer n.adminLock.Unlock()
+	if n.paused {
+		return
+	}
+	n.handleMessageLock.Lock()
+	n.paused = true
+	n.log.Info("Node %d paused", n.NodeID)
+}
+
+func (n *Node) Resume() {
+	n.adminLock.Lock()
+	defer n.adminLock.Unlock()
+	if !n.paused {
+		return
+	}
+	n.paused = false
+	n.handleMessageLock.Unlock()
+	n.log.Info("Node %d resumed", n.NodeID)
+}
+
+// withState runs f with the protocol state to itself, either by taking
+// handleMessageLock or because a pause already holds it
+func (n *Node) withState(f func()) {
+	n.adminLock.Lock()
+	defer n.adminLock.Unlock()
+	if !n.paused {
+		n.handleMessageLock.Lock()
+		defer n.handleMessageLock.Unlock()
+	}
+	f()
+}
+
+// --------------------------------------------------------
+// State Snapshots
+// --------------------------------------------------------
+
+func (n *Node) status() Status {
+	status := Status{
+		NodeID:           n.NodeID,
+		View:             n.viewNumber,
+		Primary:          n.primaryOf(n.GetPreprepareSequenceNumber() + 1),
+		Members:          config.Members(),
+		Joining:          n.joining,
+		Paused:           n.paused,
+		InViewChange:     n.viewChange.IsInViewChange(),
+		LastPreprepared:  n.GetPreprepareSequenceNumber(),
+		LastPrepared:     n.GetPrepareSequenceNumber(),
+		LastCommitted:    n.GetCommitSequenceNumber(),
+		StableCheckpoint: n.lastStableCheckpoint,
+		PendingRequests:  len(n.pendingRequests),
+		Peers:            make([]PeerStatus, 0),
+	}
+	queues := make(map[string]PeerStatus)
+	if n.messageHub.conns != nil {
+		for _, stats := range n.messageHub.conns.Stats() {
+			queues[stats.Addr] = PeerStatus{Connected: stats.Connected, QueueDepth: stats.Depth, Sent: stats.Sent, Dropped: stats.Dropped}
+		}
+	}
+	for _, id := range n.peers() {
+		addr, _ := config.NodeAddrOf(id)
+		peer := queues[addr]
+		peer.ID, peer.Addr = id, addr
+		status.Peers = append(status.Peers, peer)
+	}
+	return status
+}
+
+func (n *Node) dump() Dump {
+	dump := Dump{
+		Status:           n.status(),
+		FirstSeq:         n.firstSeqNumber,
+		Digests:          make(map[int64]string),
+		Prepared:         make([]int64, 0),
+		Certified:        make([]int64, 0),
+		PrepareVotes:     voteStatuses(n.prepareVotes),
+		CommitVotes:      voteStatuses(n.commitVotes),
+		CheckpointVotes:  voteStatuses(n.checkpointVotes),
+		History:          len(n.history),
+		PendingReconfigs: len(n.pendingReconfigs),
+		Buffered:         len(n.buffered),
+		EarlyPreprepares: make([]int64, 0),
+		ExpireTimers:     make([]string, 0),
+	}
+	for seq := n.lastStableCheckpoint; seq <= n.GetPreprepareSequenceNumber(); seq++ {
+		if digest := n.seq2digest[seq]; digest != "" {
+			dump.Digests[seq] = digest
+		}
+	}
+	for seq, prepared := range n.prepared {
+		if prepared {
+			dump.Prepared = append(dump.Prepared, seq)
+		}
+	}
+	for seq := range n.certified {
+		dump.Certified = append(dump.Certified, seq)
+	}
+	for seq := range n.earlyPreprepares {
+		dump.EarlyPreprepares = append(dump.EarlyPreprepares, seq)
+	}
+	n.timerLock.RLock()
+	for id := range n.expireTimers {
+		dump.ExpireTimers = append(dump.ExpireTimers, id)
+	}
+	n.timerLock.RUnlock()
+	for _, seqs := range [][]int64{dump.Prepared, dump.Certified, dump.EarlyPreprepares} {
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	}
+	sort.Strings(dump.ExpireTimers)
+	return dump
+}
+
+func voteStatuses(votes map[voteKey]*core.VoteSet) []VoteStatus {
+	statuses := make([]VoteStatus, 0, len(votes))
+	for key, set := range votes {
+		statuses = append(statuses, VoteStatus{Seq: key.seq, Digest: key.digest, Voters: set.Voters()})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Seq != statuses[j].Seq {
+			return statuses[i].Seq < statuses[j].Seq
+		}
+		return statuses[i].Digest < statuses[j].Digest
+	})
+	return statuses
+}
@@ -2,11 +2,10 @@ package node
 
 import (
 	"fmt"
-	"sync/atomic"
 	"time"
 
-	"github.com/michael112233/pbft/config"
 	"github.com/michael112233/pbft/core"
+	"github.com/michael112233/pbft/ledger"
 )
 
 // --------------------------------------------------------
@@ -15,54 +14,88 @@ import (
 
 func (n *Node) StartGarbageCollection() {
 	n.lastStableCheckpoint = -1
-	n.checkpointList = make(map[int64]*atomic.Int32)
-	for i := int64(n.cfg.SeqNumberLowerBound); i <= int64(n.cfg.SeqNumberUpperBound); i++ {
-		n.checkpointList[i] = &atomic.Int32{}
-		n.checkpointList[i].Store(0)
-	}
+	n.checkpointVotes = make(map[voteKey]*core.VoteSet)
+}
+
+// isCheckpoint reports whether a checkpoint is taken after committing seqNumber,
+// counted from the first sequence number of the run so that every replica
+// takes the same checkpoints
+func (n *Node) isCheckpoint(seqNumber int64) bool {
+	return (seqNumber-n.firstSeqNumber)%n.cfg.CheckpointInterval == 0
 }
 
 func (n *Node) TriggerGarbageCollection(seqNumber int64, digest string) {
 	n.log.Info(fmt.Sprintf("Check whether it is time to trigger garbage collection for sequence number %d", seqNumber))
-	if (seqNumber-n.initCommitSeqNumber)%n.cfg.CheckpointInterval != 0 {
+	if !n.isCheckpoint(seqNumber) {
 		return
 	}
 	n.log.Info(fmt.Sprintf("Trigger garbage collection for sequence number %d", seqNumber))
-	n.checkpointList[seqNumber].Add(1)
+	votesOf(n.checkpointVotes, seqNumber, digest).Add(n.NodeID)
 	n.SendCheckpointMessage(seqNumber, digest)
+	// checkpoint messages of the others may have arrived before this replica committed
+	n.checkStableCheckpoint(seqNumber, digest)
 }
 
 func (n *Node) SendCheckpointMessage(sequenceNumber int64, digest string) {
-	for _, othersIp := range config.NodeAddr {
-		if othersIp == n.GetAddr() {
-			continue
-		}
+	for _, othersID := range n.peers() {
 		// TODO: the sequence number should be the last sequence number of the block committed on the blockchain
 		checkpointMessage := core.CheckpointMessage{
 			Timestamp:      time.Now().Unix(),
-			From:           n.GetAddr(),
-			To:             othersIp,
+			From:           n.NodeID,
+			To:             othersID,
 			SequenceNumber: sequenceNumber,
 			Digest:         digest,
 		}
-		n.log.Info(fmt.Sprintf("Send checkpoint message to %s", othersIp))
-		n.messageHub.Send(core.MsgCheckpointMessage, othersIp, checkpointMessage, nil)
+		n.log.Info(fmt.Sprintf("Send checkpoint message to node %d", othersID))
+		n.messageHub.Send(core.MsgCheckpointMessage, othersID, checkpointMessage, nil)
 	}
 }
 
 func (n *Node) HandleCheckpointMessage(data core.CheckpointMessage) {
 	n.handleMessageLock.Lock()
 	defer n.handleMessageLock.Unlock()
-	n.log.Info(fmt.Sprintf("Received checkpoint message from %s, sequence number %d", data.From, data.SequenceNumber))
+	log := n.msgLog(core.MsgCheckpointMessage, data.SequenceNumber, n.viewNumber, data.From)
+	if n.bufferWhileJoining(data.SequenceNumber, func() { n.HandleCheckpointMessage(data) }) {
+		return
+	}
+	log.Info(fmt.Sprintf("Received checkpoint message from %d, sequence number %d", data.From, data.SequenceNumber))
+	if data.SequenceNumber < n.cfg.SeqNumberLowerBound || data.SequenceNumber > n.cfg.SeqNumberUpperBound {
+		log.Error(fmt.Sprintf("Checkpoint message sequence number out of range. from %d, sequence number %d", data.From, data.SequenceNumber))
+		return
+	}
 
-	n.checkpointList[data.SequenceNumber].Add(1)
+	if data.SequenceNumber <= n.lastStableCheckpoint {
+		return
+	}
+	if n.seq2digest[data.SequenceNumber] != "" && data.Digest != n.seq2digest[data.SequenceNumber] {
+		log.Error(fmt.Sprintf("Checkpoint message digest mismatch. from %d, sequence number %d", data.From, data.SequenceNumber))
+		return
+	}
+	if !votesOf(n.checkpointVotes, data.SequenceNumber, data.Digest).Add(data.From) {
+		log.Error(fmt.Sprintf("Duplicate checkpoint message from %d, sequence number %d", data.From, data.SequenceNumber))
+		return
+	}
+	n.checkStableCheckpoint(data.SequenceNumber, data.Digest)
+}
 
-	if data.Digest != n.seq2digest[data.SequenceNumber] {
-		n.log.Error(fmt.Sprintf("Checkpoint message digest mismatch. from %s, sequence number %d", data.From, data.SequenceNumber))
+// checkStableCheckpoint makes a checkpoint stable once this replica committed
+// the same digest and the checkpoint votes carry a quorum of the voting weight
+func (n *Node) checkStableCheckpoint(seqNumber int64, digest string) {
+	if n.seq2digest[seqNumber] != digest || seqNumber <= n.lastStableCheckpoint {
 		return
 	}
-	if n.checkpointList[data.SequenceNumber].Load() == int32(2*n.cfg.FaultyNodesNum+1) {
-		n.lastStableCheckpoint = data.SequenceNumber
-		n.log.Debug(fmt.Sprintf("Node %d last stable checkpoint is %d", n.NodeID, n.lastStableCheckpoint))
+	if !votesOf(n.checkpointVotes, seqNumber, digest).Complete(n.quorum()) {
+		return
 	}
+	n.lastStableCheckpoint = seqNumber
+	stableCheckpoint.Set(seqNumber)
+	n.log.Debug(fmt.Sprintf("Node %d last stable checkpoint is %d", n.NodeID, n.lastStableCheckpoint))
+	n.appendLedger(ledger.Record{
+		Kind:      ledger.KindCheckpoint,
+		Seq:       seqNumber,
+		View:      n.viewNumber,
+		Digest:    digest,
+		Timestamp: time.Now().Unix(),
+	})
+	n.pruneVotes(seqNumber)
 }
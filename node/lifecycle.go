@@ -0,0 +1,101 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/michael112233/pbft/config"
+)
+
+// --------------------------------------------------------
+// Lifecycle
+// --------------------------------------------------------
+
+// drainQuiet is how long no message may arrive before a drained replica
+// stops, a slower replica may still be voting on the last sequence number
+const drainQuiet = time.Second
+
+// RequestStop makes Run shut the node down, it never blocks and only the
+// first reason is kept
+func (n *Node) RequestStop(reason string) {
+	n.stopOnce.Do(func() {
+		n.stopReason = reason
+		close(n.done)
+	})
+}
+
+// Done is closed once a stop was requested
+func (n *Node) Done() <-chan struct{} {
+	return n.done
+}
+
+// Run starts the node and blocks until ctx is cancelled or a stop is
+// requested by a close message, the admin API or a reconfiguration, then
+// shuts it down. It returns an error if the node could not start or did not
+// drain within shutdown_timeout.
+func (n *Node) Run(ctx context.Context) error {
+	if err := n.Start(); err != nil {
+		n.Stop(0)
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		n.RequestStop("signal")
+	case <-n.done:
+	}
+	n.log.Info("Node %d stopping: %s", n.NodeID, n.stopReason)
+	return n.Shutdown(time.Duration(n.cfg.ShutdownTimeout) * time.Second)
+}
+
+// Shutdown waits up to timeout for the consensus instances in flight, then
+// stops the node with the rest of timeout to flush its send queues
+func (n *Node) Shutdown(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	n.Resume()
+	err := n.drain(deadline)
+	if err != nil {
+		n.log.Warn("%v", err)
+	}
+	n.Stop(time.Until(deadline))
+	return err
+}
+
+// drain returns once every pre-prepared sequence number has been executed
+// and no message arrived for drainQuiet. A replica removed from the set has
+// nothing left to vote on.
+func (n *Node) drain(deadline time.Time) error {
+	if !config.IsMember(n.NodeID) {
+		return nil
+	}
+	for {
+		var inFlight int64
+		n.withState(func() { inFlight = n.inFlight() })
+		quiet := time.Since(time.Unix(0, n.lastMessageAt.Load())) >= drainQuiet
+		if inFlight == 0 && quiet {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d consensus instances still in flight at shutdown, last committed sequence number %d", inFlight, n.GetCommitSequenceNumber())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// inFlight counts the sequence numbers pre-prepared or proposed but not
+// executed and the requests a rotating primary has not proposed yet
+func (n *Node) inFlight() int64 {
+	last := n.GetPreprepareSequenceNumber()
+	if sequenceNumber > last {
+		// the primary does not pre-prepare its own proposals
+		last = sequenceNumber
+	}
+	inFlight := last - n.GetCommitSequenceNumber()
+	if n.GetCommitSequenceNumber() == -1 && n.firstSeqNumber != -1 {
+		inFlight = last - n.firstSeqNumber + 1
+	}
+	if inFlight < 0 {
+		inFlight = 0
+	}
+	return inFlight + int64(len(n.pendingRequests))
+}
@@ -0,0 +1,41 @@
+package node
+
+import (
+	"github.com/michael112233/pbft/config"
+	"github.com/michael112233/pbft/metrics"
+)
+
+// --------------------------------------------------------
+// Metrics
+// --------------------------------------------------------
+
+var (
+	committedBlocks  = metrics.Counter("pbft_committed_blocks_total", "Blocks executed by this replica.")
+	committedTxs     = metrics.Counter("pbft_committed_txs_total", "Transactions executed by this replica.")
+	viewChanges      = metrics.Counter("pbft_view_changes_total", "View changes triggered by an expired request timer.")
+	currentView      = metrics.Gauge("pbft_view", "Current view of this replica.")
+	stableCheckpoint = metrics.Gauge("pbft_stable_checkpoint", "Sequence number of the last stable checkpoint, -1 before the first one.")
+	lastCommitted    = metrics.Gauge("pbft_last_committed_seq", "Sequence number of the last executed block, -1 before the first one.")
+	queuedRequests   = metrics.Gauge("pbft_pending_requests", "Client requests queued until this replica becomes primary.")
+)
+
+// startMetrics serves /metrics next to the address of the replica unless metrics are disabled
+func (n *Node) startMetrics() {
+	for _, counter := range []*metrics.Family{committedBlocks, committedTxs, viewChanges} {
+		counter.Add(0)
+	}
+	queuedRequests.Set(0)
+	currentView.Set(n.viewNumber)
+	stableCheckpoint.Set(n.lastStableCheckpoint)
+	lastCommitted.Set(n.GetCommitSequenceNumber())
+	if n.cfg.MetricsPortOffset == 0 {
+		return
+	}
+	addr, err := config.MetricsAddrOf(n.GetAddr(), n.cfg.MetricsPortOffset)
+	if err == nil {
+		n.metrics, err = metrics.Serve(addr, n.log)
+	}
+	if err != nil {
+		n.log.Error("failed to serve metrics: %v", err)
+	}
+}
@@ -1,58 +1,86 @@
 package node
 
 import (
+	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/michael112233/pbft/config"
+	"github.com/michael112233/pbft/core"
+	"github.com/michael112233/pbft/ledger"
 	"github.com/michael112233/pbft/logger"
+	"github.com/michael112233/pbft/metrics"
+	"github.com/michael112233/pbft/network"
+	"github.com/michael112233/pbft/result"
 )
 
 type Node struct {
 	NodeID                  int64
 	viewNumber              int64
-	prepareMsgNumber        map[int64]*atomic.Int32
-	commitMsgNumber         map[int64]*atomic.Int32
+	prepareVotes            map[voteKey]*core.VoteSet
+	commitVotes             map[voteKey]*core.VoteSet
+	checkpointVotes         map[voteKey]*core.VoteSet
+	prepared                map[int64]bool
+	certified               map[int64]core.CommitMessage
+	phases                  map[int64]*phaseTimes
+	firstSeqNumber          int64
 	lastPreprepareSeqNumber int64
 	lastPrepareSeqNumber    int64
 	lastCommitSeqNumber     int64
-	initCommitSeqNumber     int64
 	lastStableCheckpoint    int64
-	checkpointList          map[int64]*atomic.Int32
 	seq2digest              map[int64]string
+	history                 []*core.CommittedRequest
+	pendingReconfigs        []pendingReconfig
+	membershipSeq           int64
+	joining                 bool
+	stateVotes              map[string]map[int64]bool
+	stateFrom               int64
+	stateHistory            []*core.CommittedRequest
+	buffered                []bufferedMessage
+	pendingRequests         []core.RequestMessage
+	seenRequests            map[string]bool
+	earlyPreprepares        map[int64]core.PreprepareMessage
+	lastPreprepareDigest    string
+	handoffSeq              int64
+	handoffDigest           string
 	preprepareSeqLock       sync.Mutex
 	prepareSeqLock          sync.Mutex
 	commitSeqLock           sync.Mutex
-	PrepareMessageLock      sync.Mutex
-	CommitMessageLock       sync.Mutex
 
 	cfg        *config.Config
 	log        *logger.Logger
 	messageHub *NodeMessageHub
 	viewChange *ViewChanger
+	ledger     *ledger.Writer
+	metrics    *metrics.Server
+	admin      *adminServer
+	// operators may stop and steer the node, nil rejects every close message and signed admin request
+	operators *network.Operators
 
 	expireTimers      map[string]*time.Timer
 	expireLock        sync.RWMutex
 	timerLock         sync.RWMutex
 	handleMessageLock sync.Mutex
-
-	StopChan chan struct{}
+	// paused is set while the admin API holds handleMessageLock
+	paused    bool
+	adminLock sync.Mutex
+
+	// done is closed by RequestStop, lastMessageAt is when the last message
+	// was handled, in unix nanoseconds
+	done          chan struct{}
+	stopOnce      sync.Once
+	stopReason    string
+	lastMessageAt atomic.Int64
 }
 
-func NewNode(nodeID int64, cfg *config.Config) *Node {
-	prepareMsgNumber := make(map[int64]*atomic.Int32, cfg.SeqNumberUpperBound)
-	for i := cfg.SeqNumberLowerBound; i <= cfg.SeqNumberUpperBound; i++ {
-		prepareMsgNumber[int64(i)] = &atomic.Int32{}
-		prepareMsgNumber[int64(i)].Store(0)
-	}
-
-	commitMsgNumber := make(map[int64]*atomic.Int32, cfg.SeqNumberUpperBound)
-	for i := cfg.SeqNumberLowerBound; i <= cfg.SeqNumberUpperBound; i++ {
-		commitMsgNumber[int64(i)] = &atomic.Int32{}
-		commitMsgNumber[int64(i)].Store(0)
+// NewNode fails if the election method of cfg is unknown
+func NewNode(nodeID int64, cfg *config.Config) (*Node, error) {
+	viewChange, err := NewViewChanger(cfg)
+	if err != nil {
+		return nil, err
 	}
-
 	seq2digest := make(map[int64]string, cfg.SeqNumberUpperBound)
 	for i := cfg.SeqNumberLowerBound; i <= cfg.SeqNumberUpperBound; i++ {
 		seq2digest[int64(i)] = ""
@@ -61,40 +89,86 @@ func NewNode(nodeID int64, cfg *config.Config) *Node {
 	return &Node{
 		NodeID:                  nodeID,
 		viewNumber:              0,
-		prepareMsgNumber:        prepareMsgNumber,
-		commitMsgNumber:         commitMsgNumber,
+		prepareVotes:            make(map[voteKey]*core.VoteSet),
+		commitVotes:             make(map[voteKey]*core.VoteSet),
+		prepared:                make(map[int64]bool),
+		certified:               make(map[int64]core.CommitMessage),
+		phases:                  make(map[int64]*phaseTimes),
+		firstSeqNumber:          -1,
 		seq2digest:              seq2digest,
-		initCommitSeqNumber:     -1,
 		lastPreprepareSeqNumber: -1,
 		lastPrepareSeqNumber:    -1,
 		lastCommitSeqNumber:     -1,
+		membershipSeq:           -1,
+		stateVotes:              make(map[string]map[int64]bool),
+		seenRequests:            make(map[string]bool),
+		earlyPreprepares:        make(map[int64]core.PreprepareMessage),
+		handoffSeq:              -1,
 		cfg:                     cfg,
 		log:                     logger.NewLogger(nodeID, "node"),
 		messageHub:              NewNodeMessageHub(),
 		expireTimers:            make(map[string]*time.Timer),
-		viewChange:              NewViewChanger(cfg),
-		StopChan:                make(chan struct{}),
-	}
+		viewChange:              viewChange,
+		done:                    make(chan struct{}),
+	}, nil
 }
 
-func (n *Node) Start() {
-	n.messageHub.Start(n, &sync.WaitGroup{})
+// Start opens the ledger, the metrics and admin servers and starts listening,
+// Run calls it
+func (n *Node) Start() error {
+	if names := n.cfg.OperatorNames(); len(names) > 0 {
+		operators, err := network.LoadOperators(n.cfg.TLSDir, names)
+		if err != nil {
+			return fmt.Errorf("failed to load operator keys, create them with pbft_main keygen: %w", err)
+		}
+		n.operators = operators
+	} else if n.cfg.AdminPortOffset != 0 {
+		return errors.New("admin_port_offset is set but operators is empty, nobody could sign admin requests")
+	}
+	ledgerWriter, err := ledger.NewWriter(n.cfg.LedgerDir, ledger.NodeName(n.NodeID))
+	if err != nil {
+		n.log.Error("failed to open ledger in %s: %v", n.cfg.LedgerDir, err)
+	}
+	n.ledger = ledgerWriter
+	// checkpoint bookkeeping must exist before the first message can arrive
 	n.StartGarbageCollection()
+	n.joining = !config.IsMember(n.NodeID)
+	n.startMetrics()
+	n.startAdmin()
+	if err := n.messageHub.Start(n); err != nil {
+		return err
+	}
 	n.log.Info("node started")
+	if n.joining {
+		go n.requestState()
+	}
+	return nil
 }
 
-func (n *Node) Stop() {
+// Stop releases everything Start opened: it stops the timers and the admin
+// and metrics servers, waits for the running handlers, flushes the send
+// queues for up to flushTimeout and syncs the ledger
+func (n *Node) Stop(flushTimeout time.Duration) {
+	// a paused node would block its handlers forever
+	n.Resume()
+	n.admin.Close()
 	// Stop all expire timers to prevent resource leaks
 	n.StopAllExpireTimers()
 	// Close network resources to stop listeners and connections
 	if n.messageHub != nil {
-		n.messageHub.Close()
+		n.messageHub.Close(flushTimeout)
+	}
+	if err := n.ledger.Close(); err != nil {
+		n.log.Error("failed to close ledger: %v", err)
 	}
+	n.metrics.Close()
+	result.LogHistograms(n.log)
 	n.log.Info("node stopped")
 }
 
 func (n *Node) GetAddr() string {
-	return config.NodeAddr[int(n.NodeID)]
+	addr, _ := config.NodeAddrOf(n.NodeID)
+	return addr
 }
 
 func (n *Node) SetPreprepareSequenceNumber(seqNumber int64) {
@@ -125,9 +199,6 @@ func (n *Node) SetCommitSequenceNumber(seqNumber int64) {
 	n.commitSeqLock.Lock()
 	defer n.commitSeqLock.Unlock()
 	n.lastCommitSeqNumber = seqNumber
-	if n.initCommitSeqNumber == -1 {
-		n.initCommitSeqNumber = seqNumber
-	}
 }
 
 func (n *Node) GetCommitSequenceNumber() int64 {
@@ -136,30 +207,6 @@ func (n *Node) GetCommitSequenceNumber() int64 {
 	return n.lastCommitSeqNumber
 }
 
-func (n *Node) GetPrepareMessageNumber(seqNumber int64) int32 {
-	n.PrepareMessageLock.Lock()
-	defer n.PrepareMessageLock.Unlock()
-	return n.prepareMsgNumber[seqNumber].Load()
-}
-
-func (n *Node) GetCommitMessageNumber(seqNumber int64) int32 {
-	n.CommitMessageLock.Lock()
-	defer n.CommitMessageLock.Unlock()
-	return n.commitMsgNumber[seqNumber].Load()
-}
-
-func (n *Node) AddPrepareMessageNumber(seqNumber int64) {
-	n.PrepareMessageLock.Lock()
-	defer n.PrepareMessageLock.Unlock()
-	n.prepareMsgNumber[seqNumber].Add(1)
-}
-
-func (n *Node) AddCommitMessageNumber(seqNumber int64) {
-	n.CommitMessageLock.Lock()
-	defer n.CommitMessageLock.Unlock()
-	n.commitMsgNumber[seqNumber].Add(1)
-}
-
 // StartExpireTimer starts a new expire timer with a unique ID
 // Multiple timers can run concurrently
 func (n *Node) StartExpireTimer(timerID string) {
@@ -252,6 +299,7 @@ func (n *Node) monitorTimer(timerID string, timer *time.Timer) {
 	// start view changer
 	if !n.viewChange.IsInViewChange() {
 		n.log.Error("Node %d is expired and Start to trigger view change", n.NodeID)
+		viewChanges.Inc()
 		// n.viewChange.StartViewChange(n.viewNumber, n.lastStableCheckpoint)
 		// n.SendViewChangeMessage()
 	}
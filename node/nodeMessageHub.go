@@ -1,14 +1,11 @@
 package node
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/binary"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"sync"
+	"time"
 
 	"github.com/michael112233/pbft/core"
 	"github.com/michael112233/pbft/logger"
@@ -18,14 +15,15 @@ import (
 // --------------------------------------------------------
 // For Data Structure Definition
 // --------------------------------------------------------
-var (
-	conns2Node = network.NewConnectionsMap()
-	listenConn net.Listener
-)
 
 type NodeMessageHub struct {
 	exitChan chan struct{}
 	node_ref *Node
+	conns    *network.ConnManager
+	inbound  *network.Inbound
+	framer   *network.Framer
+	tls      *network.TLSIdentity
+	handlers map[string]func(interface{})
 
 	log *logger.Logger
 }
@@ -33,414 +31,209 @@ type NodeMessageHub struct {
 func NewNodeMessageHub() *NodeMessageHub {
 	return &NodeMessageHub{
 		exitChan: make(chan struct{}, 1),
+		inbound:  network.NewInbound(),
 	}
 }
 
-func (hub *NodeMessageHub) Start(node *Node, wg *sync.WaitGroup) {
+// Start listens on the address of node and handles its connections in the
+// background, it fails if the TLS identity cannot be loaded or the address
+// cannot be listened on
+func (hub *NodeMessageHub) Start(node *Node) error {
 	if node != nil {
 		hub.node_ref = node
 		hub.log = node.log
-		wg.Add(1)
-		go hub.listen(hub.node_ref.GetAddr(), wg)
-	}
-}
-
-func (hub *NodeMessageHub) Close() {
-	// 关闭所有tcp连接，防止资源泄露
-	hub.log.Debug("nodeMessageHub closing...")
-	for _, conn := range conns2Node.Connections {
-		conn.Close()
-	}
-	listenConn.Close()
-	hub.log.Debug("messageHub is close.")
-}
-
-// --------------------------------------------------------
-// Basic Communication Principles Implementation (like Dial & Listen)
-// --------------------------------------------------------
-func (hub *NodeMessageHub) Dial(addr string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		hub.log.Debug(fmt.Sprintf("DialTCPError: target_addr=%s, err=%v", addr, err))
-		// 再dial一次
-		hub.log.Debug(fmt.Sprintf("Try dial again... target_addr=%s", addr))
-		conn, err = net.Dial("tcp", addr)
+		policy, err := network.ParseOverflowPolicy(node.cfg.SendQueuePolicy)
 		if err != nil {
-			hub.log.Debug(fmt.Sprintf("DialTCPError: target_addr=%s, err=%v", addr, err))
-			return nil, nil
-		} else {
-			hub.log.Debug(fmt.Sprintf("dial success. target_addr=%s", addr))
+			policy = network.PolicyDropOldest
+			hub.log.Error("invalid send queue policy, using %s: err=%v", policy, err)
 		}
-	}
-	return conn, nil
-}
-
-func (hub *NodeMessageHub) packMsg(msgType string, data []byte) []byte {
-	msg := &core.Message{
-		MsgType: msgType,
-		Data:    data,
-	}
-
-	var buf bytes.Buffer
-	msgEnc := gob.NewEncoder(&buf)
-	err := msgEnc.Encode(msg)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("gobEncodeErr: err=%v, msg=%v", err, msg))
-	}
-
-	msgBytes := buf.Bytes()
-
-	// 前缀加上长度，防止粘包
-	networkBuf := make([]byte, 4+len(msgBytes))
-	binary.BigEndian.PutUint32(networkBuf[:4], uint32(len(msgBytes)))
-	copy(networkBuf[4:], msgBytes)
-
-	return networkBuf
-}
-
-func (hub *NodeMessageHub) Send(msgType string, ip string, msg interface{}, callback func(...interface{})) {
-	switch msgType {
-	case core.MsgPreprepareMessage:
-		hub.sendPreprepareMessage(msg)
-	case core.MsgPrepareMessage:
-		hub.sendPrepareMessage(msg)
-	case core.MsgCommitMessage:
-		hub.sendCommitMessage(msg)
-	case core.MsgReplyMessage:
-		hub.sendReplyMessage(msg)
-	case core.MsgViewChangeMessage:
-		hub.sendViewChangeMessage(msg)
-	case core.MsgCheckpointMessage:
-		hub.sendCheckpointMessage(msg)
-	default:
-		hub.log.Error("Unknown message type received. msgType=" + msgType)
-	}
-}
-
-func (hub *NodeMessageHub) listen(addr string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("Error setting up listener: err=%v", err))
-	}
-	hub.log.Info(fmt.Sprintf("start listening on %s", addr))
-	listenConn = ln
-	defer ln.Close()
-
-	for {
-		// // 超过时间限制没有收到新的连接则退出
-		// ln.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
-		conn, err := ln.Accept()
+		hub.conns = network.NewConnManager(node.log, network.QueueConfig{
+			Size:   int(node.cfg.SendQueueSize),
+			Policy: policy,
+		})
+		codec, err := network.GetCodec(node.cfg.WireFormat)
 		if err != nil {
-			hub.log.Debug(fmt.Sprintf("Error accepting connection: err=%v", err))
-			return
+			hub.log.Error("invalid wire format, using %s: err=%v", network.DefaultCodec, err)
+			codec, _ = network.GetCodec(network.DefaultCodec)
 		}
-		go hub.handleConnection(conn, ln)
-	}
-}
-
-func (hub *NodeMessageHub) unpackMsg(packedMsg []byte) *core.Message {
-	var networkBuf bytes.Buffer
-	networkBuf.Write(packedMsg)
-	msgDec := gob.NewDecoder(&networkBuf)
-
-	var msg core.Message
-	err := msgDec.Decode(&msg)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("unpackMsgErr: err=%v, msgBytes=%v", err, packedMsg))
-	}
-
-	return &msg
-}
-
-func (hub *NodeMessageHub) handleConnection(conn net.Conn, ln net.Listener) {
-	defer conn.Close()
-	for {
-		lenBuf := make([]byte, 4)
-		_, err := io.ReadFull(conn, lenBuf)
-		if err != nil {
-			if err.Error() == "EOF" {
-				// 发送端主动关闭连接
-				return
+		hub.framer = network.NewFramer(codec, int(node.cfg.MaxFrameSize))
+		if node.cfg.TLSEnabled {
+			identity := network.Identity(core.RoleNode, node.NodeID)
+			hub.tls, err = network.LoadTLSIdentity(node.cfg.TLSDir, identity)
+			if err != nil {
+				return fmt.Errorf("failed to load TLS identity %s from %s: %w", identity, node.cfg.TLSDir, err)
 			}
-			hub.log.Debug(fmt.Sprintf("Error reading from connection: err=%v", err))
-			return
-		}
-		length := int(binary.BigEndian.Uint32(lenBuf))
-		packedMsg := make([]byte, length)
-		_, err = io.ReadFull(conn, packedMsg)
-		if err != nil {
-			hub.log.Error(fmt.Sprintf("Error reading from connection: err=%v", err))
-		}
-
-		msg := hub.unpackMsg(packedMsg)
-		switch msg.MsgType {
-		case core.MsgRequestMessage:
-			hub.handleRequestMessage(msg.Data)
-		case core.MsgPreprepareMessage:
-			hub.handlePreprepareMessage(msg.Data)
-		case core.MsgPrepareMessage:
-			hub.handlePrepareMessage(msg.Data)
-		case core.MsgCommitMessage:
-			hub.handleCommitMessage(msg.Data)
-		case core.MsgCloseMessage:
-			hub.handleCloseMessage(msg.Data)
-		case core.MsgViewChangeMessage:
-			hub.handleViewChangeMessage(msg.Data)
-		case core.MsgCheckpointMessage:
-			hub.handleCheckpointMessage(msg.Data)
-		default:
-			hub.log.Error(fmt.Sprintf("Unknown message type received: msgType=%s", msg.MsgType))
+			if err := network.PinTopologyKeys(hub.tls); err != nil {
+				return fmt.Errorf("failed to pin public keys of the topology: %w", err)
+			}
+			hub.conns.SetDialer(hub.tls.Dialer(network.IdentityOfAddr))
 		}
+		hub.registerHandlers()
+		return hub.listen(hub.node_ref.GetAddr())
 	}
+	return nil
 }
 
-// --------------------------------------------------------
-// Communication for Unmarshalling messages to Node
-// --------------------------------------------------------
-
-func (hub *NodeMessageHub) handleRequestMessage(dataBytes []byte) {
-	var buf bytes.Buffer
-	buf.Write(dataBytes)
-	dataDec := gob.NewDecoder(&buf)
-
-	var data core.RequestMessage
-	err := dataDec.Decode(&data)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("handleRequestMessageErr: err=%v, dataBytes=%v", err, dataBytes))
+// Close stops accepting messages and waits for the running handlers, then
+// gives the queued messages up to flushTimeout to reach the peers before the
+// outbound connections are closed
+func (hub *NodeMessageHub) Close(flushTimeout time.Duration) {
+	// 关闭所有tcp连接，防止资源泄露
+	hub.log.Debug("nodeMessageHub closing...")
+	hub.inbound.Close()
+	if hub.conns == nil {
+		return
 	}
-
-	hub.node_ref.HandleRequestMessage(data)
-}
-
-func (hub *NodeMessageHub) handlePreprepareMessage(dataBytes []byte) {
-	var buf bytes.Buffer
-	buf.Write(dataBytes)
-	dataDec := gob.NewDecoder(&buf)
-
-	var data core.PreprepareMessage
-	err := dataDec.Decode(&data)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("handlePreprepareMessageErr: err=%v, dataBytes=%v", err, dataBytes))
+	for _, stats := range hub.conns.Stats() {
+		hub.log.Info("send queue stats: %s", stats)
 	}
-
-	hub.node_ref.HandlePreprepareMessage(data)
-}
-
-func (hub *NodeMessageHub) handlePrepareMessage(dataBytes []byte) {
-	var buf bytes.Buffer
-	buf.Write(dataBytes)
-	dataDec := gob.NewDecoder(&buf)
-
-	var data core.PrepareMessage
-	err := dataDec.Decode(&data)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("handlePrepareMessageErr: err=%v, dataBytes=%v", err, dataBytes))
-	}
-	hub.node_ref.HandlePrepareMessage(data)
+	hub.conns.CloseAfter(flushTimeout)
+	hub.log.Debug("messageHub is close.")
 }
 
-func (hub *NodeMessageHub) handleCommitMessage(dataBytes []byte) {
-	var buf bytes.Buffer
-	buf.Write(dataBytes)
-	dataDec := gob.NewDecoder(&buf)
-
-	var data core.CommitMessage
-	err := dataDec.Decode(&data)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("handleCommitMessageErr: err=%v, dataBytes=%v", err, dataBytes))
+// registerHandlers binds every message type a replica accepts to its handler
+func (hub *NodeMessageHub) registerHandlers() {
+	hub.handlers = map[string]func(interface{}){
+		core.MsgRequestMessage: func(msg interface{}) {
+			hub.node_ref.HandleRequestMessage(*msg.(*core.RequestMessage))
+		},
+		core.MsgPreprepareMessage: func(msg interface{}) {
+			hub.node_ref.HandlePreprepareMessage(*msg.(*core.PreprepareMessage))
+		},
+		core.MsgPrepareMessage: func(msg interface{}) {
+			hub.node_ref.HandlePrepareMessage(*msg.(*core.PrepareMessage))
+		},
+		core.MsgCommitMessage: func(msg interface{}) {
+			hub.node_ref.HandleCommitMessage(*msg.(*core.CommitMessage))
+		},
+		core.MsgCloseMessage: func(msg interface{}) {
+			hub.node_ref.HandleCloseMessage(*msg.(*core.CloseMessage))
+		},
+		core.MsgViewChangeMessage: func(msg interface{}) {
+			hub.node_ref.HandleViewChangeMessage(*msg.(*core.ViewChangeMessage))
+		},
+		core.MsgCheckpointMessage: func(msg interface{}) {
+			hub.node_ref.HandleCheckpointMessage(*msg.(*core.CheckpointMessage))
+		},
+		core.MsgStateRequestMessage: func(msg interface{}) {
+			hub.node_ref.HandleStateRequestMessage(*msg.(*core.StateRequestMessage))
+		},
+		core.MsgStateResponseMessage: func(msg interface{}) {
+			hub.node_ref.HandleStateResponseMessage(*msg.(*core.StateResponseMessage))
+		},
+		core.MsgHandoffMessage: func(msg interface{}) {
+			hub.node_ref.HandleHandoffMessage(*msg.(*core.HandoffMessage))
+		},
 	}
-	hub.node_ref.HandleCommitMessage(data)
 }
 
-func (hub *NodeMessageHub) handleCloseMessage(dataBytes []byte) {
-	var buf bytes.Buffer
-	buf.Write(dataBytes)
-	dataDec := gob.NewDecoder(&buf)
-
-	var data core.CloseMessage
-	err := dataDec.Decode(&data)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("handleCloseMessageErr: err=%v, dataBytes=%v", err, dataBytes))
+// --------------------------------------------------------
+// Basic Communication Principles Implementation (like Dial & Listen)
+// --------------------------------------------------------
+// Send delivers msg to the replica or client with id to, the role of the
+// receiver is given by the registration of msgType.
+func (hub *NodeMessageHub) Send(msgType string, to int64, msg interface{}, callback func(...interface{})) {
+	messageType, ok := core.LookupMessageByName(msgType)
+	if !ok {
+		hub.log.Error(fmt.Sprintf("encodeMessageErr: unregistered message type %s", msgType))
+		return
 	}
-	hub.node_ref.HandleCloseMessage(data)
-}
-
-func (hub *NodeMessageHub) handleViewChangeMessage(dataBytes []byte) {
-	var buf bytes.Buffer
-	buf.Write(dataBytes)
-	dataDec := gob.NewDecoder(&buf)
-
-	var data core.ViewChangeMessage
-	err := dataDec.Decode(&data)
+	addr, err := network.AddrOf(messageType.To, to)
 	if err != nil {
-		hub.log.Error(fmt.Sprintf("handleViewChangeMessageErr: err=%v, dataBytes=%v", err, dataBytes))
+		hub.log.Error(fmt.Sprintf("resolveAddrErr: msgType=%s, err=%v", msgType, err))
+		return
 	}
-	hub.node_ref.HandleViewChangeMessage(data)
-}
-
-func (hub *NodeMessageHub) handleCheckpointMessage(dataBytes []byte) {
-	var buf bytes.Buffer
-	buf.Write(dataBytes)
-	dataDec := gob.NewDecoder(&buf)
-
-	var data core.CheckpointMessage
-	err := dataDec.Decode(&data)
+	frame, err := hub.framer.Encode(messageType, msg)
 	if err != nil {
-		hub.log.Error(fmt.Sprintf("handleCheckpointMessageErr: err=%v, dataBytes=%v", err, dataBytes))
+		hub.log.Error(fmt.Sprintf("encodeMessageErr: targetAddr=%s, err=%v", addr, err))
+		return
 	}
-	hub.node_ref.HandleCheckpointMessage(data)
+	hub.conns.Send(addr, frame)
+	network.CountSent(msgType)
 }
 
-// --------------------------------------------------------
-// Communication for Marshalling Messages to Send
-// --------------------------------------------------------
-func (hub *NodeMessageHub) sendPreprepareMessage(msg interface{}) {
-	data := msg.(core.PreprepareMessage)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(&data)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("gobEncodeErr. Send Preprepare Message. caller: %s targetAddr: %s", data.From, data.To))
-	}
-
-	msg_bytes := hub.packMsg("MsgPreprepareMessage", buf.Bytes())
-
-	addr := data.To
-	conn, ok := conns2Node.Get(addr)
+// fits reports whether msg can be sent as msgType without exceeding max_frame_size
+func (hub *NodeMessageHub) fits(msgType string, msg interface{}) bool {
+	messageType, ok := core.LookupMessageByName(msgType)
 	if !ok {
-		conn, err = hub.Dial(addr)
-		if err != nil {
-			hub.log.Error(fmt.Sprintf("Dial Error. Send Preprepare Message. caller: %s targetAddr: %s", data.From, addr))
-		}
-		conns2Node.Add(addr, conn)
+		return false
 	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
+	_, err := hub.framer.Encode(messageType, msg)
+	return !errors.Is(err, network.ErrFrameTooLarge)
 }
 
-func (hub *NodeMessageHub) sendPrepareMessage(msg interface{}) {
-	data := msg.(core.PrepareMessage)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(&data)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("gobEncodeErr. Send Prepare Message. caller: %s targetAddr: %s", data.From, data.To))
+func (hub *NodeMessageHub) listen(addr string) error {
+	var ln net.Listener
+	var err error
+	if hub.tls != nil {
+		ln, err = hub.tls.Listen(addr)
+	} else {
+		ln, err = net.Listen("tcp", addr)
 	}
-
-	msg_bytes := hub.packMsg("MsgPrepareMessage", buf.Bytes())
-
-	addr := data.To
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = hub.Dial(addr)
-		if err != nil {
-			hub.log.Error(fmt.Sprintf("Dial Error. Send Prepare Message. caller: %s targetAddr: %s", data.From, addr))
-		}
-		conns2Node.Add(addr, conn)
-	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
-}
-
-func (hub *NodeMessageHub) sendCommitMessage(msg interface{}) {
-	data := msg.(core.CommitMessage)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(&data)
 	if err != nil {
-		hub.log.Error(fmt.Sprintf("gobEncodeErr. Send Commit Message. caller: %s targetAddr: %s", data.From, data.To))
-	}
-
-	msg_bytes := hub.packMsg("MsgCommitMessage", buf.Bytes())
-
-	addr := data.To
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = hub.Dial(addr)
-		if err != nil {
-			hub.log.Error(fmt.Sprintf("Dial Error. Send Commit Message. caller: %s targetAddr: %s", data.From, addr))
-		}
-		conns2Node.Add(addr, conn)
+		return fmt.Errorf("error setting up listener on %s: %w", addr, err)
 	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
+	hub.log.Info(fmt.Sprintf("start listening on %s", addr))
+	hub.inbound.Serve(ln, hub.handleConnection)
+	return nil
 }
 
-func (hub *NodeMessageHub) sendReplyMessage(msg interface{}) {
-	data := msg.(core.ReplyMessage)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(&data)
+func (hub *NodeMessageHub) handleConnection(conn net.Conn) {
+	// with TLS every message has to come from the owner of the client certificate
+	identity, err := hub.tls.PeerIdentity(conn)
 	if err != nil {
-		hub.log.Error(fmt.Sprintf("gobEncodeErr. Send Reply Message. caller: %s targetAddr: %s", data.From, data.To))
+		hub.log.Error(fmt.Sprintf("TLS handshake failed: remote=%s, err=%v", conn.RemoteAddr(), err))
+		return
 	}
-
-	msg_bytes := hub.packMsg("MsgReplyMessage", buf.Bytes())
-
-	addr := data.To
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = hub.Dial(addr)
+	var peerRole core.Role
+	var peerID int64
+	if identity != "" {
+		peerRole, peerID, err = network.ParseIdentity(identity)
+		if err == nil {
+			_, err = network.AddrOf(peerRole, peerID)
+		}
 		if err != nil {
-			hub.log.Error(fmt.Sprintf("Dial Error. Send Reply Message. caller: %s targetAddr: %s", data.From, addr))
+			hub.log.Error(fmt.Sprintf("Unknown peer identity: remote=%s, identity=%s, err=%v", conn.RemoteAddr(), identity, err))
+			return
 		}
-		conns2Node.Add(addr, conn)
-	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
-}
-
-func (hub *NodeMessageHub) sendCheckpointMessage(msg interface{}) {
-	data := msg.(core.CheckpointMessage)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(&data)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("gobEncodeErr. Send Checkpoint Message. caller: %s targetAddr: %s", data.From, data.To))
 	}
 
-	msg_bytes := hub.packMsg("MsgCheckpointMessage", buf.Bytes())
-
-	addr := data.To
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = hub.Dial(addr)
+	for {
+		// any malformed frame drops the connection, the stream cannot be resynchronised
+		messageType, msg, err := hub.framer.Read(conn)
 		if err != nil {
-			hub.log.Error(fmt.Sprintf("Dial Error. Send Checkpoint Message. caller: %s targetAddr: %s", data.From, addr))
+			if err == io.EOF {
+				// 发送端主动关闭连接
+				return
+			}
+			if errors.Is(err, net.ErrClosed) || hub.inbound.Closed() {
+				// 本端关闭时连接被主动关闭
+				hub.log.Debug(fmt.Sprintf("Connection closed while reading: remote=%s", conn.RemoteAddr()))
+				return
+			}
+			hub.log.Error(fmt.Sprintf("Error reading from connection, dropping it: remote=%s, err=%v", conn.RemoteAddr(), err))
+			return
 		}
-		conns2Node.Add(addr, conn)
-	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
-}
 
-func (hub *NodeMessageHub) sendViewChangeMessage(msg interface{}) {
-	data := msg.(core.ViewChangeMessage)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(&data)
-	if err != nil {
-		hub.log.Error(fmt.Sprintf("gobEncodeErr. Send View Change Message. caller: %s targetAddr: %s", data.From, data.To))
-	}
-
-	msg_bytes := hub.packMsg("MsgViewChangeMessage", buf.Bytes())
+		msgType := messageType.Name
+		if identity != "" {
+			sender, ok := msg.(core.Sender)
+			if !ok {
+				hub.log.Error(fmt.Sprintf("Message has no sender, dropping connection: msgType=%s, identity=%s", msgType, identity))
+				return
+			}
+			if messageType.From != peerRole || sender.Sender() != peerID {
+				hub.log.Error(fmt.Sprintf("Message sender does not match connection identity, dropping connection: msgType=%s, from=%s-%d, identity=%s", msgType, messageType.From, sender.Sender(), identity))
+				return
+			}
+		}
 
-	addr := data.To
-	conn, ok := conns2Node.Get(addr)
-	if !ok {
-		conn, err = hub.Dial(addr)
-		if err != nil {
-			hub.log.Error(fmt.Sprintf("Dial Error. Send View Change Message. caller: %s targetAddr: %s", data.From, addr))
+		handler, ok := hub.handlers[msgType]
+		if !ok {
+			hub.log.Error(fmt.Sprintf("Unknown message type received: msgType=%s", msgType))
+			continue
 		}
-		conns2Node.Add(addr, conn)
+		hub.node_ref.lastMessageAt.Store(time.Now().UnixNano())
+		handler(msg)
 	}
-	writer := bufio.NewWriter(conn)
-	writer.Write(msg_bytes)
-	writer.Flush()
 }
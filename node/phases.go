@@ -0,0 +1,46 @@
+package node
+
+import (
+	"time"
+
+	"github.com/michael112233/pbft/result"
+)
+
+// --------------------------------------------------------
+// Phase Timings
+// --------------------------------------------------------
+
+// phaseTimes remembers when a sequence number reached each phase on this replica
+type phaseTimes struct {
+	preprepared time.Time
+	prepared    time.Time
+	committed   time.Time
+}
+
+func (n *Node) phasesOf(seqNumber int64) *phaseTimes {
+	if n.phases[seqNumber] == nil {
+		n.phases[seqNumber] = &phaseTimes{}
+	}
+	return n.phases[seqNumber]
+}
+
+// observePhases records the phase durations of an executed sequence number.
+// A phase is skipped when its start was not seen, e.g. a replica can collect
+// the commit quorum before its own prepare quorum.
+func (n *Node) observePhases(seqNumber int64) {
+	phases := n.phases[seqNumber]
+	delete(n.phases, seqNumber)
+	if phases == nil {
+		return
+	}
+	executed := time.Now()
+	if !phases.preprepared.IsZero() && !phases.prepared.IsZero() {
+		result.Observe(result.PhasePrepare, phases.prepared.Sub(phases.preprepared))
+	}
+	if !phases.prepared.IsZero() && !phases.committed.IsZero() && phases.committed.After(phases.prepared) {
+		result.Observe(result.PhaseCommit, phases.committed.Sub(phases.prepared))
+	}
+	if !phases.committed.IsZero() {
+		result.Observe(result.PhaseExecute, executed.Sub(phases.committed))
+	}
+}
@@ -0,0 +1,51 @@
+package node
+
+import (
+	"github.com/michael112233/pbft/config"
+	"github.com/michael112233/pbft/core"
+)
+
+// --------------------------------------------------------
+// Votes
+// --------------------------------------------------------
+
+// voteKey separates the votes for different digests at the same sequence
+// number, so a primary sending conflicting proposals cannot merge them.
+type voteKey struct {
+	seq    int64
+	digest string
+}
+
+// quorum is built from the current replica set, which a reconfiguration may change
+func (n *Node) quorum() *core.Quorum {
+	return core.NewQuorum(config.Members())
+}
+
+func votesOf(votes map[voteKey]*core.VoteSet, seqNumber int64, digest string) *core.VoteSet {
+	key := voteKey{seq: seqNumber, digest: digest}
+	if votes[key] == nil {
+		votes[key] = core.NewVoteSet()
+	}
+	return votes[key]
+}
+
+// pruneVotes drops every vote up to a stable checkpoint, they cannot be needed anymore
+func (n *Node) pruneVotes(stableCheckpoint int64) {
+	for _, votes := range []map[voteKey]*core.VoteSet{n.prepareVotes, n.commitVotes, n.checkpointVotes} {
+		for key := range votes {
+			if key.seq < stableCheckpoint {
+				delete(votes, key)
+			}
+		}
+	}
+	for seqNumber := range n.prepared {
+		if seqNumber <= stableCheckpoint {
+			delete(n.prepared, seqNumber)
+		}
+	}
+	for seqNumber := range n.phases {
+		if seqNumber <= stableCheckpoint {
+			delete(n.phases, seqNumber)
+		}
+	}
+}
@@ -2,8 +2,10 @@ package node
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/michael112233/pbft/core"
+	"github.com/michael112233/pbft/ledger"
 	"github.com/michael112233/pbft/utils"
 )
 
@@ -11,46 +13,72 @@ import (
 func (n *Node) HandleRequestMessage(data core.RequestMessage) {
 	n.handleMessageLock.Lock()
 	defer n.handleMessageLock.Unlock()
+	if n.joining {
+		n.log.Error("Node %d is not a member yet and Ignore request message", n.NodeID)
+		return
+	}
 	if n.viewChange.IsInViewChange() {
 		n.log.Error("Node %d is in view change and Ignore request message", n.NodeID)
 		return
 	}
 	timerID := fmt.Sprintf("request_%d_%d", n.NodeID, data.Id)
 	n.StartExpireTimer(timerID)
-	n.log.Info(fmt.Sprintf("Received request message from %s to %s with %d transactions", data.From, data.To, len(data.Txs)))
+	n.log.Info(fmt.Sprintf("Received request message from %d to %d with %d transactions", data.From, data.To, len(data.Txs)))
+	if n.rotating() {
+		n.queueRequest(data)
+		return
+	}
 	n.SendPreprepareMessage(data)
 }
 
 func (n *Node) HandlePreprepareMessage(data core.PreprepareMessage) {
 	n.handleMessageLock.Lock()
 	defer n.handleMessageLock.Unlock()
+	log := n.msgLog(core.MsgPreprepareMessage, data.SequenceNumber, data.ViewNumber, data.From)
+	if n.bufferWhileJoining(data.SequenceNumber, func() { n.HandlePreprepareMessage(data) }) {
+		return
+	}
 	timerID := fmt.Sprintf("request_%d_%d", n.NodeID, data.RequestMessage.Id)
 	n.StartExpireTimer(timerID)
 	if n.viewChange.IsInViewChange() {
-		n.log.Error("Node %d is expired and Start to trigger view change", n.NodeID)
+		log.Error("Node %d is expired and Start to trigger view change", n.NodeID)
 		return
 	}
-	n.log.Info(fmt.Sprintf("SeqNumber %d: Received preprepare message from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+	log.Info(fmt.Sprintf("SeqNumber %d: Received preprepare message from %d, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
 	// if n.NodeID == 1 {
 	// 	n.log.Error("node 1 is faulty!")
 	// 	return
 	// }
 	if data.Digest != utils.GetDigest(data.RequestMessage) {
-		n.log.Error(fmt.Sprintf("SeqNumber %d: Preprepare message digest mismatch. from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+		log.Error(fmt.Sprintf("SeqNumber %d: Preprepare message digest mismatch. from %d, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+		return
+	} else if n.rotating() && data.From != n.primaryOf(data.SequenceNumber) {
+		log.Error(fmt.Sprintf("SeqNumber %d: Preprepare message from %d, which is not the primary of sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
 		return
 	} else if data.ViewNumber != n.viewNumber {
-		n.log.Error(fmt.Sprintf("SeqNumber %d: Preprepare message view number mismatch. from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+		log.Error(fmt.Sprintf("SeqNumber %d: Preprepare message view number mismatch. from %d, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
 		return
 	} else if data.SequenceNumber < n.cfg.SeqNumberLowerBound || data.SequenceNumber > n.cfg.SeqNumberUpperBound {
-		n.log.Error(fmt.Sprintf("SeqNumber %d: Preprepare message sequence number out of range. from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+		log.Error(fmt.Sprintf("SeqNumber %d: Preprepare message sequence number out of range. from %d, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+		return
+	} else if n.holdEarlyPreprepare(data) {
 		return
 	} else if n.GetPreprepareSequenceNumber() != -1 && data.SequenceNumber != n.GetPreprepareSequenceNumber()+1 {
-		n.log.Error(fmt.Sprintf("SeqNumber %d: Preprepare message sequence number mismatch. from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+		log.Error(fmt.Sprintf("SeqNumber %d: Preprepare message sequence number mismatch. from %d, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
 		return
 	} else {
-		n.log.Info(fmt.Sprintf("SeqNumber %d: Preprepare message sequence number succeeds. from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+		log.Info(fmt.Sprintf("SeqNumber %d: Preprepare message sequence number succeeds. from %d, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
 		n.SetPreprepareSequenceNumber(data.SequenceNumber)
+		if n.firstSeqNumber == -1 {
+			n.firstSeqNumber = data.SequenceNumber
+		}
+		n.phasesOf(data.SequenceNumber).preprepared = time.Now()
+		// the preprepare is the prepare vote of the primary
+		votesOf(n.prepareVotes, data.SequenceNumber, data.Digest).Add(data.From)
 		n.SendPrepareMessage(data)
+		if n.rotating() {
+			n.acceptProposal(data)
+		}
 	}
 
 }
@@ -58,80 +86,150 @@ func (n *Node) HandlePreprepareMessage(data core.PreprepareMessage) {
 func (n *Node) HandlePrepareMessage(data core.PrepareMessage) {
 	n.handleMessageLock.Lock()
 	defer n.handleMessageLock.Unlock()
+	log := n.msgLog(core.MsgPrepareMessage, data.SequenceNumber, data.ViewNumber, data.From)
+	if n.bufferWhileJoining(data.SequenceNumber, func() { n.HandlePrepareMessage(data) }) {
+		return
+	}
 	if n.viewChange.IsInViewChange() {
-		n.log.Error("Node %d is expired and Start to trigger view change", n.NodeID)
+		log.Error("Node %d is expired and Start to trigger view change", n.NodeID)
 		return
 	}
 	// if n.NodeID == 1 {
 	// 	n.log.Error("node 1 is faulty!")
 	// 	return
 	// }
-	n.log.Info(fmt.Sprintf("SeqNumber %d: Received prepare message from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+	log.Info(fmt.Sprintf("SeqNumber %d: Received prepare message from %d, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
 	if data.Digest != utils.GetDigest(data.RequestMessage) {
-		n.log.Error(fmt.Sprintf("SeqNumber %d: Prepare message digest mismatch. from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+		log.Error(fmt.Sprintf("SeqNumber %d: Prepare message digest mismatch. from %d, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
 		return
 	} else if data.ViewNumber != n.viewNumber {
-		n.log.Error(fmt.Sprintf("SeqNumber %d: Prepare message view number mismatch. from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+		log.Error(fmt.Sprintf("SeqNumber %d: Prepare message view number mismatch. from %d, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
 		return
 	} else if data.SequenceNumber < n.cfg.SeqNumberLowerBound || data.SequenceNumber > n.cfg.SeqNumberUpperBound {
-		n.log.Error(fmt.Sprintf("SeqNumber %d: Prepare message sequence number out of range. from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+		log.Error(fmt.Sprintf("SeqNumber %d: Prepare message sequence number out of range. from %d, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
 		return
-	} else if n.GetPrepareSequenceNumber() != -1 && data.SequenceNumber != n.GetPrepareSequenceNumber()+1 {
-		n.log.Error(fmt.Sprintf("SeqNumber %d: Prepare message sequence number mismatch. from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+	} else if n.prepared[data.SequenceNumber] || data.SequenceNumber <= n.lastStableCheckpoint {
+		log.Debug(fmt.Sprintf("SeqNumber %d: Prepare message from %d arrived after the block was prepared", data.SequenceNumber, data.From))
 		return
-	} else {
-		n.AddPrepareMessageNumber(data.SequenceNumber)
-		n.log.Info(fmt.Sprintf("SeqNumber %d: Prepare message count for sequence %d is now %d", data.SequenceNumber, data.SequenceNumber, n.prepareMsgNumber[data.SequenceNumber].Load()))
 	}
-	n.log.Info(fmt.Sprintf("SeqNumber %d: After receiving from %s, current prepare messages number is %d", data.SequenceNumber, data.From, n.prepareMsgNumber[data.SequenceNumber].Load()))
+	votes := votesOf(n.prepareVotes, data.SequenceNumber, data.Digest)
+	if !votes.Add(data.From) {
+		log.Error(fmt.Sprintf("SeqNumber %d: Duplicate prepare message from %d", data.SequenceNumber, data.From))
+		return
+	}
+	log.Info(fmt.Sprintf("SeqNumber %d: After receiving from %d, current prepare messages number is %d", data.SequenceNumber, data.From, votes.Size()))
+	n.checkPrepared(data.SequenceNumber, data.Digest, data.RequestMessage)
+}
 
-	if n.GetPrepareMessageNumber(data.SequenceNumber) == 2*int32(n.cfg.FaultyNodesNum) {
-		n.log.Info(fmt.Sprintf("SeqNumber %d: Received %d prepare messages, enough to commit the block.", data.SequenceNumber, n.prepareMsgNumber[data.SequenceNumber].Load()))
-		n.SetPrepareSequenceNumber(data.SequenceNumber)
-		n.SendCommitMessage(data)
+// checkPrepared sends the commit message once the prepare votes, including
+// the preprepare of the primary, carry a quorum of the voting weight
+func (n *Node) checkPrepared(seqNumber int64, digest string, request *core.RequestMessage) {
+	votes := votesOf(n.prepareVotes, seqNumber, digest)
+	if !votes.Complete(n.quorum()) {
+		return
 	}
+	n.log.Info(fmt.Sprintf("SeqNumber %d: Received %d prepare messages, enough to commit the block.", seqNumber, votes.Size()))
+	n.prepared[seqNumber] = true
+	n.phasesOf(seqNumber).prepared = time.Now()
+	if seqNumber > n.GetPrepareSequenceNumber() {
+		n.SetPrepareSequenceNumber(seqNumber)
+	}
+	n.SendCommitMessage(seqNumber, digest, request)
 }
 
 func (n *Node) HandleCommitMessage(data core.CommitMessage) {
 	n.handleMessageLock.Lock()
 	defer n.handleMessageLock.Unlock()
+	log := n.msgLog(core.MsgCommitMessage, data.SequenceNumber, data.ViewNumber, data.From)
+	if n.bufferWhileJoining(data.SequenceNumber, func() { n.HandleCommitMessage(data) }) {
+		return
+	}
 	if n.viewChange.IsInViewChange() {
-		n.log.Error("Node %d is expired and Start to trigger view change", n.NodeID)
+		log.Error("Node %d is expired and Start to trigger view change", n.NodeID)
 		return
 	}
 	// if n.NodeID == 1 {
 	// 	n.log.Error("node 1 is faulty!")
 	// 	return
 	// }
-	n.log.Info(fmt.Sprintf("SeqNumber %d: Received commit message from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+	log.Info(fmt.Sprintf("SeqNumber %d: Received commit message from %d, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
 	if data.ViewNumber != n.viewNumber {
-		n.log.Error(fmt.Sprintf("SeqNumber %d: Commit message view number mismatch. from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+		log.Error(fmt.Sprintf("SeqNumber %d: Commit message view number mismatch. from %d, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
 		return
 	} else if data.Digest != utils.GetDigest(data.RequestMessage) {
-		n.log.Error(fmt.Sprintf("SeqNumber %d: Commit message digest mismatch. from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+		log.Error(fmt.Sprintf("SeqNumber %d: Commit message digest mismatch. from %d, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
 		return
 	} else if data.SequenceNumber < n.cfg.SeqNumberLowerBound || data.SequenceNumber > n.cfg.SeqNumberUpperBound {
-		n.log.Error(fmt.Sprintf("SeqNumber %d: Commit message sequence number out of range. from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+		log.Error(fmt.Sprintf("SeqNumber %d: Commit message sequence number out of range. from %d, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
 		return
-	} else if n.GetCommitSequenceNumber() != -1 && data.SequenceNumber != n.GetCommitSequenceNumber()+1 {
-		n.log.Error(fmt.Sprintf("SeqNumber %d: Commit message sequence number mismatch. from %s, sequence number %d", data.SequenceNumber, data.From, data.SequenceNumber))
+	} else if n.GetCommitSequenceNumber() != -1 && data.SequenceNumber <= n.GetCommitSequenceNumber() {
+		log.Debug(fmt.Sprintf("SeqNumber %d: Commit message from %d arrived after the block was committed", data.SequenceNumber, data.From))
 		return
-	} else {
-		n.AddCommitMessageNumber(data.SequenceNumber)
-		n.log.Info(fmt.Sprintf("SeqNumber %d: Commit message count for sequence %d is now %d", data.SequenceNumber, data.SequenceNumber, n.commitMsgNumber[data.SequenceNumber].Load()))
 	}
-	n.log.Info(fmt.Sprintf("SeqNumber %d: After receiving from %s, current commit messages number is %d", data.SequenceNumber, data.From, n.commitMsgNumber[data.SequenceNumber].Load()))
+	votes := votesOf(n.commitVotes, data.SequenceNumber, data.Digest)
+	if !votes.Add(data.From) {
+		log.Error(fmt.Sprintf("SeqNumber %d: Duplicate commit message from %d", data.SequenceNumber, data.From))
+		return
+	}
+	log.Info(fmt.Sprintf("SeqNumber %d: After receiving from %d, current commit messages number is %d", data.SequenceNumber, data.From, votes.Size()))
+	n.checkCommitted(data)
+}
 
-	if n.GetCommitMessageNumber(data.SequenceNumber) == 2*int32(n.cfg.FaultyNodesNum) {
-		n.log.Info(fmt.Sprintf("SeqNumber %d: Received %d commit messages, enough to reply to client.", data.SequenceNumber, n.commitMsgNumber[data.SequenceNumber].Load()))
-		n.SetCommitSequenceNumber(data.SequenceNumber)
-		n.seq2digest[data.SequenceNumber] = data.Digest
-		go n.TriggerGarbageCollection(data.SequenceNumber, data.Digest)
-		n.SendReplyMessage(data)
+// checkCommitted certifies a block once its commit votes carry a quorum of
+// the voting weight. Certified blocks may complete out of order, they are
+// executed strictly in sequence number order.
+func (n *Node) checkCommitted(data core.CommitMessage) {
+	votes := votesOf(n.commitVotes, data.SequenceNumber, data.Digest)
+	if !votes.Complete(n.quorum()) {
+		return
 	}
+	n.log.Info(fmt.Sprintf("SeqNumber %d: Received %d commit messages, enough to reply to client.", data.SequenceNumber, votes.Size()))
+	n.certified[data.SequenceNumber] = data
+	n.phasesOf(data.SequenceNumber).committed = time.Now()
+	for {
+		next := n.GetCommitSequenceNumber() + 1
+		if n.GetCommitSequenceNumber() == -1 {
+			next = n.firstSeqNumber
+		}
+		certified, ok := n.certified[next]
+		if !ok {
+			return
+		}
+		delete(n.certified, next)
+		n.executeCommitted(certified)
+	}
+}
+
+func (n *Node) executeCommitted(data core.CommitMessage) {
+	n.SetCommitSequenceNumber(data.SequenceNumber)
+	committedBlocks.Inc()
+	committedTxs.Add(int64(len(data.RequestMessage.Txs)))
+	lastCommitted.Set(data.SequenceNumber)
+	n.seq2digest[data.SequenceNumber] = data.Digest
+	n.appendLedger(ledger.Record{
+		Kind:      ledger.KindCommit,
+		Seq:       data.SequenceNumber,
+		View:      data.ViewNumber,
+		Digest:    data.Digest,
+		RequestID: data.RequestMessage.Id,
+		Txs:       data.RequestMessage.Txs,
+		Timestamp: time.Now().Unix(),
+	})
+	n.observePhases(data.SequenceNumber)
+	n.TriggerGarbageCollection(data.SequenceNumber, data.Digest)
+	n.recordCommit(data)
+	n.SendReplyMessage(data)
 }
 
 func (n *Node) HandleCloseMessage(data core.CloseMessage) {
-	n.log.Info(fmt.Sprintf("Received close message from %s", data.From))
-	n.StopChan <- struct{}{}
+	if data.To != n.NodeID {
+		n.log.Warn(fmt.Sprintf("Rejected close message from %d: addressed to node %d", data.From, data.To))
+		return
+	}
+	if err := n.operators.Verify(data.Operator, data.Timestamp, data.SignedBytes(), data.Signature); err != nil {
+		n.log.Warn(fmt.Sprintf("Rejected close message from %d: %v", data.From, err))
+		return
+	}
+	n.log.Info(fmt.Sprintf("Received close message from %d signed by operator %s", data.From, data.Operator))
+	n.RequestStop(fmt.Sprintf("close message from %d signed by operator %s", data.From, data.Operator))
 }
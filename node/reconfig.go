@@ -0,0 +1,338 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/michael112233/pbft/config"
+	"github.com/michael112233/pbft/core"
+	"github.com/michael112233/pbft/ledger"
+	"github.com/michael112233/pbft/utils"
+)
+
+// --------------------------------------------------------
+// Membership Reconfiguration Principle Definition
+// --------------------------------------------------------
+
+// A request carrying a core.Reconfiguration commits like any other request.
+// The change committed at sequence number s takes effect at c = s +
+// checkpoint_interval: every replica switches to the new replica set after
+// executing exactly the same prefix, and requests already in flight finish
+// with the old one. Sequence numbers above c run with the new set and f. A
+// replica that was added fetches the history up to the last stable checkpoint
+// (at least c) from the others before it takes part. The history is sent in
+// chunks that fit into a frame, the joiner asks for the next chunk once f+1
+// replicas sent the same one.
+
+type pendingReconfig struct {
+	seq       int64
+	effective int64
+	reconfig  *core.Reconfiguration
+}
+
+// bufferedMessage is a protocol message received while joining, handled once the state is installed
+type bufferedMessage struct {
+	seq    int64
+	handle func()
+}
+
+// recordCommit remembers a committed request for state transfer and queues its reconfiguration
+func (n *Node) recordCommit(data core.CommitMessage) {
+	n.history = append(n.history, &core.CommittedRequest{
+		SequenceNumber: data.SequenceNumber,
+		ViewNumber:     data.ViewNumber,
+		Digest:         data.Digest,
+		RequestMessage: data.RequestMessage,
+	})
+	if data.RequestMessage.Reconfig != nil {
+		n.queueReconfiguration(data.SequenceNumber, data.RequestMessage.Reconfig)
+	}
+	n.applyReconfigurations(data.SequenceNumber)
+}
+
+// queueReconfiguration schedules the change committed at seq for seq + checkpoint_interval
+func (n *Node) queueReconfiguration(seq int64, reconfig *core.Reconfiguration) {
+	effective := seq + n.cfg.CheckpointInterval
+	n.log.Info(fmt.Sprintf("SeqNumber %d: Reconfiguration committed (%s), effective at sequence number %d", seq, reconfig, effective))
+	n.pendingReconfigs = append(n.pendingReconfigs, pendingReconfig{
+		seq:       seq,
+		effective: effective,
+		reconfig:  reconfig,
+	})
+}
+
+// applyReconfigurations installs every pending change that is effective once seqNumber is committed
+func (n *Node) applyReconfigurations(seqNumber int64) {
+	remaining := make([]pendingReconfig, 0)
+	applied := false
+	for _, p := range n.pendingReconfigs {
+		if p.effective > seqNumber {
+			remaining = append(remaining, p)
+			continue
+		}
+		members, f, err := p.reconfig.Next(config.Members())
+		if err == nil && n.viewChange.leaderElection.LeaderOf(n.viewNumber, members) != n.viewChange.leaderElection.GetLeader(n.viewNumber) {
+			err = fmt.Errorf("the primary of view %d would change", n.viewNumber)
+		}
+		if err != nil {
+			n.log.Error(fmt.Sprintf("SeqNumber %d: Reconfiguration (%s) of sequence number %d rejected: %v", p.effective, p.reconfig, p.seq, err))
+			continue
+		}
+
+		p.reconfig.Install(members)
+		n.cfg.NodeNum = int64(len(members))
+		n.cfg.FaultyNodesNum = f
+		n.membershipSeq = p.effective
+		applied = true
+		n.log.Info(fmt.Sprintf("SeqNumber %d: Replica set is now %v with f=%d", p.effective, members, f))
+		n.appendLedger(ledger.Record{
+			Kind:        ledger.KindReconfig,
+			Seq:         p.effective,
+			View:        n.viewNumber,
+			Timestamp:   time.Now().Unix(),
+			Members:     members,
+			FaultyNodes: f,
+		})
+	}
+	n.pendingReconfigs = remaining
+
+	if applied && !config.IsMember(n.NodeID) {
+		n.log.Info("Node %d was removed from the replica set, stopping", n.NodeID)
+		n.RequestStop("removed from the replica set")
+	}
+}
+
+// bufferWhileJoining keeps protocol messages until the state has been transferred
+func (n *Node) bufferWhileJoining(seq int64, handle func()) bool {
+	if !n.joining {
+		return false
+	}
+	n.buffered = append(n.buffered, bufferedMessage{seq: seq, handle: handle})
+	return true
+}
+
+// --------------------------------------------------------
+// State Transfer
+// --------------------------------------------------------
+
+const (
+	stateRequestInterval = time.Second
+	// stateChunkSize bounds the committed requests of one state response, a
+	// chunk is halved further until it fits into max_frame_size
+	stateChunkSize = 64
+)
+
+// requestState asks every known replica for its state until f+1 of them agree
+func (n *Node) requestState() {
+	n.log.Info("Node %d is not a member yet, requesting state", n.NodeID)
+	for {
+		n.handleMessageLock.Lock()
+		joining := n.joining
+		if joining {
+			n.sendStateRequests()
+		}
+		n.handleMessageLock.Unlock()
+		if !joining {
+			return
+		}
+		time.Sleep(stateRequestInterval)
+	}
+}
+
+// sendStateRequests asks every known replica for the next chunk, the caller holds handleMessageLock
+func (n *Node) sendStateRequests() {
+	for _, id := range config.NodeIDs() {
+		if id == n.NodeID {
+			continue
+		}
+		stateRequest := core.StateRequestMessage{
+			Timestamp:          time.Now().Unix(),
+			From:               n.NodeID,
+			To:                 id,
+			FromSequenceNumber: n.stateFrom,
+		}
+		n.messageHub.Send(core.MsgStateRequestMessage, id, stateRequest, nil)
+	}
+}
+
+func (n *Node) HandleStateRequestMessage(data core.StateRequestMessage) {
+	n.handleMessageLock.Lock()
+	defer n.handleMessageLock.Unlock()
+	// only replicas that were added are served, and only members can serve them
+	if n.joining || n.membershipSeq == -1 || !config.IsMember(data.From) {
+		n.log.Debug(fmt.Sprintf("Ignore state request from %d", data.From))
+		return
+	}
+
+	members := make([]core.Member, 0)
+	for _, id := range config.Members() {
+		addr, _ := config.NodeAddrOf(id)
+		members = append(members, core.Member{ID: id, Addr: addr})
+	}
+	// the last stable checkpoint is the latest point the replicas agree on,
+	// so a replica joining long after it was added does not replay the
+	// requests since c. No change took effect after it (c is at most the
+	// checkpoint), so the current replica set is the set at that point.
+	upTo := n.membershipSeq
+	if n.lastStableCheckpoint > upTo {
+		upTo = n.lastStableCheckpoint
+	}
+	history := make([]*core.CommittedRequest, 0, stateChunkSize)
+	for _, entry := range n.history {
+		if entry.SequenceNumber > upTo || len(history) == stateChunkSize {
+			break
+		}
+		if entry.SequenceNumber >= data.FromSequenceNumber {
+			history = append(history, entry)
+		}
+	}
+	stateResponse := core.StateResponseMessage{
+		Timestamp:          time.Now().Unix(),
+		From:               n.NodeID,
+		To:                 data.From,
+		SequenceNumber:     upTo,
+		ViewNumber:         n.viewNumber,
+		Digest:             n.seq2digest[upTo],
+		Members:            members,
+		FaultyNodesNum:     n.cfg.FaultyNodesNum,
+		History:            history,
+		FromSequenceNumber: data.FromSequenceNumber,
+	}
+	// a single committed request fitted into a preprepare, so it fits here too
+	for len(stateResponse.History) > 1 && !n.messageHub.fits(core.MsgStateResponseMessage, stateResponse) {
+		stateResponse.History = stateResponse.History[:len(stateResponse.History)/2]
+	}
+	n.log.Info(fmt.Sprintf("Send state from sequence number %d up to %d (%d requests) to node %d", data.FromSequenceNumber, upTo, len(stateResponse.History), data.From))
+	n.messageHub.Send(core.MsgStateResponseMessage, data.From, stateResponse, nil)
+}
+
+func (n *Node) HandleStateResponseMessage(data core.StateResponseMessage) {
+	n.handleMessageLock.Lock()
+	defer n.handleMessageLock.Unlock()
+	// a late chunk answers an earlier request, a replica behind the chunks
+	// already accepted cannot complete them
+	if !n.joining || data.FromSequenceNumber != n.stateFrom || data.SequenceNumber < n.stateFrom-1 {
+		return
+	}
+	n.log.Info(fmt.Sprintf("Received state from sequence number %d up to %d (%d requests) from %d", data.FromSequenceNumber, data.SequenceNumber, len(data.History), data.From))
+	for _, entry := range data.History {
+		if entry.Digest != utils.GetDigest(entry.RequestMessage) {
+			n.log.Error(fmt.Sprintf("State response digest mismatch. from %d, sequence number %d", data.From, entry.SequenceNumber))
+			return
+		}
+	}
+
+	// a chunk is accepted once f+1 replicas sent exactly the same one, the
+	// threshold never drops below the f this replica was configured with
+	key := stateKey(data)
+	if n.stateVotes[key] == nil {
+		n.stateVotes[key] = make(map[int64]bool)
+	}
+	n.stateVotes[key][data.From] = true
+	f := data.FaultyNodesNum
+	if n.cfg.FaultyNodesNum > f {
+		f = n.cfg.FaultyNodesNum
+	}
+	if int64(len(n.stateVotes[key])) < f+1 {
+		return
+	}
+	n.stateVotes = make(map[string]map[int64]bool)
+	if !data.Complete() {
+		// the replicas may be at different checkpoints, only the chunk itself has to match
+		n.stateHistory = append(n.stateHistory, data.History...)
+		n.stateFrom = data.History[len(data.History)-1].SequenceNumber + 1
+		n.sendStateRequests()
+		return
+	}
+	data.History = append(n.stateHistory, data.History...)
+	n.stateHistory = nil
+	n.installState(data)
+}
+
+// stateKey identifies the content of a state response independently of its
+// sender, only the chunk completing the state includes where it ends
+func stateKey(data core.StateResponseMessage) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d;", data.FromSequenceNumber)
+	if data.Complete() {
+		fmt.Fprintf(hash, "%d/%d/%s/%d;", data.SequenceNumber, data.ViewNumber, data.Digest, data.FaultyNodesNum)
+		for _, member := range data.Members {
+			fmt.Fprintf(hash, "%d@%s;", member.ID, member.Addr)
+		}
+	}
+	for _, entry := range data.History {
+		fmt.Fprintf(hash, "%d/%d/%s;", entry.SequenceNumber, entry.ViewNumber, entry.Digest)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (n *Node) installState(data core.StateResponseMessage) {
+	ids := make([]int64, 0, len(data.Members))
+	reconfig := &core.Reconfiguration{}
+	for _, member := range data.Members {
+		ids = append(ids, member.ID)
+		reconfig.Add = append(reconfig.Add, member)
+	}
+	reconfig.Install(ids)
+	n.cfg.NodeNum = int64(len(ids))
+	n.cfg.FaultyNodesNum = data.FaultyNodesNum
+	n.viewNumber = data.ViewNumber
+	currentView.Set(n.viewNumber)
+
+	for _, entry := range data.History {
+		n.history = append(n.history, entry)
+		n.seq2digest[entry.SequenceNumber] = entry.Digest
+		n.appendLedger(ledger.Record{
+			Kind:      ledger.KindCommit,
+			Seq:       entry.SequenceNumber,
+			View:      entry.ViewNumber,
+			Digest:    entry.Digest,
+			RequestID: entry.RequestMessage.Id,
+			Txs:       entry.RequestMessage.Txs,
+			Timestamp: time.Now().Unix(),
+		})
+	}
+	n.appendLedger(ledger.Record{
+		Kind:        ledger.KindReconfig,
+		Seq:         data.SequenceNumber,
+		View:        data.ViewNumber,
+		Timestamp:   time.Now().Unix(),
+		Members:     ids,
+		FaultyNodes: data.FaultyNodesNum,
+	})
+
+	c := data.SequenceNumber
+	if len(data.History) > 0 {
+		n.firstSeqNumber = data.History[0].SequenceNumber
+	}
+	// changes committed before c that take effect after it are still pending
+	for _, entry := range data.History {
+		if entry.RequestMessage.Reconfig != nil && entry.SequenceNumber+n.cfg.CheckpointInterval > c {
+			n.queueReconfiguration(entry.SequenceNumber, entry.RequestMessage.Reconfig)
+		}
+	}
+	n.SetPreprepareSequenceNumber(c)
+	n.SetPrepareSequenceNumber(c)
+	n.SetCommitSequenceNumber(c)
+	lastCommitted.Set(c)
+	sequenceNumber = c
+	n.membershipSeq = c
+	if n.isCheckpoint(c) {
+		n.lastStableCheckpoint = c
+		stableCheckpoint.Set(c)
+	}
+	n.joining = false
+	n.log.Info(fmt.Sprintf("Installed state up to sequence number %d, replica set is %v with f=%d", c, ids, data.FaultyNodesNum))
+
+	buffered := n.buffered
+	n.buffered = nil
+	go func() {
+		for _, message := range buffered {
+			if message.seq > c {
+				message.handle()
+			}
+		}
+	}()
+}
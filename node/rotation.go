@@ -0,0 +1,154 @@
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/michael112233/pbft/core"
+)
+
+// --------------------------------------------------------
+// Rotating Primary Principle Definition
+// --------------------------------------------------------
+
+// With rotation_interval k > 0 the client sends every request to all
+// replicas, and the primary changes every k sequence numbers instead of only
+// on a view change. Counting from the first sequence number b of the run,
+// term t covers b+t*k .. b+t*k+k-1 and its primary is the one the election
+// picks for view + t. Once the primary of a term proposed its last sequence
+// number it hands off to the next primary, which starts proposing after it
+// accepted the same preprepare itself. No view change is involved.
+
+func (n *Node) rotating() bool {
+	return n.cfg.RotationInterval > 0
+}
+
+// primaryOf returns the replica allowed to propose seqNumber
+func (n *Node) primaryOf(seqNumber int64) int64 {
+	if !n.rotating() || n.firstSeqNumber == -1 {
+		return n.viewChange.leaderElection.GetLeader(n.viewNumber)
+	}
+	return n.viewChange.leaderElection.GetLeader(n.viewNumber + (seqNumber-n.firstSeqNumber)/n.cfg.RotationInterval)
+}
+
+func (n *Node) termStart(seqNumber int64) bool {
+	return n.firstSeqNumber != -1 && (seqNumber-n.firstSeqNumber)%n.cfg.RotationInterval == 0
+}
+
+func requestKey(request *core.RequestMessage) string {
+	return fmt.Sprintf("%d/%d", request.From, request.Id)
+}
+
+// queueRequest keeps a request until some primary proposes it
+func (n *Node) queueRequest(data core.RequestMessage) {
+	if n.seenRequests[requestKey(&data)] {
+		n.log.Debug(fmt.Sprintf("Request %d of client %d was already proposed", data.Id, data.From))
+		return
+	}
+	n.seenRequests[requestKey(&data)] = true
+	n.pendingRequests = append(n.pendingRequests, data)
+	n.tryPropose()
+}
+
+// tryPropose proposes queued requests as long as this replica is the primary of the next sequence number
+func (n *Node) tryPropose() {
+	defer func() { queuedRequests.Set(int64(len(n.pendingRequests))) }()
+	for len(n.pendingRequests) > 0 {
+		last := n.GetPreprepareSequenceNumber()
+		next := last + 1
+		if n.primaryOf(next) != n.NodeID {
+			return
+		}
+		if last != -1 && n.termStart(next) && n.primaryOf(last) != n.NodeID {
+			if n.handoffSeq != last || n.handoffDigest != n.lastPreprepareDigest {
+				return
+			}
+		}
+		request := n.pendingRequests[0]
+		n.pendingRequests = n.pendingRequests[1:]
+		n.SendPreprepareMessage(request)
+	}
+}
+
+// afterPropose advances the own preprepare state of the primary and hands off at the end of its term
+func (n *Node) afterPropose(seqNumber int64, digest string) {
+	n.SetPreprepareSequenceNumber(seqNumber)
+	n.lastPreprepareDigest = digest
+
+	next := n.primaryOf(seqNumber + 1)
+	if !n.termStart(seqNumber+1) || next == n.NodeID {
+		return
+	}
+	handoffMessage := core.HandoffMessage{
+		Timestamp:      time.Now().Unix(),
+		From:           n.NodeID,
+		To:             next,
+		SequenceNumber: seqNumber,
+		ViewNumber:     n.viewNumber,
+		Digest:         digest,
+	}
+	n.log.Info(fmt.Sprintf("SeqNumber %d: Term ends, hand off to node %d", seqNumber, next))
+	n.messageHub.Send(core.MsgHandoffMessage, next, handoffMessage, nil)
+}
+
+// acceptProposal drops an accepted request from the queue and handles a preprepare that was early
+func (n *Node) acceptProposal(data core.PreprepareMessage) {
+	n.lastPreprepareDigest = data.Digest
+	key := requestKey(data.RequestMessage)
+	n.seenRequests[key] = true
+	for i, request := range n.pendingRequests {
+		if requestKey(&request) == key {
+			n.pendingRequests = append(n.pendingRequests[:i], n.pendingRequests[i+1:]...)
+			break
+		}
+	}
+
+	if early, ok := n.earlyPreprepares[data.SequenceNumber+1]; ok {
+		delete(n.earlyPreprepares, data.SequenceNumber+1)
+		go n.HandlePreprepareMessage(early)
+	}
+	n.tryPropose()
+}
+
+// holdEarlyPreprepare keeps a preprepare of the next term that overtook the
+// last one of the previous term, which comes from another primary. It is
+// called once the preprepare is known to be valid and to come from the
+// primary of its sequence number, anything beyond the next term is refused.
+func (n *Node) holdEarlyPreprepare(data core.PreprepareMessage) bool {
+	last := n.GetPreprepareSequenceNumber()
+	if !n.rotating() || last == -1 || data.SequenceNumber <= last+1 {
+		return false
+	}
+	term := func(seqNumber int64) int64 { return (seqNumber - n.firstSeqNumber) / n.cfg.RotationInterval }
+	if term(data.SequenceNumber) != term(last+1)+1 {
+		n.log.Error(fmt.Sprintf("SeqNumber %d: Preprepare message from %d is beyond the next term, %d is not accepted yet", data.SequenceNumber, data.From, last+1))
+		return true
+	}
+	if _, ok := n.earlyPreprepares[data.SequenceNumber]; ok {
+		n.log.Error(fmt.Sprintf("SeqNumber %d: Duplicate early preprepare message from %d", data.SequenceNumber, data.From))
+		return true
+	}
+	n.log.Debug(fmt.Sprintf("SeqNumber %d: Hold preprepare message from %d until %d is accepted", data.SequenceNumber, data.From, data.SequenceNumber-1))
+	n.earlyPreprepares[data.SequenceNumber] = data
+	return true
+}
+
+func (n *Node) HandleHandoffMessage(data core.HandoffMessage) {
+	n.handleMessageLock.Lock()
+	defer n.handleMessageLock.Unlock()
+	log := n.msgLog(core.MsgHandoffMessage, data.SequenceNumber, data.ViewNumber, data.From)
+	if !n.rotating() {
+		return
+	}
+	if data.ViewNumber != n.viewNumber {
+		log.Error(fmt.Sprintf("SeqNumber %d: Handoff message view number mismatch. from %d", data.SequenceNumber, data.From))
+		return
+	} else if n.primaryOf(data.SequenceNumber) != data.From || n.primaryOf(data.SequenceNumber+1) != n.NodeID || !n.termStart(data.SequenceNumber+1) {
+		log.Error(fmt.Sprintf("SeqNumber %d: Handoff message from %d does not end its term", data.SequenceNumber, data.From))
+		return
+	}
+	log.Info(fmt.Sprintf("SeqNumber %d: Received handoff message from %d, term starts at %d", data.SequenceNumber, data.From, data.SequenceNumber+1))
+	n.handoffSeq = data.SequenceNumber
+	n.handoffDigest = data.Digest
+	n.tryPropose()
+}
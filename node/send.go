@@ -12,85 +12,101 @@ import (
 var sequenceNumber int64 = -1
 
 func (n *Node) SendPreprepareMessage(data core.RequestMessage) {
-	if sequenceNumber == -1 {
+	if n.rotating() && n.GetPreprepareSequenceNumber() != -1 {
+		// the previous sequence numbers may have been proposed by other primaries
+		sequenceNumber = n.GetPreprepareSequenceNumber() + 1
+	} else if sequenceNumber == -1 {
 		sequenceNumber = GenerateRandomSequenceNumber(n.cfg.SeqNumberUpperBound, n.cfg.SeqNumberLowerBound)
 	} else {
 		sequenceNumber++
 	}
-	for _, othersIp := range config.NodeAddr {
-		if othersIp == n.GetAddr() {
-			continue
-		}
+	if n.firstSeqNumber == -1 {
+		n.firstSeqNumber = sequenceNumber
+	}
+	digest := utils.GetDigest(&data)
+	n.phasesOf(sequenceNumber).preprepared = time.Now()
+	// the preprepare is the prepare vote of the primary
+	votesOf(n.prepareVotes, sequenceNumber, digest).Add(n.NodeID)
+	for _, othersID := range n.peers() {
 		preprepareMessage := core.PreprepareMessage{
 			Timestamp:      time.Now().Unix(),
-			From:           n.GetAddr(),
-			To:             othersIp,
+			From:           n.NodeID,
+			To:             othersID,
 			SequenceNumber: sequenceNumber,
 			ViewNumber:     n.viewNumber,
-			Digest:         utils.GetDigest(&data),
+			Digest:         digest,
 			RequestMessage: &data,
 		}
-		n.log.Info(fmt.Sprintf("Send preprepare message to %s", othersIp))
-		n.messageHub.Send(core.MsgPreprepareMessage, othersIp, preprepareMessage, nil)
+		n.log.Info(fmt.Sprintf("Send preprepare message to node %d", othersID))
+		n.messageHub.Send(core.MsgPreprepareMessage, othersID, preprepareMessage, nil)
+	}
+	if n.rotating() {
+		n.afterPropose(sequenceNumber, digest)
 	}
 }
 
 func (n *Node) SendPrepareMessage(data core.PreprepareMessage) {
-	n.AddPrepareMessageNumber(data.SequenceNumber)
-	n.log.Info(fmt.Sprintf("SeqNumber %d: After receiving from %s to itself, current prepare messages number is %d", data.SequenceNumber, data.From, n.prepareMsgNumber[data.SequenceNumber].Load()))
+	votes := votesOf(n.prepareVotes, data.SequenceNumber, data.Digest)
+	votes.Add(n.NodeID)
+	n.log.Info(fmt.Sprintf("SeqNumber %d: After receiving from %d to itself, current prepare messages number is %d", data.SequenceNumber, data.From, votes.Size()))
 	// Send Prepare Message to Others.
-	for _, othersIp := range config.NodeAddr {
-		if othersIp == n.GetAddr() {
-			continue
-		}
+	for _, othersID := range n.peers() {
 		prepareMessage := core.PrepareMessage{
 			Timestamp:      time.Now().Unix(),
-			From:           n.GetAddr(),
-			To:             othersIp,
+			From:           n.NodeID,
+			To:             othersID,
 			SequenceNumber: data.SequenceNumber,
 			ViewNumber:     n.viewNumber,
 			Digest:         data.Digest,
 			RequestMessage: data.RequestMessage,
 		}
-		n.log.Info(fmt.Sprintf("Send prepare message to %s", othersIp))
-		n.messageHub.Send(core.MsgPrepareMessage, othersIp, prepareMessage, nil)
+		n.log.Info(fmt.Sprintf("Send prepare message to node %d", othersID))
+		n.messageHub.Send(core.MsgPrepareMessage, othersID, prepareMessage, nil)
 	}
+	// prepare messages of the others may have arrived before the preprepare
+	n.checkPrepared(data.SequenceNumber, data.Digest, data.RequestMessage)
 }
 
-func (n *Node) SendCommitMessage(data core.PrepareMessage) {
-	n.AddCommitMessageNumber(data.SequenceNumber)
-	n.log.Info(fmt.Sprintf("SeqNumber %d: After receiving from %s to itself, current commit messages number is %d", data.SequenceNumber, data.From, n.commitMsgNumber[data.SequenceNumber].Load()))
+func (n *Node) SendCommitMessage(seqNumber int64, digest string, request *core.RequestMessage) {
+	votes := votesOf(n.commitVotes, seqNumber, digest)
+	votes.Add(n.NodeID)
+	n.log.Info(fmt.Sprintf("SeqNumber %d: After voting itself, current commit messages number is %d", seqNumber, votes.Size()))
 
 	// Send Prepare Message to Others.
-	for _, othersIp := range config.NodeAddr {
-		if othersIp == n.GetAddr() {
-			continue
-		}
+	for _, othersID := range n.peers() {
 		commitMessage := core.CommitMessage{
 			Timestamp:      time.Now().Unix(),
-			From:           n.GetAddr(),
-			To:             othersIp,
-			SequenceNumber: data.SequenceNumber,
+			From:           n.NodeID,
+			To:             othersID,
+			SequenceNumber: seqNumber,
 			ViewNumber:     n.viewNumber,
-			Digest:         data.Digest,
-			RequestMessage: data.RequestMessage,
+			Digest:         digest,
+			RequestMessage: request,
 		}
-		n.log.Info(fmt.Sprintf("Send commit message to %s", othersIp))
-		n.messageHub.Send(core.MsgCommitMessage, othersIp, commitMessage, nil)
+		n.log.Info(fmt.Sprintf("Send commit message to node %d", othersID))
+		n.messageHub.Send(core.MsgCommitMessage, othersID, commitMessage, nil)
 	}
+	n.checkCommitted(core.CommitMessage{
+		From:           n.NodeID,
+		SequenceNumber: seqNumber,
+		ViewNumber:     n.viewNumber,
+		Digest:         digest,
+		RequestMessage: request,
+	})
 }
 
 func (n *Node) SendReplyMessage(data core.CommitMessage) {
 	replyMessage := core.ReplyMessage{
 		Timestamp:      time.Now().Unix(),
-		From:           n.GetAddr(),
-		To:             config.ClientAddr,
+		From:           n.NodeID,
+		To:             config.ClientID,
 		SequenceNumber: data.SequenceNumber,
 		ViewNumber:     n.viewNumber,
+		Digest:         data.Digest,
 		RequestMessage: data.RequestMessage,
 	}
-	n.log.Info(fmt.Sprintf("Send reply message to %s", config.ClientAddr))
+	n.log.Info(fmt.Sprintf("Send reply message to client %d", config.ClientID))
 	timerID := fmt.Sprintf("request_%d_%d", n.NodeID, data.RequestMessage.Id)
 	n.StopExpireTimer(timerID)
-	n.messageHub.Send(core.MsgReplyMessage, config.ClientAddr, replyMessage, nil)
+	n.messageHub.Send(core.MsgReplyMessage, config.ClientID, replyMessage, nil)
 }
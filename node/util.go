@@ -3,10 +3,38 @@ package node
 import (
 	"math/rand"
 	"time"
+
+	"github.com/michael112233/pbft/config"
+	"github.com/michael112233/pbft/ledger"
+	"github.com/michael112233/pbft/logger"
 )
 
 // GenerateSequenceNumber generates a random int64 sequence number
 func GenerateRandomSequenceNumber(upperBound int64, lowerBound int64) int64 {
 	rand.Seed(time.Now().UnixNano())
-	return rand.Int63() % (upperBound - lowerBound) + lowerBound
+	return rand.Int63()%(upperBound-lowerBound) + lowerBound
+}
+
+// appendLedger writes a record into the committed history of this replica
+func (n *Node) appendLedger(record ledger.Record) {
+	if err := n.ledger.Append(record); err != nil {
+		n.log.Error("failed to append %s record for sequence number %d to ledger: %v", record.Kind, record.Seq, err)
+	}
+}
+
+// msgLog tags the lines logged while handling a message with its fields
+func (n *Node) msgLog(msgType string, seqNumber int64, viewNumber int64, from int64) *logger.Logger {
+	return n.log.With("type", msgType, "seq", seqNumber, "view", viewNumber, "from", from)
+}
+
+// peers returns the ids of every other member of the replica set
+func (n *Node) peers() []int64 {
+	members := config.Members()
+	ids := make([]int64, 0, len(members))
+	for _, id := range members {
+		if id != n.NodeID {
+			ids = append(ids, id)
+		}
+	}
+	return ids
 }
@@ -19,32 +19,42 @@ type ViewChanger struct {
 	currentView           int64
 	currentSequenceNumber int64
 	leaderElection        *leader_election.LeaderElection
-	addr2vcMsg            map[string]core.ViewChangeMessage
+	vcMsgs                map[int64]core.ViewChangeMessage
+	vcVotes               *core.VoteSet
 
-	addr2vcMsgLock sync.Mutex
+	vcMsgsLock sync.Mutex
 }
 
-func NewViewChanger(cfg *config.Config) *ViewChanger {
+func NewViewChanger(cfg *config.Config) (*ViewChanger, error) {
+	leaderElection, err := leader_election.NewLeaderElection(cfg)
+	if err != nil {
+		return nil, err
+	}
 	return &ViewChanger{
 		isInViewChange: false,
 		currentView:    -1,
-		leaderElection: leader_election.NewLeaderElection(cfg),
-		addr2vcMsg:     make(map[string]core.ViewChangeMessage),
-	}
+		leaderElection: leaderElection,
+		vcMsgs:         make(map[int64]core.ViewChangeMessage),
+		vcVotes:        core.NewVoteSet(),
+	}, nil
 }
 
+// StartViewChange leaves currentView from the stable checkpoint
+// currentSequenceNumber.
 func (vc *ViewChanger) StartViewChange(currentView int64, currentSequenceNumber int64) {
 	vc.isInViewChange = true
 	vc.currentView = currentView
 	vc.currentSequenceNumber = currentSequenceNumber
-	vc.addr2vcMsg = make(map[string]core.ViewChangeMessage)
+	vc.vcMsgs = make(map[int64]core.ViewChangeMessage)
+	vc.vcVotes = core.NewVoteSet()
 }
 
 func (vc *ViewChanger) ResetViewChanger() {
 	vc.isInViewChange = false
 	vc.currentView = -1
 	vc.currentSequenceNumber = -1
-	vc.addr2vcMsg = make(map[string]core.ViewChangeMessage)
+	vc.vcMsgs = make(map[int64]core.ViewChangeMessage)
+	vc.vcVotes = core.NewVoteSet()
 }
 
 func (vc *ViewChanger) IsInViewChange() bool {
@@ -59,7 +69,7 @@ func (vc *ViewChanger) IsInViewChange() bool {
 func (n *Node) SendViewChangeMessage() {
 	havePreparedList := make(map[int64]bool)
 	for seqNumber := n.lastStableCheckpoint + 1; seqNumber <= n.lastPrepareSeqNumber; seqNumber++ {
-		if n.prepareMsgNumber[seqNumber].Load() == 2*int32(n.cfg.FaultyNodesNum) {
+		if n.prepared[seqNumber] {
 			havePreparedList[seqNumber] = true
 		}
 	}
@@ -68,18 +78,15 @@ func (n *Node) SendViewChangeMessage() {
 		Timestamp:           time.Now().Unix(),
 		CheckpointSeqNumber: n.lastStableCheckpoint,
 		ViewNumber:          n.viewChange.currentView + 1,
-		CheckpointMsgNumber: n.checkpointList[n.lastStableCheckpoint].Load(),
-		From:                n.GetAddr(),
+		CheckpointMsgNumber: int32(votesOf(n.checkpointVotes, n.lastStableCheckpoint, n.seq2digest[n.lastStableCheckpoint]).Size()),
+		From:                n.NodeID,
 		HavePreparedList:    havePreparedList,
-		To:                  "",
+		To:                  -1,
 	}
-	for _, othersIp := range config.NodeAddr {
-		if othersIp == n.GetAddr() {
-			continue
-		}
-		viewChangeMessage.To = othersIp
-		n.log.Info(fmt.Sprintf("Send view change message to %s", othersIp))
-		n.messageHub.Send(core.MsgViewChangeMessage, othersIp, viewChangeMessage, nil)
+	for _, othersID := range n.peers() {
+		viewChangeMessage.To = othersID
+		n.log.Info(fmt.Sprintf("Send view change message to node %d", othersID))
+		n.messageHub.Send(core.MsgViewChangeMessage, othersID, viewChangeMessage, nil)
 	}
 }
 
@@ -91,8 +98,8 @@ func (n *Node) sendNewViewMessage() {
 
 	// newViewMessage := core.NewViewMessage{
 	// 	Timestamp:  time.Now().Unix(),
-	// 	From:       n.GetAddr(),
-	// 	To:         "",
+	// 	From:       n.NodeID,
+	// 	To:         -1,
 	// 	ViewNumber: n.viewChange.currentView,
 	// }
 }
@@ -103,25 +110,29 @@ func (n *Node) sendNewViewMessage() {
 func (n *Node) HandleViewChangeMessage(data core.ViewChangeMessage) {
 	n.handleMessageLock.Lock()
 	defer n.handleMessageLock.Unlock()
+	log := n.msgLog(core.MsgViewChangeMessage, data.CheckpointSeqNumber, data.ViewNumber, data.From)
 	intendedViewNumber := data.ViewNumber
 	expectedLeader := n.viewChange.leaderElection.GetLeader(intendedViewNumber)
-	if n.GetAddr() != expectedLeader {
+	if n.NodeID != expectedLeader {
 		return
 	}
 	if intendedViewNumber != n.viewChange.currentView+1 {
-		n.log.Error(fmt.Sprintf("View number mismatch. from %s, sequence number %d", data.From, data.CheckpointSeqNumber))
+		log.Error(fmt.Sprintf("View number mismatch. from %d, sequence number %d", data.From, data.CheckpointSeqNumber))
 		return
 	}
 
-	n.log.Info(fmt.Sprintf("Received view change message from %s, sequence number %d", data.From, data.CheckpointSeqNumber))
+	log.Info(fmt.Sprintf("Received view change message from %d, sequence number %d", data.From, data.CheckpointSeqNumber))
 
-	n.viewChange.addr2vcMsgLock.Lock()
-	n.viewChange.addr2vcMsg[data.From] = data
-	vcMsgNumber := len(n.viewChange.addr2vcMsg)
-	n.viewChange.addr2vcMsgLock.Unlock()
+	n.viewChange.vcMsgsLock.Lock()
+	n.viewChange.vcMsgs[data.From] = data
+	// the new primary votes for its own view
+	n.viewChange.vcVotes.Add(n.NodeID)
+	n.viewChange.vcVotes.Add(data.From)
+	complete := n.viewChange.vcVotes.Complete(n.quorum())
+	n.viewChange.vcMsgsLock.Unlock()
 
-	if vcMsgNumber == 2*int(n.cfg.FaultyNodesNum) {
-		n.log.Info(fmt.Sprintf("Received enough view change messages, start new view %d", intendedViewNumber))
+	if complete {
+		log.Info(fmt.Sprintf("Received enough view change messages, start new view %d", intendedViewNumber))
 		n.sendNewViewMessage()
 	}
 }
@@ -119,9 +119,20 @@ if [[ "$need_build" == "true" ]]; then
   GOOS=linux GOARCH="$goarch" CGO_ENABLED=0 go build -o pbft_main main.go
 fi
 
+# Replicas only stop on close messages signed by an operator of config/run.json,
+# whose keys are created once with `./pbft_main keygen -m remote` and copied
+# to every machine (the replicas only need the .pub files)
+operators=$(grep -o '"operators": *"[^"]*"' config/run.json | sed 's/.*: *"\(.*\)"/\1/' || true)
+for name in ${operators//,/ }; do
+  if [[ ! -f "certs/operator-$name.pub" ]]; then
+    echo "Error: certs/operator-$name.pub is missing, run ./pbft_main keygen -m remote once and copy certs/ to every machine" >&2
+    exit 1
+  fi
+done
+
 echo "Starting role=$ROLE ${NODE_ID:+nodeId=$NODE_ID} in remote mode..."
 
-run_cmd=(./pbft_main -r "$ROLE" -m remote)
+run_cmd=(./pbft_main "$ROLE" -m remote)
 if [[ "$ROLE" == "node" ]]; then
   run_cmd+=( -n "$NODE_ID" )
 elif [[ "$ROLE" == "client" ]]; then
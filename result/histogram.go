@@ -0,0 +1,183 @@
+package result
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michael112233/pbft/logger"
+)
+
+// --------------------------------------------------------
+// Latency Histograms
+// --------------------------------------------------------
+
+// names of the histograms recorded by the client and the replicas
+const (
+	// RequestLatency is measured by the client from sending a request to
+	// accepting its result
+	RequestLatency = "request_latency"
+	// the phases of a sequence number on a replica
+	PhasePrepare = "preprepare_to_prepared"
+	PhaseCommit  = "prepared_to_committed"
+	PhaseExecute = "committed_to_executed"
+)
+
+// BucketBounds are the upper bounds of the histogram buckets
+var BucketBounds = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second,
+}
+
+// Histogram keeps every observed duration, a run observes one per request or
+// sequence number, so percentiles are exact.
+type Histogram struct {
+	name    string
+	samples []time.Duration
+	lock    sync.Mutex
+}
+
+var (
+	histograms     = make(map[string]*Histogram)
+	histogramsLock sync.Mutex
+)
+
+// GetHistogram returns the histogram called name, creating it on first use
+func GetHistogram(name string) *Histogram {
+	histogramsLock.Lock()
+	defer histogramsLock.Unlock()
+	if histograms[name] == nil {
+		histograms[name] = &Histogram{name: name}
+	}
+	return histograms[name]
+}
+
+func Observe(name string, d time.Duration) {
+	GetHistogram(name).Observe(d)
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.samples = append(h.samples, d)
+}
+
+// Bucket counts the samples above the previous bound and at most UpperBound,
+// the last bucket has no upper bound
+type Bucket struct {
+	UpperBound time.Duration
+	Count      int
+}
+
+type HistogramSnapshot struct {
+	Name    string
+	Count   int
+	Min     time.Duration
+	Max     time.Duration
+	Mean    time.Duration
+	Sum     time.Duration
+	P50     time.Duration
+	P90     time.Duration
+	P99     time.Duration
+	Buckets []Bucket
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.lock.Lock()
+	samples := append([]time.Duration(nil), h.samples...)
+	h.lock.Unlock()
+
+	s := HistogramSnapshot{Name: h.name, Count: len(samples)}
+	if len(samples) == 0 {
+		return s
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	total := time.Duration(0)
+	for _, sample := range samples {
+		total += sample
+	}
+	s.Min = samples[0]
+	s.Max = samples[len(samples)-1]
+	s.Sum = total
+	s.Mean = total / time.Duration(len(samples))
+	s.P50 = percentile(samples, 50)
+	s.P90 = percentile(samples, 90)
+	s.P99 = percentile(samples, 99)
+
+	s.Buckets = make([]Bucket, len(BucketBounds)+1)
+	for i, bound := range BucketBounds {
+		s.Buckets[i].UpperBound = bound
+	}
+	s.Buckets[len(BucketBounds)].UpperBound = time.Duration(math.MaxInt64)
+	for _, sample := range samples {
+		i := sort.Search(len(BucketBounds), func(i int) bool { return sample <= BucketBounds[i] })
+		s.Buckets[i].Count++
+	}
+	return s
+}
+
+// percentile uses the nearest rank of sorted samples
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Snapshots returns every histogram with at least one sample, sorted by name
+func Snapshots() []HistogramSnapshot {
+	histogramsLock.Lock()
+	names := make([]string, 0, len(histograms))
+	for name := range histograms {
+		names = append(names, name)
+	}
+	histogramsLock.Unlock()
+	sort.Strings(names)
+
+	snapshots := make([]HistogramSnapshot, 0, len(names))
+	for _, name := range names {
+		if s := GetHistogram(name).Snapshot(); s.Count > 0 {
+			snapshots = append(snapshots, s)
+		}
+	}
+	return snapshots
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (s HistogramSnapshot) String() string {
+	return fmt.Sprintf("%s: count=%d min=%.2fms mean=%.2fms p50=%.2fms p90=%.2fms p99=%.2fms max=%.2fms",
+		s.Name, s.Count, ms(s.Min), ms(s.Mean), ms(s.P50), ms(s.P90), ms(s.P99), ms(s.Max))
+}
+
+// BucketString lists the non-empty buckets, e.g. "<=5ms:3 <=10ms:7 >10s:1"
+func (s HistogramSnapshot) BucketString() string {
+	parts := make([]string, 0, len(s.Buckets))
+	for i, bucket := range s.Buckets {
+		if bucket.Count == 0 {
+			continue
+		}
+		if i == len(BucketBounds) {
+			parts = append(parts, fmt.Sprintf(">%s:%d", BucketBounds[len(BucketBounds)-1], bucket.Count))
+		} else {
+			parts = append(parts, fmt.Sprintf("<=%s:%d", bucket.UpperBound, bucket.Count))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// LogHistograms writes every histogram of the process to l
+func LogHistograms(l *logger.Logger) {
+	for _, s := range Snapshots() {
+		l.Info("%s", s.String())
+		l.Info("%s buckets: %s", s.Name, s.BucketString())
+	}
+}
@@ -0,0 +1,154 @@
+package result
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/michael112233/pbft/config"
+)
+
+// --------------------------------------------------------
+// Result Records
+// --------------------------------------------------------
+
+var viewChanges atomic.Int64
+
+// SetViewChanges records the number of view changes the client has seen, i.e. the last view number
+func SetViewChanges(n int64) {
+	viewChanges.Store(n)
+}
+
+// LatencySummary is the request latency of a run in milliseconds
+type LatencySummary struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean_ms"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+// Record describes one run, written by the client once all requests were sent
+type Record struct {
+	StartTime       time.Time      `json:"start_time"`
+	EndTime         time.Time      `json:"end_time"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	GitRevision     string         `json:"git_revision"`
+	NodeNum         int64          `json:"node_num"`
+	FaultyNodesNum  int64          `json:"faulty_nodes_num"`
+	MaxBlockSize    int64          `json:"max_block_size"`
+	InjectSpeed     int64          `json:"inject_speed"`
+	CommittedTxs    int64          `json:"committed_txs"`
+	TPS             float64        `json:"tps"`
+	Latency         LatencySummary `json:"latency"`
+	ViewChanges     int64          `json:"view_changes"`
+	Config          *config.Config `json:"config"`
+}
+
+// NewRecord collects the result of the run so far with cfg as its configuration
+func NewRecord(cfg *config.Config) *Record {
+	SetEndTime(time.Now())
+	latency := GetHistogram(RequestLatency).Snapshot()
+	return &Record{
+		StartTime:       startTime,
+		EndTime:         endTime,
+		DurationSeconds: endTime.Sub(startTime).Seconds(),
+		GitRevision:     gitRevision(),
+		NodeNum:         cfg.NodeNum,
+		FaultyNodesNum:  cfg.FaultyNodesNum,
+		MaxBlockSize:    cfg.MaxBlockSize,
+		InjectSpeed:     cfg.InjectSpeed,
+		CommittedTxs:    committedTransactionNum.Load(),
+		TPS:             CalculateTPS(),
+		Latency: LatencySummary{
+			Count: latency.Count,
+			Mean:  ms(latency.Mean),
+			P50:   ms(latency.P50),
+			P90:   ms(latency.P90),
+			P99:   ms(latency.P99),
+			Max:   ms(latency.Max),
+		},
+		ViewChanges: viewChanges.Load(),
+		Config:      cfg,
+	}
+}
+
+// gitRevision is the commit the binary was built from, "-dirty" marks local changes
+func gitRevision() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	revision, modified := "unknown", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+var csvHeader = []string{
+	"start_time", "end_time", "duration_seconds", "git_revision",
+	"node_num", "faulty_nodes_num", "max_block_size", "inject_speed",
+	"wire_format", "election_method", "committed_txs", "tps",
+	"latency_count", "latency_mean_ms", "latency_p50_ms", "latency_p90_ms", "latency_p99_ms", "latency_max_ms",
+	"view_changes", "record",
+}
+
+// Write stores the record as <dir>/<start time>_n<nodes>_b<block size>.json
+// and appends it as a row to <dir>/results.csv. It returns the JSON file.
+func (r *Record) Write(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s_n%d_b%d.json", r.StartTime.Format("20060102-150405"), r.NodeNum, r.MaxBlockSize)
+	path := filepath.Join(dir, name)
+	data, err := json.MarshalIndent(r, "", "    ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return "", err
+	}
+	return path, r.appendCSV(filepath.Join(dir, "results.csv"), name)
+}
+
+func (r *Record) appendCSV(path, recordName string) error {
+	_, err := os.Stat(path)
+	isNew := os.IsNotExist(err)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	i := func(v int64) string { return strconv.FormatInt(v, 10) }
+	w := csv.NewWriter(file)
+	if isNew {
+		w.Write(csvHeader)
+	}
+	w.Write([]string{
+		r.StartTime.Format(time.RFC3339), r.EndTime.Format(time.RFC3339), f(r.DurationSeconds), r.GitRevision,
+		i(r.NodeNum), i(r.FaultyNodesNum), i(r.MaxBlockSize), i(r.InjectSpeed),
+		r.Config.WireFormat, r.Config.ElectionMethod, i(r.CommittedTxs), f(r.TPS),
+		i(int64(r.Latency.Count)), f(r.Latency.Mean), f(r.Latency.P50), f(r.Latency.P90), f(r.Latency.P99), f(r.Latency.Max),
+		i(r.ViewChanges), recordName,
+	})
+	w.Flush()
+	return w.Error()
+}
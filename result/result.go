@@ -44,6 +44,7 @@ func PrintResult() {
 	SetEndTime(time.Now())
 	log.Info("Result:")
 	log.Info("TPS: %f\n", CalculateTPS())
-	log.Info("Latency: %f\n", endTime.Sub(startTime).Seconds())
+	log.Info("Elapsed: %f\n", endTime.Sub(startTime).Seconds())
 	log.Info("Committed Transaction Num: %d\n", committedTransactionNum.Load())
+	LogHistograms(log)
 }
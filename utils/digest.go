@@ -1,19 +1,23 @@
 package utils
 
 import (
-	"bytes"
-	"encoding/gob"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 
 	"github.com/michael112233/pbft/core"
 )
 
+// GetDigest hashes a canonical encoding of the request. gob is not used here
+// since its output embeds type ids that depend on which types a process
+// encoded before, so a replica that received the request inside a state
+// transfer would compute another digest.
 func GetDigest(data *core.RequestMessage) string {
-	var tmp_data = *data
-	var buf bytes.Buffer
-	encrypt := gob.NewEncoder(&buf)
-	err := encrypt.Encode(&tmp_data)
+	encoded, err := json.Marshal(data)
 	if err != nil {
 		return ""
 	}
-	return string(buf.Bytes())
-}
\ No newline at end of file
+	// hex keeps the digest valid in text based wire formats
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
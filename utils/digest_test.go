@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/michael112233/pbft/core"
+)
+
+// TestGetDigestEncoding pins the digest to the JSON documented in
+// proto/pbft.proto, which tools in other languages reproduce
+func TestGetDigestEncoding(t *testing.T) {
+	tests := []struct {
+		request *core.RequestMessage
+		json    string
+	}{
+		{
+			request: &core.RequestMessage{
+				Timestamp: 1,
+				From:      0,
+				To:        -1,
+				Txs:       []*core.Transaction{core.NewTransaction("a1", "a2", big.NewInt(5))},
+				Id:        7,
+			},
+			json: `{"Timestamp":1,"From":0,"To":-1,"Txs":[{"Sender":"a1","Receiver":"a2","Amount":5}],"Id":7,"Reconfig":null}`,
+		},
+		{
+			request: &core.RequestMessage{
+				Timestamp: 1,
+				From:      0,
+				To:        -1,
+				Id:        8,
+				Reconfig:  &core.Reconfiguration{Add: []core.Member{{ID: 4, Addr: "host:28400"}}},
+			},
+			json: `{"Timestamp":1,"From":0,"To":-1,"Txs":null,"Id":8,"Reconfig":{"Add":[{"ID":4,"Addr":"host:28400"}],"Remove":null,"FaultyNodesNum":0}}`,
+		},
+		{
+			request: &core.RequestMessage{
+				Txs: []*core.Transaction{core.NewTransaction("<a>", "b&c", new(big.Int).Lsh(big.NewInt(1), 80))},
+			},
+			json: `{"Timestamp":0,"From":0,"To":0,"Txs":[{"Sender":"\u003ca\u003e","Receiver":"b\u0026c","Amount":1208925819614629174706176}],"Id":0,"Reconfig":null}`,
+		},
+	}
+	for _, tt := range tests {
+		sum := sha256.Sum256([]byte(tt.json))
+		if got, want := GetDigest(tt.request), hex.EncodeToString(sum[:]); got != want {
+			t.Errorf("digest of %s is %s, want %s", tt.json, got, want)
+		}
+	}
+}
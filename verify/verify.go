@@ -0,0 +1,195 @@
+package verify
+
+import (
+	"fmt"
+
+	"github.com/michael112233/pbft/ledger"
+)
+
+// --------------------------------------------------------
+// Report Definition
+// --------------------------------------------------------
+
+const (
+	InvariantAgreement  string = "agreement"
+	InvariantOrder      string = "order"
+	InvariantNoGaps     string = "no-gaps"
+	InvariantClientSeen string = "client-accepted"
+)
+
+type Violation struct {
+	Invariant string
+	Detail    string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("[%s] %s", v.Invariant, v.Detail)
+}
+
+type Report struct {
+	Replicas   int
+	Commits    int
+	Accepted   int
+	Violations []Violation
+}
+
+func (r *Report) OK() bool {
+	return len(r.Violations) == 0
+}
+
+func (r *Report) addViolation(invariant string, format string, args ...interface{}) {
+	r.Violations = append(r.Violations, Violation{
+		Invariant: invariant,
+		Detail:    fmt.Sprintf(format, args...),
+	})
+}
+
+// --------------------------------------------------------
+// Invariant Checking
+// --------------------------------------------------------
+
+// CheckDir loads the ledgers written into dir and checks them.
+func CheckDir(dir string) (*Report, error) {
+	history, err := ledger.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return Check(history), nil
+}
+
+// Check verifies the PBFT safety invariants over the committed histories:
+//   - no two replicas committed different digests for the same sequence number
+//   - every replica executed the sequence numbers in the same order
+//   - no replica has a gap below its last stable checkpoint
+//   - every result accepted by the client was committed with the same digest
+func Check(history *ledger.History) *Report {
+	report := &Report{
+		Replicas: len(history.Replicas),
+	}
+
+	ids := history.ReplicaIDs()
+	orders := make(map[int64][]int64, len(ids))
+	committed := make(map[int64]map[int64]string, len(ids))
+	checkpoints := make(map[int64]int64, len(ids))
+
+	for _, id := range ids {
+		committed[id] = make(map[int64]string)
+		checkpoints[id] = -1
+		for _, record := range history.Replicas[id] {
+			switch record.Kind {
+			case ledger.KindCommit:
+				if digest, ok := committed[id][record.Seq]; ok {
+					if digest != record.Digest {
+						report.addViolation(InvariantAgreement, "replica %d committed sequence %d twice with different digests", id, record.Seq)
+					}
+					continue
+				}
+				committed[id][record.Seq] = record.Digest
+				orders[id] = append(orders[id], record.Seq)
+				report.Commits++
+			case ledger.KindCheckpoint:
+				if record.Seq > checkpoints[id] {
+					checkpoints[id] = record.Seq
+				}
+			}
+		}
+	}
+
+	checkAgreement(report, ids, committed)
+	checkOrder(report, ids, orders, committed)
+	checkGaps(report, ids, orders, committed, checkpoints)
+	checkClient(report, history.Client, committed)
+	return report
+}
+
+func checkAgreement(report *Report, ids []int64, committed map[int64]map[int64]string) {
+	// the first replica that committed a sequence number is taken as reference
+	reference := make(map[int64]int64)
+	for _, id := range ids {
+		for seq, digest := range committed[id] {
+			refID, ok := reference[seq]
+			if !ok {
+				reference[seq] = id
+				continue
+			}
+			if committed[refID][seq] != digest {
+				report.addViolation(InvariantAgreement, "sequence %d committed with digest %s by replica %d but %s by replica %d", seq, committed[refID][seq], refID, digest, id)
+			}
+		}
+	}
+}
+
+func checkOrder(report *Report, ids []int64, orders map[int64][]int64, committed map[int64]map[int64]string) {
+	// a replica may lag behind or miss an instance, so only the sequence
+	// numbers executed by both replicas have to appear in the same order
+	for i := 0; i < len(ids); i++ {
+		for j := i + 1; j < len(ids); j++ {
+			a := commonOrder(orders[ids[i]], committed[ids[j]])
+			b := commonOrder(orders[ids[j]], committed[ids[i]])
+			for k := 0; k < len(a) && k < len(b); k++ {
+				if a[k] != b[k] {
+					report.addViolation(InvariantOrder, "replica %d executed sequence %d where replica %d executed %d", ids[i], a[k], ids[j], b[k])
+					break
+				}
+			}
+		}
+	}
+}
+
+// commonOrder filters order down to the sequence numbers also committed by the other replica.
+func commonOrder(order []int64, other map[int64]string) []int64 {
+	common := make([]int64, 0, len(order))
+	for _, seq := range order {
+		if _, ok := other[seq]; ok {
+			common = append(common, seq)
+		}
+	}
+	return common
+}
+
+func checkGaps(report *Report, ids []int64, orders map[int64][]int64, committed map[int64]map[int64]string, checkpoints map[int64]int64) {
+	// a replica missing the first sequence numbers the others committed has
+	// a gap too, so every replica is checked from the lowest one of all
+	first := int64(-1)
+	for _, id := range ids {
+		for _, seq := range orders[id] {
+			if first == -1 || seq < first {
+				first = seq
+			}
+		}
+	}
+	for _, id := range ids {
+		if checkpoints[id] == -1 || len(orders[id]) == 0 {
+			continue
+		}
+		for seq := first; seq <= checkpoints[id]; seq++ {
+			if _, ok := committed[id][seq]; !ok {
+				report.addViolation(InvariantNoGaps, "replica %d has stable checkpoint %d but never committed sequence %d", id, checkpoints[id], seq)
+			}
+		}
+	}
+}
+
+func checkClient(report *Report, accepted []ledger.Record, committed map[int64]map[int64]string) {
+	for _, record := range accepted {
+		if record.Kind != ledger.KindAccept {
+			continue
+		}
+		report.Accepted++
+		found := false
+		for id, seqs := range committed {
+			digest, ok := seqs[record.Seq]
+			if !ok {
+				continue
+			}
+			if digest != record.Digest {
+				report.addViolation(InvariantClientSeen, "client accepted sequence %d with digest %s but replica %d committed %s", record.Seq, record.Digest, id, digest)
+				continue
+			}
+			found = true
+		}
+		if !found {
+			report.addViolation(InvariantClientSeen, "client accepted sequence %d but no replica ledger contains it", record.Seq)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package verify
+
+import (
+	"testing"
+
+	"github.com/michael112233/pbft/ledger"
+)
+
+func commit(seq int64, digest string) ledger.Record {
+	return ledger.Record{Kind: ledger.KindCommit, Seq: seq, Digest: digest}
+}
+
+func checkpoint(seq int64) ledger.Record {
+	return ledger.Record{Kind: ledger.KindCheckpoint, Seq: seq}
+}
+
+func accept(seq int64, digest string) ledger.Record {
+	return ledger.Record{Kind: ledger.KindAccept, Seq: seq, Digest: digest}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		replicas map[int64][]ledger.Record
+		client   []ledger.Record
+		// invariants of the expected violations, in order
+		want []string
+	}{
+		{
+			name: "consistent",
+			replicas: map[int64][]ledger.Record{
+				0: {commit(1, "a"), commit(2, "b"), checkpoint(2)},
+				1: {commit(1, "a"), commit(2, "b"), checkpoint(2)},
+				// a lagging replica is fine
+				2: {commit(1, "a")},
+			},
+			client: []ledger.Record{accept(1, "a"), accept(2, "b")},
+		},
+		{
+			name: "different digests across replicas",
+			replicas: map[int64][]ledger.Record{
+				0: {commit(1, "a")},
+				1: {commit(1, "x")},
+			},
+			want: []string{InvariantAgreement},
+		},
+		{
+			name: "same replica commits twice with different digests",
+			replicas: map[int64][]ledger.Record{
+				0: {commit(1, "a"), commit(1, "x")},
+			},
+			want: []string{InvariantAgreement},
+		},
+		{
+			name: "different execution order",
+			replicas: map[int64][]ledger.Record{
+				0: {commit(1, "a"), commit(2, "b")},
+				1: {commit(2, "b"), commit(1, "a")},
+			},
+			want: []string{InvariantOrder},
+		},
+		{
+			name: "order only over common sequence numbers",
+			replicas: map[int64][]ledger.Record{
+				0: {commit(1, "a"), commit(2, "b"), commit(3, "c")},
+				1: {commit(1, "a"), commit(3, "c")},
+			},
+		},
+		{
+			name: "gap below the stable checkpoint",
+			replicas: map[int64][]ledger.Record{
+				0: {commit(1, "a"), commit(3, "c"), checkpoint(3)},
+			},
+			want: []string{InvariantNoGaps},
+		},
+		{
+			name: "missing the first sequence numbers of the others",
+			replicas: map[int64][]ledger.Record{
+				0: {commit(1, "a"), commit(2, "b"), checkpoint(2)},
+				1: {commit(2, "b"), checkpoint(2)},
+			},
+			want: []string{InvariantNoGaps},
+		},
+		{
+			name: "client accepted another digest",
+			replicas: map[int64][]ledger.Record{
+				0: {commit(1, "a")},
+			},
+			client: []ledger.Record{accept(1, "x")},
+			want:   []string{InvariantClientSeen, InvariantClientSeen},
+		},
+		{
+			name: "client accepted an uncommitted sequence number",
+			replicas: map[int64][]ledger.Record{
+				0: {commit(1, "a")},
+			},
+			client: []ledger.Record{accept(1, "a"), accept(2, "b")},
+			want:   []string{InvariantClientSeen},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := Check(&ledger.History{Replicas: tt.replicas, Client: tt.client})
+			got := make([]string, 0, len(report.Violations))
+			for _, v := range report.Violations {
+				got = append(got, v.Invariant)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("violations %v, want invariants %v", report.Violations, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("violations %v, want invariants %v", report.Violations, tt.want)
+				}
+			}
+			if report.OK() != (len(tt.want) == 0) {
+				t.Fatalf("OK() = %v with violations %v", report.OK(), report.Violations)
+			}
+		})
+	}
+}